@@ -3,16 +3,22 @@ package app
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -34,6 +40,9 @@ const (
 	RequestTrackingHistory = 1000
 )
 
+// defaultDeadLetterLimit is how many dead letters /chatops/deadletters lists without a limit
+const defaultDeadLetterLimit = 100
+
 var _ interfaces.ChatOpsCom = &ChatOps{}
 
 type nopCom struct {
@@ -49,31 +58,62 @@ func (n *nopCom) EnvironmentParams() map[string]string {
 
 // TODO:(smt) Config to toggle OnDemandTemplates
 type ChatOps struct {
-	Kafka                  bool   `envconfig:"KAFKA"`
-	SlackAppId             string `envconfig:"SLACK_APP_ID"`
-	SlackVerificationToken string `envconfig:"SLACK_VFY_TOKEN"`
-	SlackSecretSigningKey  string `envconfig:"SLACK_SECRET_SIGNING_KEY"`
-	SlackClientId          string `envconfig:"SLACK_CLIENT_ID"`
-	SlackClientSecret      string `envconfig:"SLACK_CLIENT_SECRET"`
-	SlackAuthRedirectUrl   string `envconfig:"SLACK_AUTH_REDIRECT_URL"`
+	Kafka                  bool          `envconfig:"KAFKA"`
+	SlackAppId             string        `envconfig:"SLACK_APP_ID"`
+	SlackVerificationToken string        `envconfig:"SLACK_VFY_TOKEN"`
+	SlackSecretSigningKey  string        `envconfig:"SLACK_SECRET_SIGNING_KEY"`
+	SlackPrevSigningKeys   string        `envconfig:"SLACK_PREV_SIGNING_KEYS"`
+	SlackMaxRequestAge     time.Duration `envconfig:"SLACK_MAX_REQUEST_AGE"`
+	SlackDedupWindow       time.Duration `envconfig:"SLACK_DEDUP_WINDOW"`
+	SlackMentionTemplate   string        `envconfig:"SLACK_MENTION_TEMPLATE"`
+	SlackTokenSweep        time.Duration `envconfig:"SLACK_TOKEN_SWEEP"`
+	SlackWorkspaceTTL      time.Duration `envconfig:"SLACK_WORKSPACE_TTL"`
+	SlackClientId          string        `envconfig:"SLACK_CLIENT_ID"`
+	SlackClientSecret      string        `envconfig:"SLACK_CLIENT_SECRET"`
+	SlackAuthRedirectUrl   string        `envconfig:"SLACK_AUTH_REDIRECT_URL"`
+	SlackCallbackUrl       string        `envconfig:"SLACK_CALLBACK_URL"`
+	SlackScopes            string        `envconfig:"SLACK_SCOPES"`
 	//SlackToken             string `envconfig:"SLACK_TOKEN"`
 	//SlackInHook            string `envconfig:"SLACK_IN_HOOK"`
-	FeedbackTopic    string `envconfig:"FEEDBACK_TOPIC"`
-	Port             int    `envconfig:"PORT"`
-	ElasticSearchUrl string `envconfig:"ELASTICSEARCH_URL"`
-	ViewUrl          string `envconfig:"VIEW_URL"`
-	HealthUrl        string `envconfig:"HEALTH_URL"`
-	TemplateDir      string `envconfig:"TEMPLATE_DIR"`
-	RelayPort        int    `envconfig:"RELAY_PORT"`
-	RelayHost        string `envconfig:"RELAY_HOST"`
-	RelayPassthrough bool   `envconfig:"RELAY_PASSTHROUGH"`
-	RelayHandler     bool   `envconfig:"RELAY_HANDLER"`
-	RelayCertFile    string `envconfig:"RELAY_CERT_FILE"`
-	RelayKeyFile     string `envconfig:"RELAY_KEY_FILE"`
-	RelayInsecure    bool   `envconfig:"RELAY_INSECURE"`
-	RelayWhiteList   string `envconfig:"RELAY_WHITELIST"`
-	DbFile           string `envconfig:"DB_FILE"`
-	Debug            bool   `envconfig:"DEBUG"`
+	FeedbackTopic    string        `envconfig:"FEEDBACK_TOPIC"`
+	Port             int           `envconfig:"PORT"`
+	ElasticSearchUrl string        `envconfig:"ELASTICSEARCH_URL"`
+	ViewUrl          string        `envconfig:"VIEW_URL"`
+	HealthUrl        string        `envconfig:"HEALTH_URL"`
+	TemplateDir      string        `envconfig:"TEMPLATE_DIR"`
+	RelayPort        int           `envconfig:"RELAY_PORT"`
+	RelayHost        string        `envconfig:"RELAY_HOST"`
+	RelayPassthrough bool          `envconfig:"RELAY_PASSTHROUGH"`
+	RelayHandler     bool          `envconfig:"RELAY_HANDLER"`
+	RelayCertFile    string        `envconfig:"RELAY_CERT_FILE"`
+	RelayKeyFile     string        `envconfig:"RELAY_KEY_FILE"`
+	RelayInsecure    bool          `envconfig:"RELAY_INSECURE"`
+	RelayMutualTLS   bool          `envconfig:"RELAY_MTLS"`
+	RelayCAFile      string        `envconfig:"RELAY_CA_FILE"`
+	RelayPeers       string        `envconfig:"RELAY_PEERS"`
+	RelaySecret      string        `envconfig:"RELAY_SECRET"`
+	RelayEgress      bool          `envconfig:"RELAY_EGRESS"`
+	RelayEgressHosts string        `envconfig:"RELAY_EGRESS_HOSTS"`
+	RelayWhiteList   string        `envconfig:"RELAY_WHITELIST"`
+	RelayAllow       string        `envconfig:"RELAY_ALLOW"`
+	RelayDeny        string        `envconfig:"RELAY_DENY"`
+	RelayACLFile     string        `envconfig:"RELAY_ACL_FILE"`
+	RelayTimeout     time.Duration `envconfig:"RELAY_TIMEOUT"`
+	RelayBackoff     time.Duration `envconfig:"RELAY_BACKOFF"`
+	RelayBackoffMax  time.Duration `envconfig:"RELAY_BACKOFF_MAX"`
+	RelayBackoffMult float64       `envconfig:"RELAY_BACKOFF_MULTIPLIER"`
+	RelayJitter      float64       `envconfig:"RELAY_JITTER"`
+	RelayQueueDir    string        `envconfig:"RELAY_QUEUE_DIR"`
+	RelayQueueSize   int           `envconfig:"RELAY_QUEUE_SIZE"`
+	RelayCompress    int           `envconfig:"RELAY_COMPRESS_THRESHOLD"`
+	RelayRecordFile  string        `envconfig:"RELAY_RECORD_FILE"`
+	RelayRecordSize  int64         `envconfig:"RELAY_RECORD_SIZE"`
+	RelayRecordFiles int           `envconfig:"RELAY_RECORD_FILES"`
+	DbFile           string        `envconfig:"DB_FILE"`
+	DbKey            string        `envconfig:"DB_KEY"`
+	DbKeyFile        string        `envconfig:"DB_KEY_FILE"`
+	DbPrevKeys       string        `envconfig:"DB_PREV_KEYS"`
+	Debug            bool          `envconfig:"DEBUG"`
 
 	sc stream.KafkaStreamConfig
 
@@ -85,6 +125,8 @@ type ChatOps struct {
 	database db.Database
 	doneCh   chan int
 	kafkaCh  chan KafkaMessage
+	kafkaErr atomic.Value // last kafka produce error, nil once a produce succeeds
+	replay   bool         // replaying recordings, slack makes no outbound calls
 }
 
 func NewChatOps(name string) *ChatOps {
@@ -104,9 +146,17 @@ func (c *ChatOps) SetFlags() {
 	//flag.StringVar(&c.SlackToken, "st", "", "slack bot token")
 	//flag.StringVar(&c.SlackInHook, "sin", "", "slack incoming web hook url")
 	flag.StringVar(&c.SlackSecretSigningKey, "ssk", "", "slack secret signing key")
+	flag.StringVar(&c.SlackPrevSigningKeys, "sskprev", "", "comma separated previous slack signing keys still accepted while a new key is rolled out")
+	flag.DurationVar(&c.SlackMaxRequestAge, "sage", bot.DefaultMaxRequestAge, "slack requests with a timestamp further than this from now are refused")
+	flag.DurationVar(&c.SlackDedupWindow, "sdedup", bot.DefaultDedupWindow, "how long slack event and trigger ids are remembered, a retried delivery within this window is acknowledged but not handled again. Each handler remembers its own, a retry relayed to another handler is handled again")
+	flag.StringVar(&c.SlackMentionTemplate, "smention", bot.DefaultMentionTemplate, "template run for app mentions that don't name a template")
+	flag.DurationVar(&c.SlackWorkspaceTTL, "sttl", bot.DefaultWorkspaceTTL, "how long a workspace's slack client is used before it is loaded from the database again")
+	flag.DurationVar(&c.SlackTokenSweep, "ssweep", bot.DefaultTokenSweepInterval, "how often workspace bot tokens are checked with auth.test, workspaces whose token no longer works are flagged inactive, negative disables")
 	flag.StringVar(&c.SlackClientId, "sci", "", "slack client id")
 	flag.StringVar(&c.SlackClientSecret, "scs", "", "slack client secret")
 	flag.StringVar(&c.SlackAuthRedirectUrl, "sru", "https://slack.com/", "slack redirect url after successful oauth")
+	flag.StringVar(&c.SlackCallbackUrl, "scallback", "", "url of this server's /slack/callback sent to slack as the oauth redirect_uri, empty uses the app's configured redirect url")
+	flag.StringVar(&c.SlackScopes, "sscopes", bot.DefaultScopes, "comma separated bot scopes requested when the app is installed")
 	flag.StringVar(&c.FeedbackTopic, "ft", "slack", "kafka topic on which to send feedback interactions")
 	flag.StringVar(&c.ElasticSearchUrl, "es", "", "elastic search url")
 	flag.StringVar(&c.ViewUrl, "view", "", "view url")
@@ -119,9 +169,32 @@ func (c *ChatOps) SetFlags() {
 	flag.StringVar(&c.RelayCertFile, "cert", "cert.crt", "x509 key pair cert file")
 	flag.StringVar(&c.RelayKeyFile, "key", "cert.key", "x509 key pair key file")
 	flag.BoolVar(&c.RelayInsecure, "insecure", false, "tls skip verify")
+	flag.BoolVar(&c.RelayMutualTLS, "mtls", false, "require both relay ends to present certificates signed by the relay ca, handlers present -cert and -key")
+	flag.StringVar(&c.RelayCAFile, "ca", "ca.crt", "ca bundle used to verify relay peer certificates when using mutual tls")
+	flag.StringVar(&c.RelayPeers, "rpeers", "", "comma separated certificate CNs/SANs allowed to attach as handlers, empty allows any signed by the ca (passthrough only)")
+	flag.StringVar(&c.RelaySecret, "rsecret", "", "secret shared by the passthrough and its handlers, peers without it are refused (prefer ATSU_RELAY_SECRET)")
+	flag.BoolVar(&c.RelayEgress, "regress", false, "send the handler's outbound slack calls through the passthrough, set on both ends")
+	flag.StringVar(&c.RelayEgressHosts, "regresshosts", strings.Join(relay.DefaultEgressHosts, ","), "comma separated hosts, and their subdomains, the passthrough sends outbound calls to (passthrough only)")
 	flag.StringVar(&c.RelayWhiteList, "whitelist", ".+", "apply whitelist filter to addresses connecting to the relay (passthrough only)")
+	flag.StringVar(&c.RelayAllow, "rallow", "", "comma separated CIDR blocks allowed to connect to the relay, empty allows any (passthrough only)")
+	flag.StringVar(&c.RelayDeny, "rdeny", "", "comma separated CIDR blocks refused by the relay (passthrough only)")
+	flag.StringVar(&c.RelayACLFile, "racl", "", "yaml file of additional allow/deny blocks, reloaded by POST /chatops/relayacl (passthrough only)")
+	flag.DurationVar(&c.RelayTimeout, "rtimeout", relay.DefaultRequestTimeout, "maximum time a relayed request may take (passthrough only)")
+	flag.DurationVar(&c.RelayBackoff, "rbackoff", relay.DefaultBackoff.Initial, "wait before the first reconnect attempt (handler only)")
+	flag.DurationVar(&c.RelayBackoffMax, "rbackoffmax", relay.DefaultBackoff.Max, "maximum wait between reconnect attempts (handler only)")
+	flag.Float64Var(&c.RelayBackoffMult, "rbackoffmult", relay.DefaultBackoff.Multiplier, "growth of the wait after each failed reconnect attempt (handler only)")
+	flag.Float64Var(&c.RelayJitter, "rjitter", relay.DefaultBackoff.Jitter, "fraction 0-1 of each reconnect wait that is randomized (handler only)")
+	flag.StringVar(&c.RelayQueueDir, "rqueue", "", "directory to queue events in while no handler is connected, empty disables queueing (passthrough only)")
+	flag.IntVar(&c.RelayQueueSize, "rqueuesize", 1000, "maximum number of queued events, the oldest are dropped once full (passthrough only)")
+	flag.IntVar(&c.RelayCompress, "rcompress", relay.DefaultCompressThreshold, "size in bytes above which relayed bodies are compressed, 0 disables compression")
+	flag.StringVar(&c.RelayRecordFile, "rrecord", "", "file to record relayed requests and responses to, secrets redacted, empty disables recording (passthrough only)")
+	flag.Int64Var(&c.RelayRecordSize, "rrecordsize", 100<<20, "size in bytes at which the recording file is rotated (passthrough only)")
+	flag.IntVar(&c.RelayRecordFiles, "rrecordfiles", 5, "number of rotated recording files to keep (passthrough only)")
 	flag.BoolVar(&c.Debug, "debug", false, "verbose output")
 	flag.StringVar(&c.DbFile, "db", "./chatops.db", "database target file")
+	flag.StringVar(&c.DbKey, "dbkey", "", "base64 aes key the stored slack tokens are encrypted with, unset stores them in plaintext")
+	flag.StringVar(&c.DbKeyFile, "dbkeyfile", "", "file holding the base64 database key, used if -dbkey is not set")
+	flag.StringVar(&c.DbPrevKeys, "dbkeyprev", "", "comma separated previous base64 database keys, tokens encrypted with them are encrypted with the current key on start")
 
 	flag.IntVar(&c.Port, "port", 8040, "port for status api.")
 
@@ -160,6 +233,12 @@ func (c *ChatOps) Run() {
 	if *version {
 		return
 	}
+	if flag.Arg(0) == "replay" {
+		if err := c.Replay(flag.Arg(1)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	if c.Debug {
 		b, _ := json.Marshal(c)
@@ -187,19 +266,57 @@ func (c *ChatOps) Run() {
 	if err := c.hr.Stop(); err != nil {
 		log.Println(err)
 	}
-	c.relay.Close()
+	// the queued responses drain first, they may still need the relay's egress connection
 	c.sl.Stop()
+	c.relay.Close()
 }
 
 func (c *ChatOps) InitDb() {
-	// TODO:(smt) Encrypt db file doesn't work?
-	dbUser := "dbadmin123"
-	dbPass := "sdlkjerwoeifjsldffneflsefwiejf3jwlkj3"
 	log.Println("loading database:", c.DbFile)
-	c.database = db.NewSqliteDB(fmt.Sprintf("file:%s?_auth&_auth_user=%s&_auth_pass=%s", c.DbFile, dbUser, dbPass))
-	if err := c.database.Init(); err != nil {
+	sdb := db.NewSqliteDB(c.DbFile)
+	key, prev, err := c.dbKeys()
+	if err != nil {
 		log.Fatal(err)
 	}
+	if key == nil {
+		log.Println("database key not set, slack tokens are stored in plaintext")
+	}
+	if err := sdb.SetKeys(key, prev); err != nil {
+		log.Fatal(err)
+	}
+	if err := sdb.Init(); err != nil {
+		log.Fatal(err)
+	}
+	c.database = sdb
+}
+
+// dbKeys returns the database key, from -dbkey or -dbkeyfile, and the previous keys
+func (c *ChatOps) dbKeys() ([]byte, [][]byte, error) {
+	var key []byte
+	encoded := c.DbKey
+	if encoded == "" && c.DbKeyFile != "" {
+		b, err := ioutil.ReadFile(util.GetAbsoluteFilePath(c.DbKeyFile))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read database key: %v", err)
+		}
+		encoded = string(b)
+	}
+	if encoded != "" {
+		k, err := db.ParseKey(encoded)
+		if err != nil {
+			return nil, nil, fmt.Errorf("database key: %v", err)
+		}
+		key = k
+	}
+	var prev [][]byte
+	for _, p := range splitList(c.DbPrevKeys) {
+		k, err := db.ParseKey(p)
+		if err != nil {
+			return nil, nil, fmt.Errorf("previous database key: %v", err)
+		}
+		prev = append(prev, k)
+	}
+	return key, prev, nil
 }
 
 func (c *ChatOps) InitKafka() {
@@ -222,14 +339,39 @@ func (c *ChatOps) monitorKafkaChan() {
 				return
 			case m := <-c.kafkaCh:
 				topic := c.sc.FullTopic(fmt.Sprintf("chatops.%s", m.Topic))
-				if err := c.sc.Produce(&topic, []byte(m.Message)); err != nil {
+				err := c.sc.Produce(&topic, []byte(m.Message))
+				if err != nil {
 					log.Printf("failed to send to kafka topic: %q msg: %q\n", topic, m)
 				}
+				c.kafkaErr.Store(kafkaError{err})
 			}
 		}
 	}()
 }
 
+type kafkaError struct {
+	err error
+}
+
+// LocalHealth summarizes the health of slack, the helpers and kafka on this instance
+func (c *ChatOps) LocalHealth() relay.HealthSummary {
+	components := make(map[string]relay.ComponentHealth)
+	if c.sl != nil {
+		st := c.sl.Status()
+		components["slack"] = relay.ComponentHealth{Health: st.Health, Message: st.Message}
+		hs := bot.HelperMetrics.Status()
+		components["helpers"] = relay.ComponentHealth{Health: hs.Health, Message: hs.Message}
+	}
+	if c.Kafka {
+		kh := relay.ComponentHealth{Health: health.Green}
+		if ke, ok := c.kafkaErr.Load().(kafkaError); ok && ke.err != nil {
+			kh = relay.ComponentHealth{Health: health.Yellow, Message: fmt.Sprintf("produce failing: %v", ke.err)}
+		}
+		components["kafka"] = kh
+	}
+	return relay.NewHealthSummary(components)
+}
+
 // KafkaProduce is a mechanism for allowing subcomponents to send messages to kafka, without exposing the underlying channel
 func (c *ChatOps) KafkaProduce(topic, message string) {
 	go func() { c.kafkaCh <- KafkaMessage{topic, message} }()
@@ -278,16 +420,36 @@ func (c *ChatOps) InitSlack() {
 		//InWebHook:         c.SlackInHook,
 		AppId:             c.SlackAppId,
 		SecretSigningKey:  c.SlackSecretSigningKey,
+		PrevSigningKeys:   splitList(c.SlackPrevSigningKeys),
+		MaxRequestAge:     c.SlackMaxRequestAge,
+		DedupWindow:       c.SlackDedupWindow,
+		MentionTemplate:   c.SlackMentionTemplate,
+		SweepInterval:     c.SlackTokenSweep,
+		WorkspaceTTL:      c.SlackWorkspaceTTL,
 		VerificationToken: c.SlackVerificationToken,
 		ClientId:          c.SlackClientId,
 		ClientSecret:      c.SlackClientSecret,
 		AuthRedirectUrl:   c.SlackAuthRedirectUrl,
+		CallbackUrl:       c.SlackCallbackUrl,
+		Scopes:            splitList(c.SlackScopes),
 		FeedbackTopic:     c.FeedbackTopic,
 		TemplateDir:       c.TemplateDir,
+		Replay:            c.replay,
 	}
 	// TODO: cfg.Validate()
 	c.sl = bot.NewSlack(cfg, com, c.database)
 	c.sl.SetDebug(c.Debug)
+	if c.relay.Mode == relay.Handler {
+		// the passthrough reports the handler's health alongside its own
+		c.relay.SetHealthFunc(c.LocalHealth)
+	}
+	if c.RelayEgress && c.relay.Mode == relay.Handler {
+		// outbound calls leave through the passthrough
+		c.sl.SetHTTPClient(&http.Client{Transport: c.relay.Transport()})
+	}
+	if c.replay {
+		c.sl.SetHTTPClient(&http.Client{Transport: offlineTransport{}})
+	}
 	if err := c.sl.Start(c.router, c.relay); err != nil {
 		log.Fatal("failed to initialize slack:", err)
 	}
@@ -298,10 +460,16 @@ func (c *ChatOps) StartRelay() {
 	if c.RelayInsecure {
 		log.Println("relay insecure mode is ON")
 	}
+	if c.RelayMutualTLS {
+		log.Printf("relay mutual tls is ON, ca: %q\n", c.RelayCAFile)
+	}
+	if c.RelaySecret == "" {
+		log.Println("relay shared secret is not set, peers are not authenticated")
+	}
 	target := fmt.Sprintf("%s:%d", c.RelayHost, c.RelayPort)
 	if c.RelayPassthrough {
 		log.Printf("listening for relay connection on %q\n", target)
-		log.Printf("passthrough whitelist: %q\n", c.RelayWhiteList)
+		log.Printf("passthrough access list: %s\n", c.relay.AccessList())
 		if err := c.relay.Listen(); err != nil {
 			log.Fatal(err)
 		}
@@ -316,27 +484,206 @@ func (c *ChatOps) InitRelay() {
 	if c.RelayHandler && c.RelayPassthrough {
 		log.Fatal("relay handler and passthrough modes are mutually exclusive.")
 	}
+	if c.RelayMutualTLS && c.RelayInsecure {
+		log.Fatal("relay insecure mode cannot be used with mutual tls.")
+	}
 	conf := &tls.Config{InsecureSkipVerify: c.RelayInsecure}
 	var mode relay.RelayMode
 	switch {
 	case c.RelayHandler:
 		mode = relay.Handler
 		// conf.ServerName = c.RelayHost // Do we want SNI? (https://en.wikipedia.org/wiki/Server_Name_Indication)
+		if c.RelayMutualTLS {
+			conf.Certificates = []tls.Certificate{c.loadRelayCert(true)}
+			conf.RootCAs = c.loadRelayCA()
+		}
 	case c.RelayPassthrough:
 		mode = relay.PassThrough
-		cf := util.GetAbsoluteFilePath(c.RelayCertFile)
-		kf := util.GetAbsoluteFilePath(c.RelayKeyFile)
-		certs, err := tls.LoadX509KeyPair(cf, kf)
-		if err != nil {
-			log.Println("error loading X509KeyPair:", err)
+		conf.Certificates = []tls.Certificate{c.loadRelayCert(c.RelayMutualTLS)}
+		if c.RelayMutualTLS {
+			conf.ClientAuth = tls.RequireAndVerifyClientCert
+			conf.ClientCAs = c.loadRelayCA()
+			if c.RelayPeers != "" {
+				conf.VerifyPeerCertificate = relay.VerifyPeerNames(strings.Split(c.RelayPeers, ","))
+				log.Printf("relay peers allowed: %q\n", c.RelayPeers)
+			}
 		}
-		conf.Certificates = []tls.Certificate{certs}
 	}
 	c.relay = relay.NewRelay(c.RelayHost, c.RelayPort, c.RelayWhiteList, mode, conf)
 	if err := c.relay.Init(); err != nil {
 		log.Fatalf("relay init failed mode: %s err: %v", mode, err)
 	}
 	c.relay.SetDebug(c.Debug)
+	c.relay.SetInfo(c.Info)
+	c.relay.SetSecret(c.RelaySecret)
+	c.relay.SetRequestTimeout(c.RelayTimeout)
+	c.relay.SetCompression(c.RelayCompress)
+	c.relay.SetBackoff(relay.Backoff{
+		Initial:    c.RelayBackoff,
+		Max:        c.RelayBackoffMax,
+		Multiplier: c.RelayBackoffMult,
+		Jitter:     c.RelayJitter,
+	})
+	if c.RelayEgress {
+		switch mode {
+		case relay.Handler:
+			c.relay.SetEgress(true)
+		case relay.PassThrough:
+			if err := c.relay.EnableEgress(splitList(c.RelayEgressHosts)); err != nil {
+				log.Fatal("relay egress init failed:", err)
+			}
+			log.Printf("relay egress enabled for: %q\n", c.RelayEgressHosts)
+		}
+	}
+	if mode == relay.PassThrough {
+		acl, err := c.relayAccessList()
+		if err != nil {
+			log.Fatal("relay access list failed:", err)
+		}
+		c.relay.SetAccessList(acl)
+	}
+	if mode == relay.PassThrough && c.RelayRecordFile != "" {
+		rec, err := relay.NewRecorder(util.GetAbsoluteFilePath(c.RelayRecordFile), c.RelayRecordSize, c.RelayRecordFiles)
+		if err != nil {
+			log.Fatalf("relay recorder init failed file: %s err: %v", c.RelayRecordFile, err)
+		}
+		c.relay.SetRecorder(rec)
+		log.Printf("recording relayed requests to %q\n", c.RelayRecordFile)
+	}
+	if mode == relay.PassThrough && c.RelayQueueDir != "" {
+		if err := c.relay.SetQueue(util.GetAbsoluteFilePath(c.RelayQueueDir), c.RelayQueueSize); err != nil {
+			log.Fatalf("relay queue init failed dir: %s err: %v", c.RelayQueueDir, err)
+		}
+	}
+}
+
+// Replay feeds the requests in a relay recording, in order, to the slack handlers as though they were
+// relayed from a passthrough, and reports the requests that got a different response than was recorded.
+// Kafka and outbound calls to slack are disabled so a replay has no effect outside this process.
+func (c *ChatOps) Replay(file string) error {
+	if file == "" {
+		return errors.New("usage: chatops [flags] replay <recording file>")
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	recordings, err := relay.ReadRecordings(f)
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+	c.Kafka = false
+	c.RelayEgress = false
+	c.relay = relay.NewRelay("", 0, ".+", relay.Handler, nil)
+	if err := c.relay.Init(); err != nil {
+		return err
+	}
+	c.relay.SetDebug(c.Debug)
+	// replayed installs, messages and responses go to a database of their own, never the -db one
+	dir, err := ioutil.TempDir("", "chatops-replay")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	c.DbFile = filepath.Join(dir, "replay.db")
+	c.replay = true
+	c.InitDb()
+	c.InitSlack()
+	defer c.sl.Stop()
+
+	results := c.relay.Replay(recordings, func(req *relay.FauxRequest) {
+		c.sl.SignRequest(req.Header, req.Body)
+	})
+	mismatched := 0
+	for i, res := range results {
+		if res.Matches() {
+			log.Printf("%d %s %s: ok\n", i+1, res.Recording.Request.Method, res.Recording.Request.URL)
+			continue
+		}
+		mismatched++
+		log.Printf("%d %s %s: recorded %s, replayed %s\n", i+1, res.Recording.Request.Method, res.Recording.Request.URL,
+			describeReplay(res.Recording.Response, res.Recording.Error), describeReplay(res.Response, errorString(res.Err)))
+	}
+	if mismatched > 0 {
+		return fmt.Errorf("%d of %d replayed requests did not match the recording", mismatched, len(results))
+	}
+	log.Printf("replayed %d requests\n", len(results))
+	return nil
+}
+
+// offlineTransport refuses outbound requests
+type offlineTransport struct{}
+
+func (offlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, fmt.Errorf("outbound request to %s not sent during replay", req.URL.Host)
+}
+
+func describeReplay(resp *relay.Response, err string) string {
+	if err != "" {
+		return "error: " + err
+	}
+	if resp == nil {
+		return "no response"
+	}
+	return fmt.Sprintf("%d %q", resp.Status, resp.Body)
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// relayAccessList combines the allow and deny flags, the access list file and the legacy whitelist.
+// The file is read on every call so the access list can be reloaded.
+func (c *ChatOps) relayAccessList() (*relay.AccessList, error) {
+	allow := splitList(c.RelayAllow)
+	deny := splitList(c.RelayDeny)
+	pattern := c.RelayWhiteList
+	if c.RelayACLFile != "" {
+		conf, err := relay.LoadAccessListConfig(util.GetAbsoluteFilePath(c.RelayACLFile))
+		if err != nil {
+			return nil, err
+		}
+		allow = append(allow, conf.Allow...)
+		deny = append(deny, conf.Deny...)
+		if conf.Match != "" {
+			pattern = conf.Match
+		}
+	}
+	return relay.NewAccessList(allow, deny, pattern)
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// loadRelayCert loads the relay x509 key pair, failing to load is fatal when required
+func (c *ChatOps) loadRelayCert(required bool) tls.Certificate {
+	cf := util.GetAbsoluteFilePath(c.RelayCertFile)
+	kf := util.GetAbsoluteFilePath(c.RelayKeyFile)
+	cert, err := tls.LoadX509KeyPair(cf, kf)
+	if err != nil {
+		if required {
+			log.Fatal("error loading X509KeyPair:", err)
+		}
+		log.Println("error loading X509KeyPair:", err)
+	}
+	return cert
+}
+
+// loadRelayCA loads the ca bundle used to verify relay peers, failing to load is fatal
+func (c *ChatOps) loadRelayCA() *x509.CertPool {
+	pool, err := relay.LoadCertPool(util.GetAbsoluteFilePath(c.RelayCAFile))
+	if err != nil {
+		log.Fatal("error loading relay ca:", err)
+	}
+	return pool
 }
 
 // StartStatusUpdater provides a continual loop for updating application health data.
@@ -351,14 +698,16 @@ func (c *ChatOps) StartStatusUpdater(interval time.Duration) {
 				msg := ""
 				rstatus := c.relay.Status()
 				if relay.RelayMode(rstatus.Mode) != relay.OFF {
+					// a passthrough's relay health includes the health its handlers report
 					c.hr.AddStat("relay", rstatus)
-					if rstatus.Health != h {
-						h = rstatus.Health
-					}
+					h, msg = rstatus.Health, rstatus.HealthMessage
 				}
 				if c.relay.Mode != relay.PassThrough && c.sl != nil {
 					c.hr.AddStat("slack", c.sl.Status())
 					c.hr.AddStat("helpers", bot.HelperMetrics.Status())
+					if local := c.LocalHealth(); relay.WorstHealth(h, local.Health) != h {
+						h, msg = local.Health, local.Message
+					}
 				}
 				c.hr.SetHealth(h, msg)
 				if c.Debug {
@@ -394,6 +743,47 @@ func (c *ChatOps) ChatOpsHandler(w http.ResponseWriter, r *http.Request) {
 				log.Println(err)
 			}
 		}
+	case "relayacl":
+		if r.Method == http.MethodPost {
+			if c.relay == nil || c.relay.Mode != relay.PassThrough {
+				http.Error(w, "relay is not in passthrough mode", http.StatusBadRequest)
+				return
+			}
+			acl, err := c.relayAccessList()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			c.relay.SetAccessList(acl)
+			if _, err := w.Write([]byte("relay access list reloaded")); err != nil {
+				log.Println(err)
+			}
+		}
+	case "deadletters":
+		if r.Method == http.MethodGet {
+			if c.sl == nil {
+				http.Error(w, "slack is not running", http.StatusServiceUnavailable)
+				return
+			}
+			limit := defaultDeadLetterLimit
+			if l := r.URL.Query().Get("limit"); l != "" {
+				n, err := strconv.Atoi(l)
+				if err != nil || n <= 0 {
+					http.Error(w, "invalid limit", http.StatusBadRequest)
+					return
+				}
+				limit = n
+			}
+			letters, err := c.sl.DeadLetters(limit)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(letters); err != nil {
+				log.Println(err)
+			}
+		}
 	}
 }
 
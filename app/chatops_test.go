@@ -1,6 +1,15 @@
 package app
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -86,3 +95,161 @@ func TestChatOps_StartStatusUpdater(t *testing.T) {
 		})
 	}
 }
+
+func TestChatOps_RelayACLReload(t *testing.T) {
+	tests := []struct {
+		name  string
+		mode  relay.RelayMode
+		allow string
+		code  int
+	}{
+		{"reloaded", relay.PassThrough, "10.0.0.0/8", http.StatusOK},
+		{"invalid block", relay.PassThrough, "10.0.0.0/33", http.StatusBadRequest},
+		{"not passthrough", relay.Handler, "10.0.0.0/8", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			co := NewChatOps("test")
+			co.relay = relay.NewRelay("", 0, ".+", test.mode, nil)
+			co.RelayAllow = test.allow
+			co.router.HandleFunc("/chatops/{action}", co.ChatOpsHandler)
+			req := httptest.NewRequest(http.MethodPost, "/chatops/relayacl", nil)
+			rr := httptest.NewRecorder()
+			co.router.ServeHTTP(rr, req)
+			assert.Equal(t, test.code, rr.Code)
+		})
+	}
+}
+
+func TestChatOps_LocalHealth(t *testing.T) {
+	co := NewChatOps("test")
+	co.Kafka = true
+	assert.Equal(t, health.Green, co.LocalHealth().Health)
+
+	co.kafkaErr.Store(kafkaError{errors.New("broker down")})
+	summary := co.LocalHealth()
+	assert.Equal(t, health.Yellow, summary.Health)
+	assert.Equal(t, "kafka: produce failing: broker down", summary.Message)
+
+	co.kafkaErr.Store(kafkaError{})
+	assert.Equal(t, health.Green, co.LocalHealth().Health)
+
+	// the helpers are red once elasticsearch keeps failing
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer es.Close()
+	co.sl = bot.NewSlack(bot.SlackConfig{}, nil, nil)
+	for i := 0; i < 3; i++ {
+		resp, err := bot.HelperMetrics.RoundTrip(httptest.NewRequest(http.MethodGet, es.URL, nil))
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+		}
+	}
+	summary = co.LocalHealth()
+	assert.Equal(t, health.Red, summary.Health)
+	assert.Contains(t, summary.Message, "helpers: elasticsearch failing, last 3 requests failed: status 503")
+}
+
+func TestChatOps_DbKeys(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	prev := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+	dir, err := ioutil.TempDir("", "chatops-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "db.key")
+	if err := ioutil.WriteFile(keyFile, []byte(key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		c     ChatOps
+		key   bool
+		prev  int
+		error bool
+	}{
+		{"no key", ChatOps{}, false, 0, false},
+		{"key", ChatOps{DbKey: key, DbPrevKeys: prev}, true, 1, false},
+		{"key file", ChatOps{DbKeyFile: keyFile}, true, 0, false},
+		{"missing key file", ChatOps{DbKeyFile: filepath.Join(dir, "missing")}, false, 0, true},
+		{"invalid key", ChatOps{DbKey: "c2hvcnQ="}, false, 0, true},
+		{"invalid previous key", ChatOps{DbKey: key, DbPrevKeys: prev + ",nope"}, false, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, p, err := tt.c.dbKeys()
+			if tt.error {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.key, k != nil)
+			assert.Len(t, p, tt.prev)
+		})
+	}
+}
+
+func TestChatOps_DeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatops-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	co := NewChatOps("test")
+	co.router.HandleFunc("/chatops/{action}", co.ChatOpsHandler)
+	get := func(url string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		co.router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, url, nil))
+		return rr
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, get("/chatops/deadletters").Code)
+
+	co.DbFile = filepath.Join(dir, "chatops.db")
+	co.InitDb()
+	co.sl = bot.NewSlack(bot.SlackConfig{}, nil, co.database)
+	for i, team := range []string{"T1", "T2"} {
+		id, err := co.database.EnqueueOutbound(team, []byte("{}"), 100)
+		assert.NoError(t, err)
+		assert.NoError(t, co.database.DeadLetterOutbound(id, 8, "status 503", int64(200+i)))
+	}
+
+	rr := get("/chatops/deadletters")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	var letters []bot.DeadLetter
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &letters))
+	if assert.Len(t, letters, 2) {
+		assert.Equal(t, "T2", letters[0].TeamId)
+		assert.Equal(t, 8, letters[0].Attempts)
+		assert.Equal(t, "status 503", letters[0].LastError)
+	}
+
+	rr = get("/chatops/deadletters?limit=1")
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &letters))
+	assert.Len(t, letters, 1)
+	assert.Equal(t, http.StatusBadRequest, get("/chatops/deadletters?limit=none").Code)
+}
+
+func TestChatOps_Replay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatops-replay-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recordings := filepath.Join(dir, "recordings.jsonl")
+	if err := ioutil.WriteFile(recordings, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	dbFile := filepath.Join(dir, "chatops.db")
+	co := NewChatOps("test")
+	co.DbFile = dbFile
+	co.TemplateDir = "../templates"
+	assert.NoError(t, co.Replay(recordings))
+	// the -db database is never touched
+	_, err = os.Stat(dbFile)
+	assert.True(t, os.IsNotExist(err))
+	assert.NotEqual(t, dbFile, co.DbFile)
+}
@@ -0,0 +1,69 @@
+package bot
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultDedupWindow covers slack's event retries, which come after about a second, a minute and five minutes
+const DefaultDedupWindow = 10 * time.Minute
+
+// dedupCapacity bounds how many delivery ids are remembered
+const dedupCapacity = 10000
+
+// deduplicator remembers the ids of recently handled deliveries, so a delivery slack retries is not handled twice.
+// An id is forgotten once it is older than the window, or to make room when capacity ids are remembered.
+// The ids are only known to this process, behind a passthrough with several handlers a retry relayed to another
+// handler is handled again. The passthrough can't deduplicate instead, it doesn't verify the requests so a forged
+// request could claim a real delivery's id first.
+type deduplicator struct {
+	window   time.Duration
+	capacity int
+
+	lock  sync.Mutex
+	seen  map[string]time.Time
+	order []seenId // oldest first
+}
+
+type seenId struct {
+	id   string
+	seen time.Time
+}
+
+func newDeduplicator(window time.Duration, capacity int) *deduplicator {
+	return &deduplicator{window: window, capacity: capacity, seen: make(map[string]time.Time)}
+}
+
+// duplicate records the id and reports whether it was already recorded within the window.
+// An empty id is never a duplicate.
+func (d *deduplicator) duplicate(id string, now time.Time) bool {
+	if d == nil || id == "" {
+		return false
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.prune(now)
+	if _, ok := d.seen[id]; ok {
+		return true
+	}
+	if len(d.order) >= d.capacity {
+		delete(d.seen, d.order[0].id)
+		d.order = d.order[1:]
+	}
+	d.seen[id] = now
+	d.order = append(d.order, seenId{id: id, seen: now})
+	return false
+}
+
+// prune forgets the ids that are out of the window, the lock must be held
+func (d *deduplicator) prune(now time.Time) {
+	drop := 0
+	for _, s := range d.order {
+		if now.Sub(s.seen) < d.window {
+			break
+		}
+		delete(d.seen, s.id)
+		drop++
+	}
+	d.order = d.order[drop:]
+}
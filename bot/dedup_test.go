@@ -0,0 +1,83 @@
+package bot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeduplicator(t *testing.T) {
+	now := time.Now()
+	d := newDeduplicator(time.Minute, 3)
+	assert.False(t, d.duplicate("a", now))
+	assert.True(t, d.duplicate("a", now.Add(time.Second)))
+	assert.False(t, d.duplicate("", now))
+	assert.False(t, d.duplicate("", now))
+
+	// forgotten once out of the window
+	assert.False(t, d.duplicate("a", now.Add(time.Minute)))
+	assert.True(t, d.duplicate("a", now.Add(time.Minute+time.Second)))
+
+	// the oldest are forgotten to make room
+	assert.False(t, d.duplicate("b", now.Add(time.Minute)))
+	assert.False(t, d.duplicate("c", now.Add(time.Minute)))
+	assert.False(t, d.duplicate("d", now.Add(time.Minute)))
+	assert.False(t, d.duplicate("a", now.Add(time.Minute)))
+	assert.True(t, d.duplicate("d", now.Add(time.Minute)))
+	assert.Len(t, d.seen, 3)
+	assert.Len(t, d.order, 3)
+
+	var none *deduplicator
+	assert.False(t, none.duplicate("a", now))
+}
+
+func TestSlack_Deduplicate(t *testing.T) {
+	event := func(id string) string {
+		return fmt.Sprintf(`{"type":"event_callback","team_id":"T1","event_id":%q,"event":{"type":"reaction_added","user":"U1"}}`, id)
+	}
+	slash := func(trigger string) string {
+		return "team_id=T1&channel_name=general&user_name=u&command=%2Fatsu&text=help&response_url=https%3A%2F%2Fhooks.slack.com%2Fr&trigger_id=" + trigger
+	}
+	tests := []struct {
+		name       string
+		handler    func(*Slack) http.HandlerFunc
+		bodies     []string
+		duplicates int64
+	}{
+		{"event retried", func(s *Slack) http.HandlerFunc { return s.EventHandler }, []string{event("Ev1"), event("Ev1"), event("Ev1")}, 2},
+		{"events", func(s *Slack) http.HandlerFunc { return s.EventHandler }, []string{event("Ev1"), event("Ev2")}, 0},
+		{"slash retried", func(s *Slack) http.HandlerFunc { return s.SlashHandler }, []string{slash("1.2.a"), slash("1.2.a")}, 1},
+		{"slash without trigger", func(s *Slack) http.HandlerFunc { return s.SlashHandler }, []string{slash(""), slash("")}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := createSlackTestConfig()
+			cfg.TemplateDir = "testdata"
+			s := NewSlack(cfg, nil, createTestDb())
+			if err := s.LoadTemplates(); err != nil {
+				t.Fatal(err)
+			}
+			s.SetHTTPClient(&http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("ok")), Header: http.Header{}}, nil
+			})})
+			for i, body := range tt.bodies {
+				req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				if i > 0 {
+					req.Header.Set("X-Slack-Retry-Num", fmt.Sprint(i))
+				}
+				s.SignRequest(req.Header, []byte(body))
+				rr := httptest.NewRecorder()
+				tt.handler(s).ServeHTTP(rr, req)
+				assert.Equal(t, http.StatusOK, rr.Code)
+			}
+			assert.Equal(t, tt.duplicates, s.Status().Deduplicated)
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package bot
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// eventType returns the type templates subscribe to for the event, message events are further
+// split by channel type like their slack subscriptions, e.g. message.im
+func eventType(event map[string]interface{}) string {
+	t, _ := event["type"].(string)
+	if ct, ok := event["channel_type"].(string); ok && t == "message" && ct != "" {
+		return t + "." + ct
+	}
+	return t
+}
+
+// eventTemplates returns the names of the templates whose `events` metadata lists the event type,
+// a template listing `message` gets every message.* event
+func (s *Slack) eventTemplates(evType string) []string {
+	var names []string
+	for name, meta := range s.templateMetadata {
+		if meta == nil {
+			continue
+		}
+		for _, e := range meta.Events {
+			if e == evType || strings.HasPrefix(evType, e+".") {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// messageKeyOf returns the key the message at the channel and ts was remembered by, empty if it wasn't
+func (s *Slack) messageKeyOf(teamId, channel, ts string) string {
+	if channel == "" || ts == "" {
+		return ""
+	}
+	key, err := s.database.GetSlackMessageKey(teamId, channel, ts)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("failed to look up the message at [%s %s]: %v", channel, ts, err)
+	}
+	return key
+}
+
+// processEvent runs the templates subscribed to the event with the event payload as TemplateData.Event,
+// publishes the home tab for app_home_opened, and cleans up after app_uninstalled and tokens_revoked.
+// Results are sent to the event's channel, replying in the thread of the message the event is about if any,
+// whose message key, if it was posted by a template with one, is TemplateData.MessageKey.
+// A template that renders nothing ignores the event. Events from bots, including our own, are ignored so
+// a template replying to a message can't trigger itself.
+func (s *Slack) processEvent(teamId string, raw []byte) ([]*ActionResult, error) {
+	var event map[string]interface{}
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return nil, fmt.Errorf("failed unmarshaling event: %s", err)
+	}
+	if botId, _ := event["bot_id"].(string); botId != "" {
+		return nil, nil
+	}
+	evType := eventType(event)
+	switch evType {
+	case "app_home_opened":
+		s.homeOpened(teamId, event)
+	case "app_uninstalled", "tokens_revoked":
+		s.workspaceEvent(teamId, evType, event)
+	}
+	channel, _ := event["channel"].(string)
+	user, _ := event["user"].(string)
+	threadTs, _ := event["thread_ts"].(string)
+	messageKey := ""
+	if item, ok := event["item"].(map[string]interface{}); ok {
+		c, _ := item["channel"].(string)
+		ts, _ := item["ts"].(string)
+		if channel == "" {
+			channel = c
+		}
+		if threadTs == "" {
+			threadTs = ts
+		}
+		messageKey = s.messageKeyOf(teamId, c, ts)
+	}
+
+	var results []*ActionResult
+	for _, name := range s.eventTemplates(evType) {
+		action := s.NewAction(ActionInput{
+			TeamId:          teamId,
+			Channel:         channel,
+			User:            user,
+			InteractionData: make(map[string]interface{}),
+			TemplateName:    name,
+		})
+		action.Data.Event = event
+		action.Data.MessageKey = messageKey
+		rt := None
+		if channel != "" {
+			rt = Channel
+		}
+		action.SetResponse(rt, "", channel, "")
+		action.SetRecipient(channel, user)
+		action.ThreadTs = threadTs
+		result, err := s.ExecuteAction(action)
+		if err != nil {
+			return results, fmt.Errorf("%s event template %s failed: %v", evType, name, err)
+		}
+		if len(bytes.TrimSpace(result.ProcessedTemplate)) == 0 {
+			if s.debug {
+				log.Printf("%s event ignored by %s", evType, name)
+			}
+			continue
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
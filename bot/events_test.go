@@ -0,0 +1,145 @@
+package bot
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/atsu/chatops/interfaces/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlack_EventTemplates(t *testing.T) {
+	s := NewSlack(createSlackTestConfig(), nil, createTestDb())
+	s.templateMetadata = map[string]*TemplateMetadata{
+		"ack.tpl":      {Events: []string{"reaction_added"}},
+		"dm.tpl":       {Events: []string{"message.im"}},
+		"messages.tpl": {Events: []string{"message", "member_joined_channel"}},
+		"other.tpl":    {},
+		"nometa.tpl":   nil,
+	}
+	assert.Equal(t, []string{"ack.tpl"}, s.eventTemplates("reaction_added"))
+	assert.Equal(t, []string{"dm.tpl", "messages.tpl"}, s.eventTemplates("message.im"))
+	assert.Equal(t, []string{"messages.tpl"}, s.eventTemplates("message.channels"))
+	assert.Equal(t, []string{"messages.tpl"}, s.eventTemplates("member_joined_channel"))
+	assert.Empty(t, s.eventTemplates("tokens_revoked"))
+
+	assert.Equal(t, "message.im", eventType(map[string]interface{}{"type": "message", "channel_type": "im"}))
+	assert.Equal(t, "reaction_added", eventType(map[string]interface{}{"type": "reaction_added"}))
+}
+
+func TestSlack_ProcessEvent(t *testing.T) {
+	tests := []struct {
+		name      string
+		event     string
+		templates []string
+		channel   string
+		threadTs  string
+		rt        ResponseType
+	}{
+		{"acknowledged", `{"type":"reaction_added","user":"U1","reaction":"white_check_mark","item":{"type":"message","channel":"C1","ts":"100.1"}}`,
+			[]string{"ack.tpl"}, "C1", "100.1", Channel},
+		{"other reaction", `{"type":"reaction_added","user":"U1","reaction":"eyes","item":{"type":"message","channel":"C1","ts":"100.1"}}`,
+			nil, "", "", ""},
+		{"direct message", `{"type":"message","channel_type":"im","user":"U1","channel":"D1","text":"hi","ts":"100.2"}`,
+			[]string{"dm.tpl"}, "D1", "", Channel},
+		{"bot message", `{"type":"message","channel_type":"im","bot_id":"B1","channel":"D1","text":"hi"}`,
+			nil, "", "", ""},
+		{"no channel", `{"type":"tokens_revoked","tokens":{"bot":["U0BOT"]}}`,
+			[]string{"revoked.tpl"}, "", "", None},
+		{"not subscribed", `{"type":"pin_added","user":"U1","channel_id":"C1"}`,
+			nil, "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCom := new(mocks.ChatOpsCom)
+			mockCom.On("EnvironmentParams").Return(map[string]string{})
+			s := NewSlack(createSlackTestConfig(), mockCom, createTestDb())
+			s.templates = template.Must(template.New("ack.tpl").Parse(
+				`{{ if eq .Event.reaction "white_check_mark" }}{"text":"<@{{ .Event.user }}> acknowledged"}{{ end }}`))
+			template.Must(s.templates.New("dm.tpl").Parse(`{"text":"you said {{ .Event.text }}"}`))
+			template.Must(s.templates.New("revoked.tpl").Parse(`{}`))
+			s.templateMetadata = map[string]*TemplateMetadata{
+				"ack.tpl":     {Events: []string{"reaction_added"}},
+				"dm.tpl":      {Events: []string{"message.im"}},
+				"revoked.tpl": {Events: []string{"tokens_revoked"}, SendToKafka: true},
+			}
+
+			results, err := s.processEvent("T1", []byte(tt.event))
+			assert.NoError(t, err)
+			var names []string
+			for _, r := range results {
+				names = append(names, r.Action.TemplateName)
+				assert.Equal(t, tt.channel, r.Channel)
+				assert.Equal(t, tt.threadTs, r.ThreadTs)
+				assert.Equal(t, tt.rt, r.ResponseType)
+			}
+			assert.Equal(t, tt.templates, names)
+		})
+	}
+}
+
+func TestSlack_EventHandlerRoutes(t *testing.T) {
+	mockCom := new(mocks.ChatOpsCom)
+	mockCom.On("EnvironmentParams").Return(map[string]string{})
+	tdb := createTestDb()
+	s := NewSlack(createSlackTestConfig(), mockCom, tdb)
+	s.templates = template.Must(template.New("joined.tpl").Parse(`{"text":"welcome <@{{ .Event.user }}>"}`))
+	s.templateMetadata = map[string]*TemplateMetadata{"joined.tpl": {Events: []string{"member_joined_channel"}}}
+
+	body := `{"type":"event_callback","team_id":"T1","event_id":"Ev1","event":{"type":"member_joined_channel","user":"U1","channel":"C1"}}`
+	req := httptest.NewRequest(http.MethodPost, EventEndpoint, strings.NewReader(body))
+	s.SignRequest(req.Header, []byte(body))
+	rr := httptest.NewRecorder()
+	s.EventHandler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	result := waitQueued(t, tdb)
+	assert.Equal(t, "joined.tpl", result.Action.TemplateName)
+	assert.Equal(t, "C1", result.Channel)
+	assert.Equal(t, `{"text":"welcome <@U1>"}`, string(result.ProcessedTemplate))
+}
+
+func TestSlack_AlertAck(t *testing.T) {
+	tests := []struct {
+		name     string
+		reaction string
+		ts       string
+		expected string
+	}{
+		{"alert", "white_check_mark", "100.1", `"text": "<@U1> acknowledged alert *a1*"`},
+		{"other reaction", "eyes", "100.1", ""},
+		{"not an alert", "white_check_mark", "100.2", ""},
+		{"unknown message", "white_check_mark", "100.3", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCom := new(mocks.ChatOpsCom)
+			mockCom.On("EnvironmentParams").Return(map[string]string{})
+			cfg := createSlackTestConfig()
+			cfg.TemplateDir = "../templates"
+			tdb := createTestDb()
+			assert.NoError(t, tdb.InsertSlackMessage("T1", "atsu_id=a1", "C1", "100.1"))
+			assert.NoError(t, tdb.InsertSlackMessage("T1", "issue=i1", "C1", "100.2"))
+			s := NewSlack(cfg, mockCom, tdb)
+			if err := s.LoadTemplates(); err != nil {
+				t.Fatal(err)
+			}
+
+			event := fmt.Sprintf(`{"type":"reaction_added","user":"U1","reaction":"%s","item":{"type":"message","channel":"C1","ts":"%s"}}`, tt.reaction, tt.ts)
+			results, err := s.processEvent("T1", []byte(event))
+			assert.NoError(t, err)
+			if tt.expected == "" {
+				assert.Empty(t, results)
+				return
+			}
+			if assert.Len(t, results, 1) {
+				assert.Contains(t, string(results[0].ProcessedTemplate), tt.expected)
+				assert.Equal(t, "100.1", results[0].ThreadTs)
+			}
+		})
+	}
+}
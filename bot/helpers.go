@@ -8,6 +8,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"math/rand"
@@ -16,6 +17,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/atsu/goat/health"
 	"github.com/google/uuid"
 	"github.com/olivere/elastic"
 	"github.com/zserge/metric"
@@ -25,6 +27,7 @@ import (
 var HelperMetrics = &helperInstrument{
 	slowRequestThresh:             time.Second * 3,
 	elasticSearchSlowRequests:     make([]slowRequest, 0, 20),
+	elasticSearchErrors:           make([]requestError, 0, 20),
 	elasticSearchResponseTimeSecs: metric.NewHistogram("1h1h"), // 1 hour history, 1 hour precision
 	elasticSearchRequestCount:     metric.NewCounter("1h1h"),   // 1 hour history, 1 hour precision
 }
@@ -35,10 +38,21 @@ type slowRequest struct {
 	Url          string
 	Body         string
 }
+type requestError struct {
+	Timestamp int64
+	Url       string
+	Error     string
+}
+
+// helperFailingThresh is how many requests in a row have to fail for the helpers to be red
+const helperFailingThresh = 3
+
 type helperInstrument struct {
 	slowRequestThresh time.Duration
 
 	elasticSearchSlowRequests     []slowRequest
+	elasticSearchErrors           []requestError
+	elasticSearchFailing          int // requests failed in a row
 	elasticSearchResponseTimeSecs metric.Metric
 	elasticSearchRequestCount     metric.Metric
 
@@ -60,6 +74,25 @@ func (h *helperInstrument) recordSlowRequest(duration time.Duration, url, body s
 	}}, h.elasticSearchSlowRequests...)
 }
 
+// recordResult records a failed request, or resets the failures in a row if it succeeded
+func (h *helperInstrument) recordResult(url string, err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err == nil {
+		h.elasticSearchFailing = 0
+		return
+	}
+	h.elasticSearchFailing++
+	if len(h.elasticSearchErrors) >= 20 {
+		h.elasticSearchErrors = h.elasticSearchErrors[:19]
+	}
+	h.elasticSearchErrors = append([]requestError{{
+		Timestamp: time.Now().Unix(),
+		Url:       url,
+		Error:     err.Error(),
+	}}, h.elasticSearchErrors...)
+}
+
 // RoundTrip used to instrument elastic search requests https://github.com/olivere/elastic/wiki/HttpTransport
 func (h *helperInstrument) RoundTrip(r *http.Request) (*http.Response, error) {
 	h.elasticSearchRequestCount.Add(1)
@@ -84,24 +117,66 @@ func (h *helperInstrument) RoundTrip(r *http.Request) (*http.Response, error) {
 		}
 		h.elasticSearchResponseTimeSecs.Add(since.Seconds())
 	}()
-	return http.DefaultTransport.RoundTrip(r)
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err == nil && resp.StatusCode >= 500 {
+		h.recordResult(r.URL.String(), fmt.Errorf("status %d", resp.StatusCode))
+	} else {
+		h.recordResult(r.URL.String(), err)
+	}
+	return resp, err
 }
 
 type HelperStatus struct {
+	Health                        health.State
+	Message                       string
 	ElasticSearchResponseTimeSecs interface{}
 	ElasticSearchRequestCount     interface{}
 	ElasticSearchSlowRequests     interface{}
+	ElasticSearchErrors           interface{}
 }
 
 // Status returns a HelperStatus object to encapsulate the current status of the helpers
 func (h *helperInstrument) Status() HelperStatus {
 	h.lock.RLock()
 	defer h.lock.RUnlock()
+	state, msg := h.health(time.Now())
 	return HelperStatus{
+		Health:                        state,
+		Message:                       msg,
 		ElasticSearchRequestCount:     h.elasticSearchRequestCount,
 		ElasticSearchResponseTimeSecs: h.elasticSearchResponseTimeSecs,
 		ElasticSearchSlowRequests:     h.elasticSearchSlowRequests,
+		ElasticSearchErrors:           h.elasticSearchErrors,
+	}
+}
+
+// health is red if the last few elasticsearch requests failed and yellow if there were errors or slow requests
+// in the last hour, the lock must be held
+func (h *helperInstrument) health(now time.Time) (health.State, string) {
+	if h.elasticSearchFailing >= helperFailingThresh {
+		return health.Red, fmt.Sprintf("elasticsearch failing, last %d requests failed: %s",
+			h.elasticSearchFailing, h.elasticSearchErrors[0].Error)
+	}
+	hourAgo := now.Add(-time.Hour).Unix()
+	errs, slow := 0, 0
+	for _, e := range h.elasticSearchErrors {
+		if e.Timestamp > hourAgo {
+			errs++
+		}
+	}
+	for _, r := range h.elasticSearchSlowRequests {
+		if r.Timestamp > hourAgo {
+			slow++
+		}
+	}
+	switch {
+	case errs > 0:
+		return health.Yellow, fmt.Sprintf("%d elasticsearch errors and %d slow requests in the last hour, last: %s",
+			errs, slow, h.elasticSearchErrors[0].Error)
+	case slow > 0:
+		return health.Yellow, fmt.Sprintf("%d slow elasticsearch requests in the last hour", slow)
 	}
+	return health.Green, ""
 }
 
 /* ===== Helpers Below =====*/
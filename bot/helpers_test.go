@@ -2,10 +2,13 @@ package bot
 
 import (
 	"bytes"
+	"errors"
 	"html/template"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/atsu/goat/health"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -64,3 +67,41 @@ func TestError(t *testing.T) {
 		})
 	}
 }
+
+func TestHelperInstrument_Health(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		setup   func(h *helperInstrument)
+		want    health.State
+		message string
+	}{
+		{"no requests", func(h *helperInstrument) {}, health.Green, ""},
+		{"old errors", func(h *helperInstrument) {
+			h.recordResult("http://es/1", errors.New("refused"))
+			h.elasticSearchErrors[0].Timestamp = now.Add(-2 * time.Hour).Unix()
+			h.recordResult("http://es/2", nil)
+		}, health.Green, ""},
+		{"slow request", func(h *helperInstrument) {
+			h.recordSlowRequest(5*time.Second, "http://es/1", "")
+		}, health.Yellow, "1 slow elasticsearch requests in the last hour"},
+		{"recent error", func(h *helperInstrument) {
+			h.recordResult("http://es/1", errors.New("status 503"))
+			h.recordResult("http://es/2", nil)
+		}, health.Yellow, "1 elasticsearch errors and 0 slow requests in the last hour, last: status 503"},
+		{"failing", func(h *helperInstrument) {
+			for i := 0; i < helperFailingThresh; i++ {
+				h.recordResult("http://es/1", errors.New("refused"))
+			}
+		}, health.Red, "elasticsearch failing, last 3 requests failed: refused"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := &helperInstrument{}
+			test.setup(h)
+			state, msg := h.health(now)
+			assert.Equal(t, test.want, state)
+			assert.Equal(t, test.message, msg)
+		})
+	}
+}
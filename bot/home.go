@@ -0,0 +1,194 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HomeTemplate renders the app home tab, it is published when a user opens the tab
+// and refreshed for the users that opened it when an alert or their feedback arrives
+const HomeTemplate = "home.tpl"
+
+// homeAlerts is how many recent alerts are kept for the home tab
+const homeAlerts = 10
+
+// HomeData is the per user data given to the home template as TemplateData.Home
+type HomeData struct {
+	UserId       string
+	RecentAlerts []HomeAlert // newest first
+	Feedback     HomeFeedback
+}
+
+// HomeAlert is an atsu event with an atsu_id
+type HomeAlert struct {
+	AtsuId   string
+	Text     string
+	Template string
+	Time     int64
+}
+
+// HomeFeedback counts a user's feedback on alerts
+type HomeFeedback struct {
+	Positive int
+	Negative int
+}
+
+// home tracks, by team, the recent alerts, the feedback each user gave and the users that opened the home tab
+type home struct {
+	lock     sync.Mutex
+	alerts   map[string][]HomeAlert
+	feedback map[string]map[string]HomeFeedback
+	viewers  map[string]map[string]bool
+}
+
+func newHome() *home {
+	return &home{
+		alerts:   make(map[string][]HomeAlert),
+		feedback: make(map[string]map[string]HomeFeedback),
+		viewers:  make(map[string]map[string]bool),
+	}
+}
+
+func (h *home) alert(team string, a HomeAlert) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	alerts := append([]HomeAlert{a}, h.alerts[team]...)
+	if len(alerts) > homeAlerts {
+		alerts = alerts[:homeAlerts]
+	}
+	h.alerts[team] = alerts
+}
+
+// addFeedback counts a label of 1 as positive and anything else as negative, like the alert buttons
+func (h *home) addFeedback(team, user string, label float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.feedback[team] == nil {
+		h.feedback[team] = make(map[string]HomeFeedback)
+	}
+	f := h.feedback[team][user]
+	if label == 1 {
+		f.Positive++
+	} else {
+		f.Negative++
+	}
+	h.feedback[team][user] = f
+}
+
+func (h *home) opened(team, user string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.viewers[team] == nil {
+		h.viewers[team] = make(map[string]bool)
+	}
+	h.viewers[team][user] = true
+}
+
+func (h *home) viewer(team, user string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.viewers[team][user]
+}
+
+// users returns the users of the team that opened the home tab
+func (h *home) users(team string) []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	users := make([]string, 0, len(h.viewers[team]))
+	for u := range h.viewers[team] {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// remove forgets the team
+func (h *home) remove(team string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.alerts, team)
+	delete(h.feedback, team)
+	delete(h.viewers, team)
+}
+
+func (h *home) data(team, user string) *HomeData {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return &HomeData{
+		UserId:       user,
+		RecentAlerts: append([]HomeAlert(nil), h.alerts[team]...),
+		Feedback:     h.feedback[team][user],
+	}
+}
+
+// homeOpened publishes the home tab for the user, an app_home_opened event for another tab is ignored
+func (s *Slack) homeOpened(team string, event map[string]interface{}) {
+	user, _ := event["user"].(string)
+	if tab, _ := event["tab"].(string); user == "" || (tab != "" && tab != "home") {
+		return
+	}
+	s.home.opened(team, user)
+	if err := s.publishHome(team, user); err != nil {
+		log.Println("failed to publish home:", err)
+		s.recordError(err)
+	}
+}
+
+// recordAlert keeps the atsu event for the home tab if it has an atsu_id, and refreshes the tab
+func (s *Slack) recordAlert(team string, action *Action) {
+	id, ok := action.Data.InteractionData["atsu_id"]
+	if !ok || id == nil || fmt.Sprint(id) == "" {
+		return
+	}
+	text, _ := action.Data.InteractionData["text"].(string)
+	s.home.alert(team, HomeAlert{AtsuId: fmt.Sprint(id), Text: text, Template: action.TemplateName, Time: time.Now().Unix()})
+	for _, user := range s.home.users(team) {
+		if err := s.publishHome(team, user); err != nil {
+			log.Println("failed to refresh home:", err)
+		}
+	}
+}
+
+// recordFeedback counts the user's feedback for the home tab, and refreshes their tab
+func (s *Slack) recordFeedback(result *ActionResult) {
+	if result.UserId == "" {
+		return
+	}
+	s.home.addFeedback(result.TeamId, result.UserId, result.Data.FeedbackMessage().Label)
+	if s.home.viewer(result.TeamId, result.UserId) {
+		if err := s.publishHome(result.TeamId, result.UserId); err != nil {
+			log.Println("failed to refresh home:", err)
+		}
+	}
+}
+
+// publishHome renders the home template for the user and publishes it with views.publish,
+// nothing is published if there is no home template
+func (s *Slack) publishHome(team, user string) error {
+	if s.templateLookup(HomeTemplate, false) == nil {
+		return nil
+	}
+	action := s.NewAction(ActionInput{
+		TeamId:          team,
+		User:            user,
+		InteractionData: make(map[string]interface{}),
+		TemplateName:    HomeTemplate,
+	})
+	action.Data.Home = s.home.data(team, user)
+	result, err := s.ExecuteAction(action)
+	if err != nil {
+		return err
+	}
+	if len(result.ProcessedTemplate) == 0 {
+		return errors.New("home template rendered nothing")
+	}
+	instance, err := s.instance(team, "views.publish")
+	if err != nil {
+		return err
+	}
+	return s.callViews(instance.BotToken, "views.publish", viewRequest{UserId: user, View: result.ProcessedTemplate})
+}
@@ -0,0 +1,100 @@
+package bot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/atsu/chatops/interfaces/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHome(t *testing.T) {
+	h := newHome()
+	for i := 0; i < homeAlerts+2; i++ {
+		h.alert("T1", HomeAlert{AtsuId: fmt.Sprint(i)})
+	}
+	h.addFeedback("T1", "U1", 1)
+	h.addFeedback("T1", "U1", 0)
+	h.addFeedback("T1", "U1", 1)
+	h.opened("T1", "U2")
+	h.opened("T1", "U1")
+
+	data := h.data("T1", "U1")
+	assert.Equal(t, "U1", data.UserId)
+	if assert.Len(t, data.RecentAlerts, homeAlerts) {
+		assert.Equal(t, fmt.Sprint(homeAlerts+1), data.RecentAlerts[0].AtsuId)
+		assert.Equal(t, "2", data.RecentAlerts[homeAlerts-1].AtsuId)
+	}
+	assert.Equal(t, HomeFeedback{Positive: 2, Negative: 1}, data.Feedback)
+	assert.Equal(t, []string{"U1", "U2"}, h.users("T1"))
+	assert.True(t, h.viewer("T1", "U2"))
+
+	other := h.data("T2", "U1")
+	assert.Empty(t, other.RecentAlerts)
+	assert.Equal(t, HomeFeedback{}, other.Feedback)
+	assert.Empty(t, h.users("T2"))
+}
+
+func TestSlack_Home(t *testing.T) {
+	type publish struct {
+		User string          `json:"user_id"`
+		View json.RawMessage `json:"view"`
+	}
+	var published []publish
+	mockCom := new(mocks.ChatOpsCom)
+	mockCom.On("EnvironmentParams").Return(map[string]string{})
+	s := NewSlack(createSlackTestConfig(), mockCom, createTestDb())
+	s.SetHTTPClient(&http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		assert.Equal(t, SlackApiUrl+"views.publish", r.URL.String())
+		var p publish
+		b, _ := ioutil.ReadAll(r.Body)
+		assert.NoError(t, json.Unmarshal(b, &p))
+		published = append(published, p)
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(`{"ok":true}`)), Header: http.Header{}}, nil
+	})})
+	s.workspaceApis.Store("T1", SlackInstance{TeamId: "T1", BotToken: "xoxb"})
+	s.templates = template.Must(template.New(HomeTemplate).Parse(
+		`{"type":"home","alerts":[{{ range $i, $a := .Home.RecentAlerts }}{{ if $i }},{{ end }}"{{ $a.AtsuId }}"{{ end }}],"up":{{ .Home.Feedback.Positive }}}`))
+	s.templateMetadata = map[string]*TemplateMetadata{}
+
+	// opening another tab does nothing
+	_, err := s.processEvent("T1", []byte(`{"type":"app_home_opened","user":"U1","channel":"D1","tab":"messages"}`))
+	assert.NoError(t, err)
+	assert.Empty(t, published)
+
+	_, err = s.processEvent("T1", []byte(`{"type":"app_home_opened","user":"U1","channel":"D1","tab":"home"}`))
+	assert.NoError(t, err)
+
+	alert := &Action{TemplateName: "_alert.tpl", Data: TemplateData{InteractionData: map[string]interface{}{"atsu_id": "a1", "text": "disk full"}}}
+	s.recordAlert("T1", alert)
+	s.recordAlert("T1", &Action{Data: TemplateData{InteractionData: map[string]interface{}{"text": "not an alert"}}})
+
+	feedback := &ActionResult{TeamId: "T1", UserId: "U1", KafkaMessageType: Feedback,
+		Data: TemplateData{InteractionData: map[string]interface{}{"value": `{"label":1,"atsu_id":"a1"}`}}}
+	s.SendResultResponse(feedback)
+	// feedback from a user that never opened the home tab is counted but not published
+	s.SendResultResponse(&ActionResult{TeamId: "T1", UserId: "U2", KafkaMessageType: Feedback, Data: feedback.Data})
+	assert.Equal(t, HomeFeedback{Positive: 1}, s.home.data("T1", "U2").Feedback)
+
+	expected := []string{
+		`{"type":"home","alerts":[],"up":0}`,
+		`{"type":"home","alerts":["a1"],"up":0}`,
+		`{"type":"home","alerts":["a1"],"up":1}`,
+	}
+	if assert.Len(t, published, len(expected)) {
+		for i, p := range published {
+			assert.Equal(t, "U1", p.User)
+			assert.JSONEq(t, expected[i], string(p.View))
+		}
+	}
+
+	// without a home template nothing is published
+	s.templates = template.Must(template.New("other.tpl").Parse(`{}`))
+	assert.NoError(t, s.publishHome("T1", "U1"))
+	assert.Len(t, published, len(expected))
+}
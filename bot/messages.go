@@ -0,0 +1,143 @@
+package bot
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/nlopes/slack"
+)
+
+// messageKey returns the key the template's message is remembered by, the metadata's message key field
+// and its value in the template data, or empty if either is missing
+func (m TemplateMetadata) messageKey(data TemplateData) string {
+	if m.MessageKey == "" {
+		return ""
+	}
+	v, ok := data.InteractionData[m.MessageKey]
+	if !ok || v == nil || fmt.Sprint(v) == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s=%v", m.MessageKey, v)
+}
+
+// sendChannelMessage posts the result to its channel, in its thread if it has one. If the template asked to thread
+// or update and a message was remembered for its key, it replies in that message's thread or updates it instead.
+// A newly posted message is remembered by the key. Returns a note on what was sent for the log.
+func (s *Slack) sendChannelMessage(result *ActionResult, opts slack.MsgOption) (string, error) {
+	key := result.MessageKey
+	if key != "" && (result.Thread || result.Update) {
+		channel, ts, err := s.database.GetSlackMessage(result.TeamId, key)
+		switch {
+		case err == sql.ErrNoRows || ts == "":
+		case err != nil:
+			log.Printf("failed to look up message [%s]: %v", key, err)
+		case result.Update:
+			return fmt.Sprintf(" [update %s] ", key), s.updateMessage(result.TeamId, channel, ts, opts)
+		default:
+			_, _, err := s.postMessage(result.TeamId, channel, opts, slack.MsgOptionTS(ts))
+			return fmt.Sprintf(" [thread %s] ", key), err
+		}
+	}
+	options := []slack.MsgOption{opts}
+	if result.ThreadTs != "" {
+		options = append(options, slack.MsgOptionTS(result.ThreadTs))
+	}
+	channel, ts, err := s.postMessage(result.TeamId, result.Channel, options...)
+	if err != nil || key == "" {
+		return "", err
+	}
+	if err := s.database.InsertSlackMessage(result.TeamId, key, channel, ts); err != nil {
+		log.Printf("failed to remember message [%s]: %v", key, err)
+	}
+	return fmt.Sprintf(" [posted %s] ", key), nil
+}
+
+// updateMessage replaces the message's content
+func (s *Slack) updateMessage(team, channel, ts string, opts slack.MsgOption) error {
+	instance, err := s.instance(team, "updating message")
+	if err != nil {
+		return err
+	}
+	_, _, _, err = instance.client.UpdateMessage(channel, ts, opts)
+	return err
+}
+
+// sendEphemeral shows the message in the channel to only the user the action came from
+func (s *Slack) sendEphemeral(result *ActionResult, opts slack.MsgOption) error {
+	channel := result.ChannelId
+	if channel == "" {
+		channel = result.Channel
+	}
+	if channel == "" || result.UserId == "" {
+		return errors.New("ephemeral messages need a channel and a user")
+	}
+	instance, err := s.instance(result.TeamId, "ephemeral message")
+	if err != nil {
+		return err
+	}
+	_, err = instance.client.PostEphemeral(channel, result.UserId, opts)
+	return err
+}
+
+// sendDirectMessage opens a direct message conversation with the user the action came from and posts to it
+func (s *Slack) sendDirectMessage(result *ActionResult, opts slack.MsgOption) error {
+	if result.UserId == "" {
+		return errors.New("direct messages need a user")
+	}
+	instance, err := s.instance(result.TeamId, "direct message")
+	if err != nil {
+		return err
+	}
+	im, _, _, err := instance.client.OpenConversation(&slack.OpenConversationParameters{Users: []string{result.UserId}})
+	if err != nil {
+		return fmt.Errorf("failed to open direct message: %w", err)
+	}
+	_, _, err = s.postMessage(result.TeamId, im.ID, opts)
+	return err
+}
+
+// validateRecipient checks the action has the ids its response type needs
+func (a *Action) validateRecipient() error {
+	switch {
+	case a.ResponseType == Ephemeral && (a.ChannelId == "" || a.UserId == ""):
+		return errors.New("ephemeral responses need a channel and a user")
+	case a.ResponseType == DirectMessage && a.UserId == "":
+		return errors.New("dm responses need a user")
+	}
+	return nil
+}
+
+// messageOption parses a message template into its blocks, or its text if it has no blocks,
+// with a note on which for the log
+func messageOption(b []byte) (slack.MsgOption, string, error) {
+	msg, err := ParseMessage(b)
+	if err != nil {
+		return nil, "", err
+	}
+	if msg.Blocks.BlockSet != nil {
+		return slack.MsgOptionBlocks(msg.Blocks.BlockSet...), " [block set] ", nil
+	}
+	return slack.MsgOptionText(msg.Text, false), " [not block set] ", nil
+}
+
+// replaceOriginal sets replace_original on a response url message, so it replaces the message the interaction came from
+func replaceOriginal(b []byte) ([]byte, error) {
+	return setResponseField(b, "replace_original", true)
+}
+
+// ephemeralResponse sets response_type on a response url message, so only the user the interaction came from sees it
+func ephemeralResponse(b []byte) ([]byte, error) {
+	return setResponseField(b, "response_type", "ephemeral")
+}
+
+func setResponseField(b []byte, key string, value interface{}) ([]byte, error) {
+	var msg map[string]interface{}
+	if err := json.Unmarshal(b, &msg); err != nil {
+		return nil, fmt.Errorf("failed unmarshaling response message: %s", err)
+	}
+	msg[key] = value
+	return json.Marshal(msg)
+}
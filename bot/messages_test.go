@@ -0,0 +1,195 @@
+package bot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/atsu/chatops/interfaces/mocks"
+	"github.com/nlopes/slack"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplateMetadata_MessageKey(t *testing.T) {
+	data := TemplateData{InteractionData: map[string]interface{}{"atsu_id": "a1", "value": 1.5, "empty": ""}}
+	assert.Equal(t, "atsu_id=a1", TemplateMetadata{MessageKey: "atsu_id"}.messageKey(data))
+	assert.Equal(t, "value=1.5", TemplateMetadata{MessageKey: "value"}.messageKey(data))
+	assert.Equal(t, "", TemplateMetadata{MessageKey: "empty"}.messageKey(data))
+	assert.Equal(t, "", TemplateMetadata{MessageKey: "missing"}.messageKey(data))
+	assert.Equal(t, "", TemplateMetadata{}.messageKey(data))
+}
+
+func TestSlack_SendChannelMessage(t *testing.T) {
+	type call struct {
+		method   string
+		channel  string
+		ts       string
+		threadTs string
+	}
+	var calls []call
+	posted := 0
+	s := NewSlack(createSlackTestConfig(), nil, createTestDb())
+	s.SetHTTPClient(&http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		assert.NoError(t, r.ParseForm())
+		calls = append(calls, call{
+			method:   strings.TrimPrefix(r.URL.Path, "/api/"),
+			channel:  r.PostForm.Get("channel"),
+			ts:       r.PostForm.Get("ts"),
+			threadTs: r.PostForm.Get("thread_ts"),
+		})
+		posted++
+		body := fmt.Sprintf(`{"ok":true,"channel":"C%d","ts":"100.%d"}`, posted, posted)
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body)), Header: http.Header{}}, nil
+	})})
+	s.workspaceApis.Store("team", SlackInstance{TeamId: "team", client: s.newClient("xoxb")})
+
+	tests := []struct {
+		name     string
+		result   ActionResult
+		expected call
+	}{
+		{"first alert is posted", ActionResult{MessageKey: "atsu_id=a1", Thread: true}, call{"chat.postMessage", "alerts", "", ""}},
+		{"repeat alert replies in the thread", ActionResult{MessageKey: "atsu_id=a1", Thread: true}, call{"chat.postMessage", "C1", "", "100.1"}},
+		{"update replaces the first alert", ActionResult{MessageKey: "atsu_id=a1", Update: true}, call{"chat.update", "C1", "100.1", ""}},
+		{"other alerts are posted", ActionResult{MessageKey: "atsu_id=a2", Update: true}, call{"chat.postMessage", "alerts", "", ""}},
+		{"other alerts are remembered", ActionResult{MessageKey: "atsu_id=a2", Thread: true}, call{"chat.postMessage", "C4", "", "100.4"}},
+		{"without a key", ActionResult{Thread: true}, call{"chat.postMessage", "alerts", "", ""}},
+		{"in a thread", ActionResult{ThreadTs: "99.9"}, call{"chat.postMessage", "alerts", "", "99.9"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = nil
+			result := tt.result
+			result.TeamId, result.Channel = "team", "alerts"
+			_, err := s.sendChannelMessage(&result, slack.MsgOptionText("alert", false))
+			assert.NoError(t, err)
+			if assert.Len(t, calls, 1) {
+				assert.Equal(t, tt.expected, calls[0])
+			}
+		})
+	}
+}
+
+func TestSlack_ReplaceOriginal(t *testing.T) {
+	var bodies []map[string]interface{}
+	s := NewSlack(createSlackTestConfig(), nil, createTestDb())
+	s.SetHTTPClient(&http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		var body map[string]interface{}
+		b, _ := ioutil.ReadAll(r.Body)
+		assert.NoError(t, json.Unmarshal(b, &body))
+		bodies = append(bodies, body)
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("ok")), Header: http.Header{}}, nil
+	})})
+
+	s.SendResultResponse(&ActionResult{ResponseType: Direct, ResponseUrl: "https://hooks.slack.com/response", ProcessedTemplate: []byte(`{"text":"done"}`)})
+	s.SendResultResponse(&ActionResult{ResponseType: Direct, ResponseUrl: "https://hooks.slack.com/response", ReplaceOriginal: true, ProcessedTemplate: []byte(`{"text":"done"}`)})
+	s.SendResultResponse(&ActionResult{ResponseType: Ephemeral, ResponseUrl: "https://hooks.slack.com/response", ProcessedTemplate: []byte(`{"text":"done"}`)})
+	assert.Equal(t, []map[string]interface{}{
+		{"text": "done"},
+		{"text": "done", "replace_original": true},
+		{"text": "done", "response_type": "ephemeral"},
+	}, bodies)
+
+	_, err := replaceOriginal([]byte("not json"))
+	assert.Error(t, err)
+}
+
+func TestParseResponseType(t *testing.T) {
+	rt, err := ParseResponseType("ephemeral")
+	assert.NoError(t, err)
+	assert.Equal(t, Ephemeral, rt)
+	rt, err = ParseResponseType("dm")
+	assert.NoError(t, err)
+	assert.Equal(t, DirectMessage, rt)
+	_, err = ParseResponseType("everyone")
+	assert.Error(t, err)
+}
+
+func TestSlack_EphemeralAndDirectMessage(t *testing.T) {
+	type call struct {
+		method  string
+		channel string
+		user    string
+		users   string
+	}
+	var calls []call
+	s := NewSlack(createSlackTestConfig(), nil, createTestDb())
+	s.SetHTTPClient(&http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		assert.NoError(t, r.ParseForm())
+		c := call{
+			method:  strings.TrimPrefix(r.URL.Path, "/api/"),
+			channel: r.PostForm.Get("channel"),
+			user:    r.PostForm.Get("user"),
+			users:   r.PostForm.Get("users"),
+		}
+		calls = append(calls, c)
+		body := `{"ok":true,"channel":"C1","ts":"100.1","message_ts":"100.1"}`
+		if c.method == "conversations.open" {
+			body = `{"ok":true,"channel":{"id":"D1"}}`
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body)), Header: http.Header{}}, nil
+	})})
+	s.workspaceApis.Store("team", SlackInstance{TeamId: "team", client: s.newClient("xoxb")})
+
+	tests := []struct {
+		name     string
+		result   ActionResult
+		expected []call
+	}{
+		{"ephemeral", ActionResult{ResponseType: Ephemeral, Channel: "general", ChannelId: "C1", UserId: "U1"},
+			[]call{{"chat.postEphemeral", "C1", "U1", ""}}},
+		{"ephemeral by channel name", ActionResult{ResponseType: Ephemeral, Channel: "general", UserId: "U1"},
+			[]call{{"chat.postEphemeral", "general", "U1", ""}}},
+		{"ephemeral without user", ActionResult{ResponseType: Ephemeral, ChannelId: "C1"}, nil},
+		{"ephemeral by response url", ActionResult{ResponseType: Ephemeral, ChannelId: "C1", UserId: "U1", ResponseUrl: "https://hooks.slack.com/response"},
+			[]call{{"/response", "", "", ""}}},
+		{"direct message", ActionResult{ResponseType: DirectMessage, ChannelId: "C1", UserId: "U1"},
+			[]call{{"conversations.open", "", "", "U1"}, {"chat.postMessage", "D1", "", ""}}},
+		{"direct message without user", ActionResult{ResponseType: DirectMessage, ChannelId: "C1"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = nil
+			result := tt.result
+			result.TeamId, result.ProcessedTemplate = "team", []byte(`{"text":"job details"}`)
+			s.SendResultResponse(&result)
+			assert.Equal(t, tt.expected, calls)
+		})
+	}
+}
+
+func TestSlack_AtsuEventResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		status int
+	}{
+		{"webhook", "", http.StatusOK},
+		{"channel", "&channel=C1", http.StatusOK},
+		{"ephemeral", "&channel=C1&user=U1&response=ephemeral", http.StatusOK},
+		{"ephemeral without user", "&channel=C1&response=ephemeral", http.StatusBadRequest},
+		{"dm", "&user=U1&response=dm", http.StatusOK},
+		{"dm without user", "&response=dm", http.StatusBadRequest},
+		{"unknown response", "&response=everyone", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCom := new(mocks.ChatOpsCom)
+			mockCom.On("EnvironmentParams").Return(map[string]string{})
+			cfg := createSlackTestConfig()
+			cfg.TemplateDir = "testdata"
+			s := NewSlack(cfg, mockCom, createTestDb())
+			if err := s.LoadTemplates(); err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodPost, AtsuEventEndpoint+"?teamId=team&tpl=text"+tt.query, strings.NewReader(`{"text":"hi"}`))
+			rr := httptest.NewRecorder()
+			s.AtsuEventHandler(rr, req)
+			assert.Equal(t, tt.status, rr.Code)
+		})
+	}
+}
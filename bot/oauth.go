@@ -0,0 +1,112 @@
+package bot
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultScopes are the bot scopes requested when the app is installed, chat:write and im:write post channel,
+// ephemeral and direct message responses, reactions:read receives reaction_added events
+const DefaultScopes = "app_mentions:read,incoming-webhook,commands,team:read,chat:write,im:write,reactions:read"
+
+// stateMaxAge is how long an install has between AuthorizeHandler and CallbackHandler
+const stateMaxAge = 10 * time.Minute
+
+// stateCookie binds the state to the browser that started the install
+const stateCookie = "slack_oauth_state"
+
+// OAuth state failures, also counted as reasons in SlackStatus.RejectedReasons
+var (
+	ErrMissingState  = errors.New("missing oauth state")
+	ErrInvalidState  = errors.New("invalid oauth state")
+	ErrExpiredState  = errors.New("expired oauth state")
+	ErrStateMismatch = errors.New("oauth state not issued to this browser")
+	ErrReusedState   = errors.New("reused oauth state")
+)
+
+// newState returns a state for an install started now, a random nonce and expiry signed with the client secret
+func (s *Slack) newState(now time.Time) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	payload := fmt.Sprintf("%s.%d", hex.EncodeToString(nonce), now.Add(stateMaxAge).Unix())
+	return payload + "." + hex.EncodeToString(s.signState(payload)), nil
+}
+
+func (s *Slack) signState(payload string) []byte {
+	mac := hmac.New(sha256.New, []byte(s.clientSecret))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// verifyState checks the state was issued by us, to this browser, has not expired and is used only once
+func (s *Slack) verifyState(r *http.Request, now time.Time) error {
+	state := r.URL.Query().Get("state")
+	if state == "" {
+		return ErrMissingState
+	}
+	parts := strings.Split(state, ".")
+	if len(parts) != 3 {
+		return ErrInvalidState
+	}
+	sig, err := hex.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, s.signState(parts[0]+"."+parts[1])) {
+		return ErrInvalidState
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return ErrInvalidState
+	}
+	if now.After(time.Unix(expires, 0)) {
+		return ErrExpiredState
+	}
+	if c, err := r.Cookie(stateCookie); err != nil || !hmac.Equal([]byte(c.Value), []byte(state)) {
+		return ErrStateMismatch
+	}
+	if s.stateUsed(parts[0], time.Unix(expires, 0), now) {
+		return ErrReusedState
+	}
+	return nil
+}
+
+// stateUsed records the state's nonce until the state expires and reports whether it was already used,
+// forgetting the nonces of states that have expired
+func (s *Slack) stateUsed(nonce string, expires, now time.Time) bool {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	for n, exp := range s.usedStates {
+		if now.After(exp) {
+			delete(s.usedStates, n)
+		}
+	}
+	if _, ok := s.usedStates[nonce]; ok {
+		return true
+	}
+	s.usedStates[nonce] = expires
+	return false
+}
+
+var installPage = template.Must(template.New("install").Parse(`<!DOCTYPE html>
+<html><head><title>{{ .Title }}</title></head>
+<body><h1>{{ .Title }}</h1><p>{{ .Message }}</p></body></html>
+`))
+
+// installError shows the user why the install did not complete
+func installError(w http.ResponseWriter, status int, title, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := installPage.Execute(w, struct{ Title, Message string }{title, message}); err != nil {
+		log.Println(err)
+	}
+}
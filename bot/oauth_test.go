@@ -0,0 +1,180 @@
+package bot
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newInstallTestSlack(t *testing.T, accessResponse string) *Slack {
+	cfg := createSlackTestConfig()
+	cfg.ClientId, cfg.ClientSecret = "client", "secret"
+	cfg.AuthRedirectUrl = "https://example.com/installed"
+	cfg.CallbackUrl = "https://chatops.example.com/slack/callback"
+	s := NewSlack(cfg, nil, createTestDb())
+	s.SetHTTPClient(&http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		assert.Equal(t, SlackAccessUrl, r.URL.String())
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "code1", r.PostForm.Get("code"))
+		assert.Equal(t, "https://chatops.example.com/slack/callback", r.PostForm.Get("redirect_uri"))
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(accessResponse)), Header: http.Header{}}, nil
+	})})
+	return s
+}
+
+// authorize starts an install, returning the state and the cookie binding it to the browser
+func authorize(t *testing.T, s *Slack) (string, *http.Cookie) {
+	rr := httptest.NewRecorder()
+	s.AuthorizeHandler(rr, httptest.NewRequest(http.MethodGet, SlackAuthorizeEndpoint, nil))
+	assert.Equal(t, http.StatusFound, rr.Code)
+	u, err := url.Parse(rr.Header().Get("Location"))
+	assert.NoError(t, err)
+	cookies := rr.Result().Cookies()
+	if !assert.Len(t, cookies, 1) {
+		t.FailNow()
+	}
+	return u.Query().Get("state"), cookies[0]
+}
+
+func callback(s *Slack, query string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, SlackCallbackEndpoint+"?"+query, nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rr := httptest.NewRecorder()
+	s.CallbackHandler(rr, req)
+	return rr
+}
+
+func TestSlack_AuthorizeHandler(t *testing.T) {
+	s := newInstallTestSlack(t, "")
+	s.scopes = []string{"commands", "chat:write"}
+	rr := httptest.NewRecorder()
+	s.AuthorizeHandler(rr, httptest.NewRequest(http.MethodGet, SlackAuthorizeEndpoint, nil))
+	assert.Equal(t, http.StatusFound, rr.Code)
+	u, err := url.Parse(rr.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, SlackAuthorizeUrl, u.Scheme+"://"+u.Host+u.Path)
+	assert.Equal(t, "commands,chat:write", u.Query().Get("scope"))
+	assert.Equal(t, "client", u.Query().Get("client_id"))
+	assert.Equal(t, "https://chatops.example.com/slack/callback", u.Query().Get("redirect_uri"))
+	state := u.Query().Get("state")
+	assert.NotEmpty(t, state)
+	if cookies := rr.Result().Cookies(); assert.Len(t, cookies, 1) {
+		assert.Equal(t, stateCookie, cookies[0].Name)
+		assert.Equal(t, state, cookies[0].Value)
+		assert.True(t, cookies[0].HttpOnly)
+		assert.Equal(t, SlackCallbackEndpoint, cookies[0].Path)
+	}
+
+	other, _ := authorize(t, s)
+	assert.NotEqual(t, state, other)
+}
+
+func TestSlack_CallbackHandler(t *testing.T) {
+	s := newInstallTestSlack(t, `{"ok":true,"access_token":"xoxb-1","team":{"id":"T1","name":"team"},"incoming_webhook":{"url":"https://hooks.slack.com/1"}}`)
+	state, cookie := authorize(t, s)
+	rr := callback(s, "code=code1&state="+url.QueryEscape(state), cookie)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, "https://example.com/installed", rr.Header().Get("Location"))
+	i, ok := s.workspaceApis.Load("T1")
+	if assert.True(t, ok) {
+		assert.Equal(t, "xoxb-1", i.(SlackInstance).BotToken)
+		assert.Equal(t, "https://hooks.slack.com/1", i.(SlackInstance).WebHookUrl)
+	}
+
+	// the state can't be used again
+	rr = callback(s, "code=code1&state="+url.QueryEscape(state), cookie)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, int64(1), s.Status().RejectedReasons[ErrReusedState.Error()])
+}
+
+func TestSlack_CallbackHandlerRefused(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		query    func(state string) string
+		cookie   func(c *http.Cookie) *http.Cookie
+		status   int
+		reason   error
+	}{
+		{"missing state", "", func(string) string { return "code=code1" }, nil, http.StatusBadRequest, ErrMissingState},
+		{"tampered state", "", func(state string) string {
+			parts := strings.Split(state, ".")
+			parts[1] = "9999999999" // extend the expiry
+			return "code=code1&state=" + url.QueryEscape(strings.Join(parts, "."))
+		}, nil, http.StatusBadRequest, ErrInvalidState},
+		{"no cookie", "", nil, func(*http.Cookie) *http.Cookie { return nil }, http.StatusBadRequest, ErrStateMismatch},
+		{"other browser's cookie", "", nil, func(c *http.Cookie) *http.Cookie {
+			return &http.Cookie{Name: c.Name, Value: "other"}
+		}, http.StatusBadRequest, ErrStateMismatch},
+		{"denied", "", func(state string) string { return "error=access_denied&state=" + url.QueryEscape(state) }, nil, http.StatusForbidden, nil},
+		{"slack refused", `{"ok":false,"error":"invalid_code"}`, nil, nil, http.StatusBadGateway, nil},
+		{"invalid response", `not json`, nil, nil, http.StatusBadGateway, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newInstallTestSlack(t, tt.response)
+			state, cookie := authorize(t, s)
+			query := "code=code1&state=" + url.QueryEscape(state)
+			if tt.query != nil {
+				query = tt.query(state)
+			}
+			if tt.cookie != nil {
+				cookie = tt.cookie(cookie)
+			}
+			rr := callback(s, query, cookie)
+			assert.Equal(t, tt.status, rr.Code)
+			assert.Contains(t, rr.Header().Get("Content-Type"), "text/html")
+			_, ok := s.workspaceApis.Load("T1")
+			assert.False(t, ok)
+			if tt.reason != nil {
+				assert.Equal(t, int64(1), s.Status().RejectedReasons[tt.reason.Error()])
+			}
+		})
+	}
+}
+
+func TestSlack_VerifyStateExpired(t *testing.T) {
+	s := newInstallTestSlack(t, "")
+	state, err := s.newState(time.Now().Add(-stateMaxAge - time.Minute))
+	assert.NoError(t, err)
+	req := httptest.NewRequest(http.MethodGet, SlackCallbackEndpoint+"?state="+url.QueryEscape(state), nil)
+	req.AddCookie(&http.Cookie{Name: stateCookie, Value: state})
+	assert.Equal(t, ErrExpiredState, s.verifyState(req, time.Now()))
+	assert.NoError(t, s.verifyState(req, time.Now().Add(-stateMaxAge)))
+}
+
+func TestSlack_VerifyStateReused(t *testing.T) {
+	s := newInstallTestSlack(t, "")
+	s.dedup = newDeduplicator(time.Second, 1) // smaller than the state's lifetime, must not let it be reused
+	now := time.Now()
+	state, err := s.newState(now)
+	assert.NoError(t, err)
+	req := httptest.NewRequest(http.MethodGet, SlackCallbackEndpoint+"?state="+url.QueryEscape(state), nil)
+	req.AddCookie(&http.Cookie{Name: stateCookie, Value: state})
+	assert.NoError(t, s.verifyState(req, now))
+	s.dedup.duplicate("other", now.Add(time.Minute))
+	assert.Equal(t, ErrReusedState, s.verifyState(req, now.Add(stateMaxAge-time.Second)))
+
+	// forgotten once expired
+	other, err := s.newState(now.Add(stateMaxAge))
+	assert.NoError(t, err)
+	req = httptest.NewRequest(http.MethodGet, SlackCallbackEndpoint+"?state="+url.QueryEscape(other), nil)
+	req.AddCookie(&http.Cookie{Name: stateCookie, Value: other})
+	assert.NoError(t, s.verifyState(req, now.Add(stateMaxAge+time.Second)))
+	assert.Len(t, s.usedStates, 1)
+}
+
+func TestSlackAuthResponse_String(t *testing.T) {
+	auth := &SlackAuthResponse{Ok: true, AccessToken: "xoxb-secret", Team: Identity{Id: "T1"}}
+	assert.NotContains(t, auth.String(), "xoxb-secret")
+	assert.Contains(t, auth.String(), "T1")
+	assert.Equal(t, "xoxb-secret", auth.AccessToken)
+}
@@ -0,0 +1,286 @@
+package bot
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/atsu/chatops/db"
+	"github.com/nlopes/slack"
+)
+
+// outbound queue retry policy, a response is retried with a backoff doubling from the min to the max,
+// or after as long as slack asked, and dead lettered after the max attempts
+const (
+	outboundMaxAttempts = 8
+	outboundRetryMin    = time.Second
+	outboundRetryMax    = 5 * time.Minute
+	outboundBatch       = 50
+	outboundPoll        = time.Second
+	drainTimeout        = 10 * time.Second
+)
+
+// queuedResult is an ActionResult as stored in the outbound queue
+type queuedResult struct {
+	Result *ActionResult
+	Error  string `json:",omitempty"`
+}
+
+// DeadLetter is a response that could not be sent, without its response url, times are unix seconds
+type DeadLetter struct {
+	Id           int64        `json:"id"`
+	TeamId       string       `json:"teamId"`
+	ResponseType ResponseType `json:"responseType"`
+	Channel      string       `json:"channel,omitempty"`
+	UserId       string       `json:"userId,omitempty"`
+	Template     string       `json:"template,omitempty"`
+	Attempts     int          `json:"attempts"`
+	LastError    string       `json:"lastError"`
+	Created      int64        `json:"created"`
+	Failed       int64        `json:"failed"`
+}
+
+// outboundUpdate is what happened to a queued response, sent, retried later or dead lettered
+type outboundUpdate struct {
+	sent       bool
+	deadLetter bool
+	attempts   int
+	at         int64 // when to retry, or when it was dead lettered
+	lastError  string
+}
+
+// statusError is a response from slack that isn't a success
+type statusError struct {
+	what       string
+	code       int
+	body       string
+	retryAfter time.Duration // how long slack asked to wait before retrying, zero if it didn't say
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s failed with status %d: %s", e.what, e.code, e.body)
+}
+
+// newStatusError reads the Retry-After of a rate limited response
+func newStatusError(what string, resp *http.Response, body []byte) *statusError {
+	e := &statusError{what: what, code: resp.StatusCode, body: string(body)}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		e.retryAfter = time.Duration(secs) * time.Second
+	}
+	return e
+}
+
+// retryable reports whether sending may succeed later, rate limits, server errors and network errors,
+// and how long slack asked to wait
+func retryable(err error) (bool, time.Duration) {
+	var rateLimited *slack.RateLimitedError
+	var status *statusError
+	var retry interface{ Retryable() bool }
+	var netErr net.Error
+	switch {
+	case errors.As(err, &rateLimited):
+		return true, rateLimited.RetryAfter
+	case errors.As(err, &status):
+		return status.code == http.StatusTooManyRequests || status.code >= 500, status.retryAfter
+	case errors.As(err, &retry):
+		return retry.Retryable(), 0
+	case errors.As(err, &netErr):
+		// a refused connection, or no egress after shutdown, won't get better by trying again
+		return netErr.Timeout() || netErr.Temporary(), 0
+	}
+	return false, 0
+}
+
+// outboundBackoff is the wait before the attempt after the given number of failed attempts
+func outboundBackoff(attempts int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return retryAfter
+	}
+	backoff := outboundRetryMin << uint(attempts-1)
+	if backoff > outboundRetryMax || backoff <= 0 {
+		backoff = outboundRetryMax
+	}
+	return backoff
+}
+
+// queueActionResult stores the result in the outbound queue and wakes the response processor,
+// it is sent even if chatops restarts first
+func (s *Slack) queueActionResult(result *ActionResult) {
+	if result == nil {
+		return
+	}
+	dup := *result
+	dup.Error = nil // an error can't be unmarshalled, it is kept as its message
+	q := queuedResult{Result: &dup}
+	if result.Error != nil {
+		q.Error = result.Error.Error()
+	}
+	b, err := json.Marshal(q)
+	if err == nil {
+		_, err = s.database.EnqueueOutbound(result.TeamId, b, time.Now().Unix())
+	}
+	if err != nil {
+		log.Println("failed to queue response, sending it now:", err)
+		s.SendResultResponse(result)
+		return
+	}
+	select {
+	case s.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// startResponseProcessor sends the queued responses as they are queued or become due, until the bot is stopped
+// when it sends the responses that are due before returning
+func (s *Slack) startResponseProcessor() {
+	s.processorDone = make(chan struct{})
+	go func() {
+		defer close(s.processorDone)
+		ticker := time.NewTicker(outboundPoll)
+		defer ticker.Stop()
+		for {
+			for s.sendOutbound(time.Now()) == outboundBatch {
+			}
+			select {
+			case <-s.doneCh:
+				for s.sendOutbound(time.Now()) == outboundBatch {
+				}
+				return
+			case <-s.wakeCh:
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// sendOutbound sends a batch of the responses due by now, returning how many were handled
+func (s *Slack) sendOutbound(now time.Time) int {
+	msgs, err := s.database.DueOutbound(now.Unix(), outboundBatch)
+	if err != nil {
+		log.Println("failed to read the outbound queue:", err)
+		s.recordError(err)
+		return 0
+	}
+	for _, m := range msgs {
+		if err := s.sendQueued(m, now); err != nil {
+			log.Println("failed to update the outbound queue:", err)
+			s.recordError(err)
+			return 0
+		}
+	}
+	return len(msgs)
+}
+
+// sendQueued sends a queued response, retrying it later if it may succeed then and dead lettering it otherwise.
+// Kafka and feedback are handled on the first attempt only. A response whose last update failed is only updated,
+// it isn't sent again.
+func (s *Slack) sendQueued(m db.OutboundMessage, now time.Time) error {
+	if u, ok := s.pendingUpdate(m.Id); ok {
+		return s.updateOutbound(m.Id, u)
+	}
+	var q queuedResult
+	if err := json.Unmarshal(m.Payload, &q); err != nil || q.Result == nil {
+		return s.deadLetter(m.Id, m.Attempts, fmt.Sprintf("invalid queued response: %v", err), now)
+	}
+	result := q.Result
+	if q.Error != "" {
+		result.Error = errors.New(q.Error)
+	}
+	if m.Attempts == 0 {
+		s.resultEffects(result)
+	}
+	err := s.deliverResult(result)
+	if err == nil {
+		return s.updateOutbound(m.Id, outboundUpdate{sent: true})
+	}
+	attempts := m.Attempts + 1
+	if retry, after := retryable(err); retry && attempts < outboundMaxAttempts {
+		atomic.AddInt64(&s.retryCount, 1)
+		next := now.Add(outboundBackoff(attempts, after))
+		log.Printf("response %d failed, attempt %d retried at %s: %v", m.Id, attempts, next.Format(time.RFC3339), err)
+		return s.updateOutbound(m.Id, outboundUpdate{attempts: attempts, at: next.Unix(), lastError: err.Error()})
+	}
+	return s.deadLetter(m.Id, attempts, err.Error(), now)
+}
+
+func (s *Slack) deadLetter(id int64, attempts int, reason string, now time.Time) error {
+	atomic.AddInt64(&s.deadLetterCount, 1)
+	log.Printf("response %d dead lettered after %d attempts: %s", id, attempts, reason)
+	return s.updateOutbound(id, outboundUpdate{deadLetter: true, attempts: attempts, at: now.Unix(), lastError: reason})
+}
+
+// updateOutbound records what happened to the queued response. If the database fails the update is held
+// in memory and made again the next time the response is due, until then it isn't sent again.
+// Held updates are lost on restart, so a response sent just before then may be sent twice.
+func (s *Slack) updateOutbound(id int64, u outboundUpdate) error {
+	var err error
+	switch {
+	case u.sent:
+		err = s.database.DeleteOutbound(id)
+	case u.deadLetter:
+		err = s.database.DeadLetterOutbound(id, u.attempts, u.lastError, u.at)
+	default:
+		err = s.database.RetryOutbound(id, u.attempts, u.at, u.lastError)
+	}
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+	if err != nil {
+		s.pendingUpdates[id] = u
+	} else {
+		delete(s.pendingUpdates, id)
+	}
+	return err
+}
+
+func (s *Slack) pendingUpdate(id int64) (outboundUpdate, bool) {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+	u, ok := s.pendingUpdates[id]
+	return u, ok
+}
+
+// DeadLetters returns up to limit responses that could not be sent, most recent first
+func (s *Slack) DeadLetters(limit int) ([]DeadLetter, error) {
+	letters, err := s.database.GetDeadLetters(limit)
+	if err != nil {
+		return nil, err
+	}
+	dls := make([]DeadLetter, 0, len(letters))
+	for _, l := range letters {
+		dl := DeadLetter{Id: l.Id, TeamId: l.TeamId, Attempts: l.Attempts, LastError: l.LastError, Created: l.Created, Failed: l.Failed}
+		var q queuedResult
+		if err := json.Unmarshal(l.Payload, &q); err == nil && q.Result != nil {
+			dl.ResponseType = q.Result.ResponseType
+			dl.Channel = q.Result.Channel
+			dl.UserId = q.Result.UserId
+			dl.Template = string(q.Result.ProcessedTemplate)
+		}
+		dls = append(dls, dl)
+	}
+	return dls, nil
+}
+
+// sendResponseURL posts the body to a response url or webhook, a response that isn't a success is an error
+func (s *Slack) sendResponseURL(what, url string, body []byte) (int, []byte, error) {
+	resp, err := s.outbound().Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed POST to %s: %w", what, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, b, newStatusError(what, resp, b)
+	}
+	return resp.StatusCode, b, nil
+}
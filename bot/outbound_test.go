@@ -0,0 +1,278 @@
+package bot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atsu/chatops/interfaces/mocks"
+	"github.com/atsu/chatops/relay"
+	"github.com/nlopes/slack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		retry      bool
+		retryAfter time.Duration
+	}{
+		{"rate limited", &slack.RateLimitedError{RetryAfter: 30 * time.Second}, true, 30 * time.Second},
+		{"too many requests", &statusError{code: http.StatusTooManyRequests, retryAfter: 5 * time.Second}, true, 5 * time.Second},
+		{"server error", &statusError{code: http.StatusBadGateway}, true, 0},
+		{"wrapped server error", fmt.Errorf("failed: %w", &statusError{code: http.StatusInternalServerError}), true, 0},
+		{"client error", &statusError{code: http.StatusNotFound}, false, 0},
+		{"network timeout", &url.Error{Op: "Post", URL: "https://hooks.slack.com", Err: &net.DNSError{IsTimeout: true}}, true, 0},
+		{"temporary network error", &url.Error{Op: "Post", URL: "https://hooks.slack.com", Err: &net.DNSError{IsTemporary: true}}, true, 0},
+		{"connection refused", &url.Error{Op: "Post", URL: "https://hooks.slack.com", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, false, 0},
+		{"no egress", &url.Error{Op: "Post", URL: "https://hooks.slack.com", Err: relay.ErrNoEgress}, false, 0},
+		{"slack error", errors.New("channel_not_found"), false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retry, after := retryable(tt.err)
+			assert.Equal(t, tt.retry, retry)
+			assert.Equal(t, tt.retryAfter, after)
+		})
+	}
+}
+
+func TestOutboundBackoff(t *testing.T) {
+	assert.Equal(t, outboundRetryMin, outboundBackoff(1, 0))
+	assert.Equal(t, 4*outboundRetryMin, outboundBackoff(3, 0))
+	assert.Equal(t, outboundRetryMax, outboundBackoff(30, 0))
+	assert.Equal(t, time.Minute, outboundBackoff(3, time.Minute))
+}
+
+// newOutboundTestSlack answers response url posts with the statuses in turn, the last one once they run out
+func newOutboundTestSlack(tdb *TestDb, statuses ...int) (*Slack, func() int) {
+	var lock sync.Mutex
+	calls := 0
+	mockCom := new(mocks.ChatOpsCom)
+	mockCom.On("KafkaProduce", mock.Anything, mock.Anything).Return()
+	s := NewSlack(createSlackTestConfig(), mockCom, tdb)
+	s.SetHTTPClient(&http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		status := statuses[len(statuses)-1]
+		if calls < len(statuses) {
+			status = statuses[calls]
+		}
+		calls++
+		header := http.Header{}
+		if status == http.StatusTooManyRequests {
+			header.Set("Retry-After", "30")
+		}
+		return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader("")), Header: header}, nil
+	})})
+	return s, func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return calls
+	}
+}
+
+var directResult = &ActionResult{TeamId: "T1", ResponseType: Direct, ResponseUrl: "https://hooks.slack.com/response", UserId: "U1",
+	ProcessedTemplate: []byte(`{"text":"done"}`), SendToKafka: true}
+
+func TestSlack_SendOutbound(t *testing.T) {
+	now := time.Now()
+
+	t.Run("retried after the rate limit", func(t *testing.T) {
+		tdb := createTestDb()
+		s, calls := newOutboundTestSlack(tdb, http.StatusTooManyRequests, http.StatusOK)
+		s.queueActionResult(directResult)
+		assert.Equal(t, 1, s.sendOutbound(now))
+		if queued := tdb.queued(); assert.Len(t, queued, 1) {
+			assert.Equal(t, 1, queued[0].Attempts)
+			assert.Equal(t, now.Add(30*time.Second).Unix(), queued[0].NextAttempt)
+			assert.Contains(t, queued[0].LastError, "status 429")
+		}
+		assert.Equal(t, 0, s.sendOutbound(now.Add(29*time.Second)))
+		assert.Equal(t, 1, s.sendOutbound(now.Add(30*time.Second)))
+		assert.Empty(t, tdb.queued())
+		assert.Equal(t, 2, calls())
+		assert.Equal(t, int64(1), s.Status().Retried)
+		assert.Equal(t, int64(0), s.Status().DeadLettered)
+		// kafka is sent to once however many attempts it takes
+		s.com.(*mocks.ChatOpsCom).AssertNumberOfCalls(t, "KafkaProduce", 1)
+	})
+
+	t.Run("dead lettered when slack refuses it", func(t *testing.T) {
+		tdb := createTestDb()
+		s, calls := newOutboundTestSlack(tdb, http.StatusNotFound)
+		s.queueActionResult(directResult)
+		assert.Equal(t, 1, s.sendOutbound(now))
+		assert.Empty(t, tdb.queued())
+		assert.Equal(t, 1, calls())
+		letters, err := s.DeadLetters(10)
+		assert.NoError(t, err)
+		if assert.Len(t, letters, 1) {
+			assert.Equal(t, 1, letters[0].Attempts)
+			assert.Contains(t, letters[0].LastError, "status 404")
+		}
+		assert.Equal(t, int64(1), s.Status().DeadLettered)
+	})
+
+	t.Run("dead lettered after the last attempt", func(t *testing.T) {
+		tdb := createTestDb()
+		s, calls := newOutboundTestSlack(tdb, http.StatusServiceUnavailable)
+		s.queueActionResult(directResult)
+		at := now
+		for i := 0; i < outboundMaxAttempts; i++ {
+			assert.Equal(t, 1, s.sendOutbound(at))
+			at = at.Add(outboundRetryMax)
+		}
+		assert.Empty(t, tdb.queued())
+		assert.Equal(t, outboundMaxAttempts, calls())
+		letters, err := s.DeadLetters(10)
+		assert.NoError(t, err)
+		if assert.Len(t, letters, 1) {
+			assert.Equal(t, outboundMaxAttempts, letters[0].Attempts)
+		}
+		assert.Equal(t, int64(outboundMaxAttempts-1), s.Status().Retried)
+	})
+
+	t.Run("invalid payload dead lettered", func(t *testing.T) {
+		tdb := createTestDb()
+		s, calls := newOutboundTestSlack(tdb, http.StatusOK)
+		_, err := tdb.EnqueueOutbound("T1", []byte("not json"), now.Unix())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, s.sendOutbound(now))
+		assert.Empty(t, tdb.queued())
+		assert.Equal(t, 0, calls())
+		letters, err := s.DeadLetters(10)
+		assert.NoError(t, err)
+		assert.Len(t, letters, 1)
+	})
+}
+
+// failingDb fails the first few DeleteOutbound and RetryOutbound calls
+type failingDb struct {
+	*TestDb
+	deletes, retries int
+}
+
+func (f *failingDb) DeleteOutbound(id int64) error {
+	if f.deletes > 0 {
+		f.deletes--
+		return errors.New("database is locked")
+	}
+	return f.TestDb.DeleteOutbound(id)
+}
+
+func (f *failingDb) RetryOutbound(id int64, attempts int, nextAttempt int64, lastError string) error {
+	if f.retries > 0 {
+		f.retries--
+		return errors.New("database is locked")
+	}
+	return f.TestDb.RetryOutbound(id, attempts, nextAttempt, lastError)
+}
+
+func TestSlack_SendOutboundUpdateFails(t *testing.T) {
+	now := time.Now()
+
+	t.Run("sent response not sent again", func(t *testing.T) {
+		tdb := createTestDb()
+		fdb := &failingDb{TestDb: tdb, deletes: 2}
+		s, calls := newOutboundTestSlack(tdb, http.StatusOK)
+		s.database = fdb
+		s.queueActionResult(directResult)
+		assert.Equal(t, 0, s.sendOutbound(now))
+		assert.Equal(t, 0, s.sendOutbound(now.Add(time.Second)))
+		assert.Len(t, tdb.queued(), 1)
+		assert.Equal(t, 1, s.sendOutbound(now.Add(2*time.Second)))
+		assert.Empty(t, tdb.queued())
+		assert.Equal(t, 1, calls())
+		s.com.(*mocks.ChatOpsCom).AssertNumberOfCalls(t, "KafkaProduce", 1)
+	})
+
+	t.Run("retry kept until it is recorded", func(t *testing.T) {
+		tdb := createTestDb()
+		fdb := &failingDb{TestDb: tdb, retries: 1}
+		s, calls := newOutboundTestSlack(tdb, http.StatusServiceUnavailable, http.StatusOK)
+		s.database = fdb
+		s.queueActionResult(directResult)
+		assert.Equal(t, 0, s.sendOutbound(now))
+		// the row is still due but the retry waits for its backoff
+		assert.Equal(t, 1, s.sendOutbound(now))
+		assert.Equal(t, 1, calls())
+		if queued := tdb.queued(); assert.Len(t, queued, 1) {
+			assert.Equal(t, 1, queued[0].Attempts)
+			assert.Equal(t, now.Add(outboundRetryMin).Unix(), queued[0].NextAttempt)
+		}
+		assert.Equal(t, 1, s.sendOutbound(now.Add(outboundRetryMin)))
+		assert.Equal(t, 2, calls())
+		assert.Empty(t, tdb.queued())
+		assert.Equal(t, int64(1), s.Status().Retried)
+		s.com.(*mocks.ChatOpsCom).AssertNumberOfCalls(t, "KafkaProduce", 1)
+	})
+}
+
+func TestSlack_QueueActionResult(t *testing.T) {
+	tdb := createTestDb()
+	s, _ := newOutboundTestSlack(tdb, http.StatusOK)
+	s.queueActionResult(&ActionResult{TeamId: "T1", ResponseType: None, Error: errors.New("template failed")})
+	s.queueActionResult(nil)
+	if queued := tdb.queued(); assert.Len(t, queued, 1) {
+		var q queuedResult
+		assert.NoError(t, json.Unmarshal(queued[0].Payload, &q))
+		assert.Equal(t, "template failed", q.Error)
+		assert.Equal(t, None, q.Result.ResponseType)
+	}
+}
+
+func TestSlack_StopDrainsQueue(t *testing.T) {
+	tdb := createTestDb()
+
+	// responses queued before a restart are sent by the next start
+	s, calls := newOutboundTestSlack(tdb, http.StatusOK)
+	s.queueActionResult(directResult)
+	s.queueActionResult(directResult)
+	assert.Equal(t, 0, calls())
+
+	s, calls = newOutboundTestSlack(tdb, http.StatusOK)
+	s.startResponseProcessor()
+	s.queueActionResult(directResult)
+	s.Stop()
+	assert.Equal(t, 3, calls())
+	assert.Empty(t, tdb.queued())
+}
+
+func TestSlack_DeadLetters(t *testing.T) {
+	tdb := createTestDb()
+	s, _ := newOutboundTestSlack(tdb, http.StatusGone)
+	now := time.Now()
+	s.queueActionResult(directResult)
+	s.sendOutbound(now)
+	s.queueActionResult(&ActionResult{TeamId: "T2", ResponseType: Channel, Channel: "alerts", ProcessedTemplate: []byte("not json")})
+	s.sendOutbound(now.Add(time.Minute))
+
+	letters, err := s.DeadLetters(10)
+	assert.NoError(t, err)
+	if assert.Len(t, letters, 2) {
+		assert.Equal(t, "T2", letters[0].TeamId)
+		assert.Equal(t, Channel, letters[0].ResponseType)
+		assert.Equal(t, "alerts", letters[0].Channel)
+		assert.Equal(t, now.Add(time.Minute).Unix(), letters[0].Failed)
+		assert.Equal(t, "T1", letters[1].TeamId)
+		assert.Equal(t, `{"text":"done"}`, letters[1].Template)
+	}
+	b, err := json.Marshal(letters)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "hooks.slack.com/response")
+
+	letters, err = s.DeadLetters(1)
+	assert.NoError(t, err)
+	assert.Len(t, letters, 1)
+}
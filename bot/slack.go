@@ -13,6 +13,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"text/template"
 	"time"
 
@@ -38,27 +39,45 @@ const (
 	SlackCallbackEndpoint    = "/slack/callback"
 	SlackOnDemandTplEndpoint = "/slack/on-demand-template"
 	FreeformTemplate         = "_freeform.tpl"
+	DefaultMentionTemplate   = "_kafka.tpl"                   // runs for mentions that don't name a template
 	FreeformPassword         = "YXRzdS10by10aGUtbW9vbiEhIQ==" // TODO XXX hard-coded for now
 	SlackAuthorizeUrl        = "https://slack.com/oauth/v2/authorize"
 	SlackAccessUrl           = "https://slack.com/api/oauth.v2.access"
+	SlackApiUrl              = "https://slack.com/api/"
 )
 
 type Slack struct {
 	token             string
 	verificationToken string
 	secretSigningKey  string
+	signingKeys       [][]byte             // the current signing key first, then any previous keys still accepted
+	maxRequestAge     time.Duration        // requests with a timestamp further than this from now are refused
+	dedup             *deduplicator        // event and trigger ids already handled
+	usedStates        map[string]time.Time // nonces of the oauth states used to install, until they expire
+	stateLock         sync.Mutex
+	mentionTemplate   string        // runs for mentions that don't name a template
+	home              *home         // what the home tab shows
+	sweepInterval     time.Duration // how often workspace tokens are checked, negative never
+	replay            bool          // replaying recordings, nothing is sent to slack
 	inWebHook         string
 	feedbackTopic     string
 	clientId          string
 	clientSecret      string
 	authRedirectUrl   string
+	callbackUrl       string   // redirect_uri given to slack, empty uses the app's configured redirect url
+	scopes            []string // bot scopes requested on install
 
 	// map of id to slack client
 	//workspaceApis map[string]*slack.Client
 	workspaceApis sync.Map
+	workspaces    map[string]*WorkspaceStatus // state of the workspaces loaded or that failed to load
+	workspaceTTL  time.Duration               // how long a loaded workspace is used before it is loaded again
+	wsLock        sync.Mutex                  // guards workspaces
+	loadLocks     sync.Map                    // *sync.Mutex by team id, one load of a workspace at a time
 
 	database          db.Database
 	com               interfaces.ChatOpsCom
+	httpClient        *http.Client // used for all outbound calls to slack
 	templateDirectory string
 	templates         *template.Template
 	templateMetadata  map[string]*TemplateMetadata
@@ -74,15 +93,25 @@ type Slack struct {
 	atsuEventsCounter       metric.Metric
 	templateErrorsCounter   metric.Metric
 	errorsLastHour          metric.Metric
+	dedupCounter            metric.Metric
+	dedupCount              int64
 	errorCount              int64
 	errorTimes              []int64
 	errorsRecent            []string
+	templateErr             error
+	rejections              map[string]int64 // requests that failed verification, by reason
+	lastRejection           string
 	errLock                 sync.Mutex
 
 	//api         *slack.Client
-	doneCh      chan int
-	resultQueue chan *ActionResult
-	debug       bool
+	doneCh          chan int
+	wakeCh          chan struct{} // wakes the response processor when a response is queued
+	processorDone   chan struct{} // closed once the response processor has drained the queue
+	retryCount      int64
+	deadLetterCount int64
+	pendingUpdates  map[int64]outboundUpdate // queue updates the database failed, retried before sending again
+	pendingLock     sync.Mutex
+	debug           bool
 }
 
 type SlackConfig struct {
@@ -90,11 +119,20 @@ type SlackConfig struct {
 	Token             string
 	VerificationToken string
 	SecretSigningKey  string
+	PrevSigningKeys   []string      // previous signing keys still accepted while a key rotation is rolled out
+	MaxRequestAge     time.Duration // zero uses DefaultMaxRequestAge
+	DedupWindow       time.Duration // zero uses DefaultDedupWindow
+	MentionTemplate   string        // empty uses DefaultMentionTemplate
+	SweepInterval     time.Duration // zero uses DefaultTokenSweepInterval, negative disables the sweep
+	WorkspaceTTL      time.Duration // zero uses DefaultWorkspaceTTL
+	Replay            bool          // replaying recordings, responses are queued but never sent and tokens aren't swept
 	InWebHook         string
 	FeedbackTopic     string
 	ClientId          string
 	ClientSecret      string
 	AuthRedirectUrl   string
+	CallbackUrl       string   // the url of SlackCallbackEndpoint given to slack as the redirect_uri
+	Scopes            []string // empty uses DefaultScopes
 
 	TemplateDir string
 }
@@ -105,18 +143,53 @@ func (cfg SlackConfig) Validate() error {
 }
 
 func NewSlack(cfg SlackConfig, com interfaces.ChatOpsCom, database db.Database) *Slack {
+	maxRequestAge := cfg.MaxRequestAge
+	if maxRequestAge <= 0 {
+		maxRequestAge = DefaultMaxRequestAge
+	}
+	dedupWindow := cfg.DedupWindow
+	if dedupWindow <= 0 {
+		dedupWindow = DefaultDedupWindow
+	}
+	sweepInterval := cfg.SweepInterval
+	if sweepInterval == 0 {
+		sweepInterval = DefaultTokenSweepInterval
+	}
+	workspaceTTL := cfg.WorkspaceTTL
+	if workspaceTTL <= 0 {
+		workspaceTTL = DefaultWorkspaceTTL
+	}
+	scopes := cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = strings.Split(DefaultScopes, ",")
+	}
+	mentionTemplate := cfg.MentionTemplate
+	if mentionTemplate == "" {
+		mentionTemplate = DefaultMentionTemplate
+	}
 	return &Slack{
 		token:             cfg.Token,
 		verificationToken: cfg.VerificationToken,
 		secretSigningKey:  cfg.SecretSigningKey,
+		signingKeys:       signingKeys(cfg.SecretSigningKey, cfg.PrevSigningKeys),
+		maxRequestAge:     maxRequestAge,
+		dedup:             newDeduplicator(dedupWindow, dedupCapacity),
+		mentionTemplate:   mentionTemplate,
+		home:              newHome(),
+		sweepInterval:     sweepInterval,
+		replay:            cfg.Replay,
 		inWebHook:         cfg.InWebHook,
 		feedbackTopic:     cfg.FeedbackTopic,
 		clientId:          cfg.ClientId,
 		clientSecret:      cfg.ClientSecret,
 		authRedirectUrl:   cfg.AuthRedirectUrl,
+		callbackUrl:       cfg.CallbackUrl,
+		scopes:            scopes,
 		templateDirectory: path.Join(cfg.TemplateDir, "slack"),
 
 		//workspaceApis: make(map[string]*slack.Client),
+		workspaces:   make(map[string]*WorkspaceStatus),
+		workspaceTTL: workspaceTTL,
 
 		requestResponseTimeSecs: metric.NewHistogram("1h1h"), // 1 hour history, 1 hour precision
 		slashCounter:            metric.NewCounter("1h1h"),   // 1 hour history, 1 hour precision
@@ -126,15 +199,21 @@ func NewSlack(cfg SlackConfig, com interfaces.ChatOpsCom, database db.Database)
 		atsuEventsCounter:       metric.NewCounter("1h1h"),   // 1 hour history, 1 hour precision
 		templateErrorsCounter:   metric.NewCounter("1h1h"),   // 1 hour history, 1 hour precision
 		errorsLastHour:          metric.NewCounter("1h1h"),   // 1 hour history, 1 hour precision
+		dedupCounter:            metric.NewCounter("1h1h"),   // 1 hour history, 1 hour precision
 		onDemandMetadata:        make(map[string]*TemplateMetadata),
 		onDemandTemplates:       template.New(""), // dummy so we don't ever hit a nil pointer.
 
 		database:     database,
 		com:          com,
+		httpClient:   http.DefaultClient,
 		errorTimes:   make([]int64, 0, 100),
 		errorsRecent: make([]string, 0, 10),
+		rejections:   make(map[string]int64),
+		usedStates:   make(map[string]time.Time),
 		doneCh:       make(chan int),
-		resultQueue:  make(chan *ActionResult, 10),
+		wakeCh:       make(chan struct{}, 1),
+
+		pendingUpdates: make(map[int64]outboundUpdate),
 	}
 }
 
@@ -142,8 +221,27 @@ func (s *Slack) SetDebug(b bool) {
 	s.debug = b
 }
 
+// SetHTTPClient sets the client used for slack api, response url and webhook calls, must be called before Start
+func (s *Slack) SetHTTPClient(client *http.Client) {
+	s.httpClient = client
+}
+
+// outbound returns the client for calls to slack
+func (s *Slack) outbound() *http.Client {
+	if s.httpClient == nil {
+		return http.DefaultClient
+	}
+	return s.httpClient
+}
+
+// newClient creates a slack api client for the token
+func (s *Slack) newClient(token string) *slack.Client {
+	return slack.New(token, slack.OptionHTTPClient(s.outbound()))
+}
+
 type SlackStatus struct {
 	Health                health.State `json:"health"`
+	Message               string       `json:"message,omitempty"`
 	ResponseTimeSecs      interface{}
 	SlashCounter          interface{}
 	EventCounter          interface{}
@@ -152,10 +250,19 @@ type SlackStatus struct {
 	AtsuEventCounter      interface{}
 	ErrorsCounter         interface{}
 	TemplateErrorsCounter interface{}
+	DedupCounter          interface{}
 	ErrorTimes            []int64
 	ErrorsRecent          []string
-	Events                int64 `json:"events"`
-	Errors                int64 `json:"errors"`
+	Events                int64             `json:"events"`
+	Errors                int64             `json:"errors"`
+	Deduplicated          int64             `json:"deduplicated"`
+	Retried               int64             `json:"retried"`      // failed attempts to send a response that were retried
+	DeadLettered          int64             `json:"deadLettered"` // responses given up on, see DeadLetters
+	Rejected              int64             `json:"rejected"`
+	RejectedReasons       map[string]int64  `json:"rejectedReasons,omitempty"`
+	LastRejection         string            `json:"lastRejection,omitempty"`
+	InactiveWorkspaces    map[string]string `json:"inactiveWorkspaces,omitempty"`
+	Workspaces            []WorkspaceStatus `json:"workspaces,omitempty"`
 }
 
 func (s *Slack) LoadTemplates() error {
@@ -164,14 +271,33 @@ func (s *Slack) LoadTemplates() error {
 		s.templates = templates
 		s.templateMetadata = templateMetadata
 	}
+	s.errLock.Lock()
+	s.templateErr = err
+	s.errLock.Unlock()
 
 	return err
 }
 
 func (s *Slack) Status() SlackStatus {
-	h := health.Green
+	workspaces := s.workspaceStatuses()
+	inactive := make(map[string]string)
+	for _, ws := range workspaces {
+		if ws.State == WorkspaceInactive {
+			inactive[ws.TeamId] = ws.LastError
+		}
+	}
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+	h, msg := s.health()
+	rejected := int64(0)
+	reasons := make(map[string]int64, len(s.rejections))
+	for reason, cnt := range s.rejections {
+		reasons[reason] = cnt
+		rejected += cnt
+	}
 	return SlackStatus{
 		Health:                h,
+		Message:               msg,
 		ResponseTimeSecs:      s.requestResponseTimeSecs,
 		SlashCounter:          s.slashCounter,
 		EventCounter:          s.eventCounter,
@@ -180,10 +306,42 @@ func (s *Slack) Status() SlackStatus {
 		AtsuEventCounter:      s.atsuEventsCounter,
 		ErrorsCounter:         s.errorsLastHour,
 		TemplateErrorsCounter: s.templateErrorsCounter,
+		DedupCounter:          s.dedupCounter,
 		ErrorTimes:            s.errorTimes,
 		ErrorsRecent:          s.errorsRecent,
 		Errors:                s.errorCount,
+		Deduplicated:          atomic.LoadInt64(&s.dedupCount),
+		Retried:               atomic.LoadInt64(&s.retryCount),
+		DeadLettered:          atomic.LoadInt64(&s.deadLetterCount),
+		Rejected:              rejected,
+		RejectedReasons:       reasons,
+		LastRejection:         s.lastRejection,
+		InactiveWorkspaces:    inactive,
+		Workspaces:            workspaces,
+	}
+}
+
+// health is red if the templates failed to load and yellow if there were errors in the last hour,
+// the error lock must be held
+func (s *Slack) health() (health.State, string) {
+	if s.templateErr != nil {
+		return health.Red, fmt.Sprintf("templates failed to load: %v", s.templateErr)
+	}
+	hourAgo := time.Now().Add(-time.Hour).Unix()
+	cnt := 0
+	for _, t := range s.errorTimes {
+		if t > hourAgo {
+			cnt++
+		}
 	}
+	if cnt == 0 {
+		return health.Green, ""
+	}
+	msg := fmt.Sprintf("%d errors in the last hour", cnt)
+	if len(s.errorsRecent) > 0 {
+		msg = fmt.Sprintf("%s, last: %s", msg, s.errorsRecent[len(s.errorsRecent)-1])
+	}
+	return health.Yellow, msg
 }
 
 type SlackInstance struct {
@@ -193,43 +351,48 @@ type SlackInstance struct {
 	client     *slack.Client
 }
 
+// relayEvents relays events with the relay queue, except slack's url_verification challenge which slack expects
+// the handler to answer right away, so it is never queued
+func relayEvents(r *relay.Relay) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		var outer struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(body, &outer); err == nil && outer.Type == slackevents.URLVerification {
+			r.RelayHandler(w, req)
+			return
+		}
+		r.BufferedRelayHandler(w, req)
+	}
+}
+
 func (s *Slack) Start(router *mux.Router, r *relay.Relay) error {
 	if r.Mode != relay.PassThrough {
 		if err := s.LoadTemplates(); err != nil {
 			return err
 		}
 
-		// TODO: this should really be on-demand loading
-		bots, err := s.database.GetAllSlackBots()
-		if err != nil {
-			return err
+		// workspaces are loaded from the database on first use, see instance
+		if !s.replay {
+			s.startResponseProcessor()
+			s.startTokenSweep(s.sweepInterval)
 		}
-		for _, bot := range bots {
-			inst := SlackInstance{
-				TeamId:     bot.TeamId,
-				BotToken:   bot.BotToken,
-				WebHookUrl: bot.WebHookUrl,
-				client:     slack.New(bot.BotToken),
-			}
-			ti, err := inst.client.GetTeamInfo()
-			if err != nil {
-				log.Printf("error loading slack client for team:%s token:%s - %s", bot.TeamId, bot.BotToken, err)
-			} else {
-				log.Printf("slack for teamid:%s (%s) on \"%s.slack.com\" is active\n", ti.ID, ti.Name, ti.Domain)
-				s.workspaceApis.Store(bot.TeamId, inst)
-			}
-		}
-		s.startResponseProcessor()
 	}
 
 	// For relay mode, we want to relay the slack events...
 	if r.Mode == relay.PassThrough {
-		// Passthrough Mode only relays requests
-		router.HandleFunc(EventEndpoint, r.RelayHandler)
+		// Passthrough Mode only relays requests, events only need an acknowledgement so they can wait for a handler
+		router.HandleFunc(EventEndpoint, relayEvents(r))
 		router.HandleFunc(InterctEndpoint, r.RelayHandler)
 		router.HandleFunc(SlashEndpoint, r.RelayHandler)
 		router.HandleFunc(LoadActionsEndpoint, r.RelayHandler)
-		router.HandleFunc(AtsuEventEndpoint, r.RelayHandler)
+		router.HandleFunc(AtsuEventEndpoint, r.BufferedRelayHandler)
 		router.HandleFunc(SlackOnDemandTplEndpoint, r.RelayHandler)
 		router.HandleFunc(SlackAuthorizeEndpoint, r.RelayHandler)
 		router.HandleFunc(SlackCallbackEndpoint, r.RelayHandler)
@@ -260,23 +423,35 @@ func (s *Slack) Start(router *mux.Router, r *relay.Relay) error {
 	return nil
 }
 
-func (s *Slack) startResponseProcessor() {
-	go func() {
-		for {
-			select {
-			case <-s.doneCh:
-				return
-			case res := <-s.resultQueue:
-				s.SendResultResponse(res)
-			}
-		}
-	}()
-}
-
+// Stop stops the bot, waiting for the responses that are due to be sent, at most drainTimeout,
+// the rest stay queued for the next start
 func (s *Slack) Stop() {
 	if s.doneCh != nil {
 		close(s.doneCh)
 	}
+	if s.processorDone != nil {
+		select {
+		case <-s.processorDone:
+		case <-time.After(drainTimeout):
+			log.Println("timed out sending queued responses, they are sent on the next start")
+		}
+	}
+}
+
+// duplicate reports whether the delivery was already handled, acknowledging it again is all that is left to do.
+// The kind and id identify the delivery, e.g. an event and its event id.
+func (s *Slack) duplicate(kind, id string, h http.Header) bool {
+	if id == "" || !s.dedup.duplicate(kind+":"+id, time.Now()) {
+		return false
+	}
+	atomic.AddInt64(&s.dedupCount, 1)
+	if s.dedupCounter != nil {
+		s.dedupCounter.Add(1)
+	}
+	if s.debug {
+		log.Printf("ignoring duplicate %s %s, retry: %q reason: %q\n", kind, id, h.Get("X-Slack-Retry-Num"), h.Get("X-Slack-Retry-Reason"))
+	}
+	return true
 }
 
 func (s *Slack) httpError(r *http.Request, w http.ResponseWriter, status int, resp string, e error) {
@@ -352,14 +527,32 @@ func (s *Slack) OnDemandTemplateHandler(w http.ResponseWriter, r *http.Request)
 	w.WriteHeader(http.StatusAccepted)
 }
 
+// AuthorizeHandler starts an install, redirecting to slack with the scopes and a state that binds the install to this browser
 func (s *Slack) AuthorizeHandler(w http.ResponseWriter, r *http.Request) {
-	//r.URL.Query().Set("redirect_uri", "http://localhost")
-	//r.URL.Query().Set("scope", "incoming-webhook")
-	//r.URL.Query().Set("client_id", s.clientId)
-	//r.URL.Query().Set("state", "")
-	scopes := "app_mentions:read,incoming-webhook,commands,team:read"
+	state, err := s.newState(time.Now())
+	if err != nil {
+		s.httpError(r, w, http.StatusInternalServerError, "failed to start install", err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Value:    state,
+		Path:     SlackCallbackEndpoint,
+		MaxAge:   int(stateMaxAge.Seconds()),
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	q := url.Values{
+		"scope":     {strings.Join(s.scopes, ",")},
+		"client_id": {s.clientId},
+		"state":     {state},
+	}
+	if s.callbackUrl != "" {
+		q.Set("redirect_uri", s.callbackUrl)
+	}
 	u, _ := url.Parse(SlackAuthorizeUrl)
-	u.RawQuery = fmt.Sprintf("scope=%s&client_id=%s", scopes, s.clientId)
+	u.RawQuery = q.Encode()
 	http.Redirect(w, r, u.String(), http.StatusFound)
 }
 
@@ -385,52 +578,75 @@ type SlackAuthResponse struct {
 	Team            Identity     `json:"team"`
 	Enterprise      Identity     `json:"enterprise"`
 	IncomingWebHook SlackWebHook `json:"incoming_webhook"`
+	Error           string       `json:"error"`
 	//AuthedUser string // TODO:(smt) do we care about this?
 }
 
+// String is the response without the access token, so it can be logged
 func (s *SlackAuthResponse) String() string {
-	if b, err := json.Marshal(s); err != nil {
+	redacted := *s
+	if redacted.AccessToken != "" {
+		redacted.AccessToken = "REDACTED"
+	}
+	if b, err := json.Marshal(redacted); err != nil {
 		return fmt.Sprintf(`{"error": "%s" }`, err.Error())
 	} else {
 		return string(b)
 	}
 }
 
+// CallbackHandler completes an install started by AuthorizeHandler, slack redirects here with a code
+// to exchange for the workspace's bot token, or an error if the user cancelled the install
 func (s *Slack) CallbackHandler(w http.ResponseWriter, r *http.Request) {
-	code := r.URL.Query().Get("code")
-	//state := r.URL.Query().Get("state")
+	http.SetCookie(w, &http.Cookie{Name: stateCookie, Path: SlackCallbackEndpoint, MaxAge: -1})
+	if err := s.verifyState(r, time.Now()); err != nil {
+		s.recordRejection(err)
+		log.Println("install refused:", err)
+		installError(w, http.StatusBadRequest, "Install failed", "The install link expired or was not started from this browser, please start the install again.")
+		return
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		log.Println("install denied:", e)
+		installError(w, http.StatusForbidden, "Install cancelled", "The app was not installed.")
+		return
+	}
 
 	form := url.Values{
-		"code":          {code},
+		"code":          {r.URL.Query().Get("code")},
 		"client_id":     {s.clientId},
 		"client_secret": {s.clientSecret},
 	}
-	res, err := http.PostForm(SlackAccessUrl, form)
+	if s.callbackUrl != "" {
+		form.Set("redirect_uri", s.callbackUrl)
+	}
+	res, err := s.outbound().PostForm(SlackAccessUrl, form)
 	if err != nil {
+		s.recordError(err)
+		installError(w, http.StatusBadGateway, "Install failed", "Slack could not be reached, please try again.")
+		return
+	}
+	defer res.Body.Close()
+	var auth SlackAuthResponse
+	if err := json.NewDecoder(res.Body).Decode(&auth); err != nil {
+		s.recordError(fmt.Errorf("invalid oauth.v2.access response: %v", err))
+		installError(w, http.StatusBadGateway, "Install failed", "Slack sent an invalid response, please try again.")
+		return
+	}
+	if !auth.Ok || auth.AccessToken == "" || auth.Team.Id == "" {
+		s.recordError(fmt.Errorf("oauth.v2.access failed: %s", auth.Error))
+		installError(w, http.StatusBadGateway, "Install failed", fmt.Sprintf("Slack refused the install: %s", auth.Error))
+		return
+	}
+	log.Printf("installed in team %s (%s)", auth.Team.Id, auth.Team.Name)
+	inst := SlackInstance{
+		TeamId:     auth.Team.Id,
+		WebHookUrl: auth.IncomingWebHook.Url,
+		BotToken:   auth.AccessToken,
+		client:     s.newClient(auth.AccessToken),
+	}
+	s.cacheWorkspace(inst)
+	if err := s.database.InsertSlackBot(auth.Team.Id, auth.AccessToken, auth.IncomingWebHook.Url); err != nil {
 		log.Println(err)
-	} else {
-		body, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		fmt.Println(string(body))
-		var auth SlackAuthResponse
-		if err := json.Unmarshal(body, &auth); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		fmt.Println(auth)
-		inst := SlackInstance{
-			TeamId:     auth.Team.Id,
-			WebHookUrl: auth.IncomingWebHook.Url,
-			BotToken:   auth.AccessToken,
-			client:     slack.New(auth.AccessToken),
-		}
-		s.workspaceApis.Store(auth.Team.Id, inst)
-		if err := s.database.InsertSlackBot(auth.Team.Id, auth.AccessToken, auth.IncomingWebHook.Url); err != nil {
-			log.Println(err)
-		}
 	}
 	http.Redirect(w, r, s.authRedirectUrl, http.StatusFound)
 }
@@ -473,11 +689,26 @@ func (s *Slack) EventHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 	case slackevents.CallbackEvent:
-		if !s.VerifyRequest(r.Header, body) {
+		if !s.verifyReceived(r.Header, body, receivedAt(r)) {
 			s.httpError(r, w, http.StatusUnauthorized, "validation failed", fmt.Errorf("[ERROR] Failed validating signed secret"))
 			return
 		}
+		if cb, ok := eventsAPIEvent.Data.(*slackevents.EventsAPICallbackEvent); ok && s.duplicate("event", cb.EventID, r.Header) {
+			return
+		}
 		innerEvent := eventsAPIEvent.InnerEvent
+		if cb, ok := eventsAPIEvent.Data.(*slackevents.EventsAPICallbackEvent); ok && cb.InnerEvent != nil {
+			// follow up processing asynchronously to allow the request to close
+			go func() {
+				results, err := s.processEvent(eventsAPIEvent.TeamID, *cb.InnerEvent)
+				if err != nil {
+					log.Println("event failed:", err)
+				}
+				for _, result := range results {
+					s.queueActionResult(result)
+				}
+			}()
+		}
 		switch ev := innerEvent.Data.(type) {
 		case *slackevents.AppMentionEvent:
 			// follow up processing asynchronously to allow the request to close
@@ -522,6 +753,19 @@ func (s *Slack) DelayedInteractionHandler(w http.ResponseWriter, r *http.Request
 		s.httpError(r, w, http.StatusBadRequest, "invalid body", err)
 		return
 	}
+	view, err := ParseView([]byte(jsonStr))
+	if err != nil {
+		s.httpError(r, w, http.StatusBadRequest, "invalid view", err)
+		return
+	}
+	if s.duplicate("interaction", message.TriggerID, r.Header) {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if message.Type == InteractionTypeViewSubmission {
+		s.respondViewSubmission(r, w, message, view)
+		return
+	}
 
 	// if the request did not require an immediate response,
 	// Then we need to respond within 3000ms with content,
@@ -530,7 +774,7 @@ func (s *Slack) DelayedInteractionHandler(w http.ResponseWriter, r *http.Request
 
 	// follow up processing asynchronously to allow the request to close
 	go func() {
-		if result, err := s.processInteractionCallback(message); err != nil {
+		if result, err := s.processInteractionCallback(message, view); err != nil {
 			log.Println("interaction failed:", err)
 			s.SendErrorResponse(err, Direct, message.Team.ID, message.Channel.Name, message.ResponseURL)
 		} else {
@@ -562,6 +806,10 @@ func (s *Slack) SlashHandler(w http.ResponseWriter, r *http.Request) {
 		s.httpError(r, w, http.StatusInternalServerError, "failed to parse command", err)
 		return
 	}
+	if s.duplicate("slash", sc.TriggerID, r.Header) {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
 
 	// Disable atsu check
 	//if sc.Command != "/atsu" {
@@ -609,8 +857,21 @@ func (s *Slack) ImmediateInteractionHandler(w http.ResponseWriter, r *http.Reque
 		s.httpError(r, w, http.StatusInternalServerError, "parse interaction failure", err)
 		return
 	}
+	view, err := ParseView(payload)
+	if err != nil {
+		s.httpError(r, w, http.StatusBadRequest, "invalid view", err)
+		return
+	}
+	if s.duplicate("interaction", message.TriggerID, r.Header) {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if message.Type == InteractionTypeViewSubmission {
+		s.respondViewSubmission(r, w, message, view)
+		return
+	}
 	// handle immediate responses
-	if result, err := s.processInteractionCallback(message); err != nil {
+	if result, err := s.processInteractionCallback(message, view); err != nil {
 		s.httpError(r, w, http.StatusInternalServerError, "interaction failure", err)
 	} else {
 		if _, err := w.Write(result.ProcessedTemplate); err != nil {
@@ -636,7 +897,9 @@ func (s *Slack) AtsuEventHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	teamId := r.URL.Query().Get("teamId")
-	tpl := r.URL.Query().Get("tpl") // specify template
+	channel := r.URL.Query().Get("channel") // post as the bot instead of to the webhook
+	user := r.URL.Query().Get("user")       // the user id for ephemeral and dm responses
+	tpl := r.URL.Query().Get("tpl")         // specify template
 	pw := r.URL.Query().Get("pw")
 	freeformEnabled := pw == FreeformPassword && tpl == FreeformTemplate
 
@@ -657,6 +920,9 @@ func (s *Slack) AtsuEventHandler(w http.ResponseWriter, r *http.Request) {
 		OnDemand:     od,
 		TeamId:       teamId,
 		ResponseType: WebHook,
+		Channel:      channel,
+		ChannelId:    channel,
+		UserId:       user,
 		TemplateName: tpl,
 		Data: TemplateData{
 			EnvironmentParams: s.EnvParams(),
@@ -665,6 +931,20 @@ func (s *Slack) AtsuEventHandler(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
+	if channel != "" {
+		action.ResponseType = Channel
+	}
+	if response := r.URL.Query().Get("response"); response != "" {
+		if action.ResponseType, err = ParseResponseType(response); err != nil {
+			s.httpError(r, w, http.StatusBadRequest, err.Error(), err)
+			return
+		}
+	}
+	if err := action.validateRecipient(); err != nil {
+		s.httpError(r, w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
 	if _, err := w.Write([]byte(`{"status":"ok"}`)); err != nil {
 		log.Println(err)
 	}
@@ -678,6 +958,7 @@ func (s *Slack) AtsuEventHandler(w http.ResponseWriter, r *http.Request) {
 				result.ProcessedTemplate = body
 			}
 			s.queueActionResult(result)
+			s.recordAlert(teamId, action)
 		}
 	}()
 }
@@ -703,9 +984,15 @@ func (s *Slack) EnvParams() EnvironmentParams {
 	return params
 }
 
+// processAppMentionEvent resolves the mention's text to a template the same way as a slash command,
+// "@atsu describe mount" runs describe_mount.tpl, falling back to the mention template if none matches.
+// The reply goes to the mention's thread, or starts one on the mention.
 func (s *Slack) processAppMentionEvent(teamId, teamDomain string, ev *slackevents.AppMentionEvent) (*ActionResult, error) {
-	// Currently overriding to send any mentions to kafka
 	// TODO:(smt) lookup user/chan/team ids
+	templateName, data := s.mentionTemplate, make(map[string]interface{})
+	if tpl, inargs := util.FindTemplate(s.templates, strings.Fields(util.StripSlackUsers(ev.Text))...); tpl != nil {
+		templateName, data = tpl.Name(), util.ParseArgs(inargs)
+	}
 	action := s.NewAction(ActionInput{
 		Id:              "",
 		TeamId:          teamId,
@@ -713,10 +1000,15 @@ func (s *Slack) processAppMentionEvent(teamId, teamDomain string, ev *slackevent
 		Channel:         ev.Channel,
 		User:            ev.User,
 		InputText:       ev.Text,
-		InteractionData: make(map[string]interface{}),
-		TemplateName:    "_kafka.tpl",
+		InteractionData: data,
+		TemplateName:    templateName,
 	})
 	action.SetResponse(Channel, "", ev.Channel, "")
+	action.ThreadTs = ev.ThreadTimeStamp
+	if action.ThreadTs == "" {
+		action.ThreadTs = ev.TimeStamp
+	}
+	action.SetRecipient(ev.Channel, ev.User)
 	return s.ExecuteAction(action)
 }
 
@@ -726,6 +1018,7 @@ func (s *Slack) processSlashCommand(sc slack.SlashCommand) (*ActionResult, error
 		return nil, fmt.Errorf("failed converting command input: %v", err)
 	}
 	sa.SetResponse(Direct, sc.ResponseURL, sc.ChannelName, sc.TriggerID)
+	sa.SetRecipient(sc.ChannelID, sc.UserID)
 	result, err := s.ExecuteAction(sa)
 	if err != nil {
 		return nil, fmt.Errorf("processing slash command failed: %v", err)
@@ -733,7 +1026,9 @@ func (s *Slack) processSlashCommand(sc slack.SlashCommand) (*ActionResult, error
 	return result, nil
 }
 
-func (s *Slack) processInteractionCallback(message slack.InteractionCallback) (*ActionResult, error) {
+// processInteractionCallback executes the template an interaction chains to, view is the modal
+// the interaction came from, if any
+func (s *Slack) processInteractionCallback(message slack.InteractionCallback, view *View) (*ActionResult, error) {
 	if s.debug {
 		log.Println("Interaction Type:", message.Type)
 	}
@@ -743,6 +1038,14 @@ func (s *Slack) processInteractionCallback(message slack.InteractionCallback) (*
 	case slack.InteractionTypeBlockActions:
 		rt = Direct
 		action = s.ConvertBlockAction(message)
+		if action != nil && view != nil {
+			// inputs elsewhere in the modal are available to the template too
+			for k, v := range view.interactionData() {
+				if _, ok := action.Data.InteractionData[k]; !ok {
+					action.Data.InteractionData[k] = v
+				}
+			}
+		}
 	case slack.InteractionTypeDialogSuggestion:
 		fallthrough
 	case slack.InteractionTypeDialogCancellation:
@@ -751,6 +1054,11 @@ func (s *Slack) processInteractionCallback(message slack.InteractionCallback) (*
 	case slack.InteractionTypeDialogSubmission:
 		rt = None
 		action = s.ConvertInteractionCallback(message)
+	case InteractionTypeViewSubmission:
+		fallthrough
+	case InteractionTypeViewClosed:
+		rt = None
+		action = s.ConvertViewInteraction(message, view)
 	default:
 		log.Println("unknown interaction type:", message.Type)
 	}
@@ -759,25 +1067,15 @@ func (s *Slack) processInteractionCallback(message slack.InteractionCallback) (*
 	}
 	if action != nil {
 		action.SetResponse(rt, message.ResponseURL, message.Channel.Name, message.TriggerID)
+		action.SetRecipient(message.Channel.ID, message.User.ID)
+		if view != nil {
+			action.ViewId, action.ViewHash = view.Id, view.Hash
+		}
 		return s.ExecuteAction(action)
 	}
 	return nil, errors.New("invalid action")
 }
 
-func (s *Slack) queueActionResult(result *ActionResult) {
-	if result != nil {
-		s.resultQueue <- result
-	}
-}
-
-// VerifyRequest https://api.slack.com/docs/verifying-requests-from-slack
-func (s *Slack) VerifyRequest(h http.Header, body []byte) bool {
-	timestamp := h.Get("X-Slack-Request-Timestamp")
-	str := fmt.Sprintf("%s:%s:%s", "v0", timestamp, string(body))
-	hash := util.ComputeSha256HMAC([]byte(str), []byte(s.secretSigningKey))
-	return fmt.Sprintf("v0=%s", hash) == h.Get("X-Slack-Signature")
-}
-
 // validate the interaction, and returns an error if validation fails.
 // if an error is returned the second result is the http status code for response
 func (s *Slack) validateInteraction(header http.Header, method string, body []byte) (error, int) {
@@ -798,25 +1096,24 @@ func (s *Slack) validateInteraction(header http.Header, method string, body []by
 
 // SendToChannel sends the provided options list to the provided slack channel
 func (s *Slack) SendToChannel(team string, channel string, options ...slack.MsgOption) {
+	if _, _, err := s.postMessage(team, channel, options...); err != nil {
+		log.Println("failed sending to channel:", err)
+	}
+}
+
+// postMessage posts to the channel as the bot, returning the channel id and ts of the posted message
+func (s *Slack) postMessage(team string, channel string, options ...slack.MsgOption) (string, string, error) {
 	post := slack.NewPostMessageParameters()
 	post.Username = botUserName
 	post.AsUser = true
 	post.Parse = "full"
 
 	options = append(options, slack.MsgOptionPostMessageParameters(post))
-	i, ok := s.workspaceApis.Load(team)
-	if !ok {
-		log.Printf("api for [%s] not found, aborting sending to channel [%s]\n", team, channel)
-		return
-	}
-	instance, ok := i.(SlackInstance)
-	if !ok {
-		log.Printf("unexpected type %T not *slack.Client\n", i)
-		return
-	}
-	if _, _, err := instance.client.PostMessage(channel, options...); err != nil {
-		log.Println("failed sending to channel:", err)
+	instance, err := s.instance(team, "sending to channel "+channel)
+	if err != nil {
+		return "", "", err
 	}
+	return instance.client.PostMessage(channel, options...)
 }
 
 // SendErrorResponse is for sending a direct response through slack to the user (via response url) or channel
@@ -859,7 +1156,12 @@ type Action struct {
 	ResponseType ResponseType
 	ResponseUrl  string
 	Channel      string
+	ChannelId    string // ephemeral messages need the channel and user ids
+	UserId       string
 	TriggerId    string
+	ThreadTs     string // reply in this thread
+	ViewId       string // the modal the interaction came from
+	ViewHash     string
 	Id           string
 	TeamId       string
 	TemplateName string
@@ -874,6 +1176,12 @@ func (a *Action) SetResponse(rt ResponseType, responseUrl, channel, triggerId st
 	a.TriggerId = triggerId
 }
 
+// SetRecipient sets the ids of the channel and user the action came from, for Ephemeral and DirectMessage responses
+func (a *Action) SetRecipient(channelId, userId string) {
+	a.ChannelId = channelId
+	a.UserId = userId
+}
+
 func (a *Action) String() string {
 	b, err := json.Marshal(a)
 	if err != nil {
@@ -887,8 +1195,21 @@ type ResponseType string
 var None = ResponseType("none")
 var Direct = ResponseType("direct")
 var Dialog = ResponseType("dialog")
+var Modal = ResponseType("modal")
 var Channel = ResponseType("channel")
 var WebHook = ResponseType("webhook")
+var Ephemeral = ResponseType("ephemeral")
+var DirectMessage = ResponseType("dm")
+
+// ParseResponseType returns the named response type
+func ParseResponseType(name string) (ResponseType, error) {
+	for _, rt := range []ResponseType{None, Direct, Dialog, Modal, Channel, WebHook, Ephemeral, DirectMessage} {
+		if string(rt) == name {
+			return rt, nil
+		}
+	}
+	return "", fmt.Errorf("unknown response type: %s", name)
+}
 
 type ActionResult struct {
 	TeamId            string
@@ -896,7 +1217,17 @@ type ActionResult struct {
 	Action            *Action
 	ResponseUrl       string
 	Channel           string
+	ChannelId         string
+	UserId            string
 	TriggerId         string
+	ThreadTs          string
+	Modal             ModalMode
+	ViewId            string
+	ViewHash          string
+	MessageKey        string // identifies the message to remember, or to reply to or update
+	Thread            bool
+	Update            bool
+	ReplaceOriginal   bool
 	ResponseType      ResponseType
 	SendToKafka       bool
 	KafkaMessageType  KafkaMessageType
@@ -950,14 +1281,28 @@ func (s *Slack) KafkaSend(mt KafkaMessageType, data TemplateData) {
 	}
 }
 
-// SendResultResponse evaluates the ActionResult and sends the appropriate response payload back to slack
+// SendResultResponse evaluates the ActionResult and sends the appropriate response payload back to slack,
+// once, responses that should be retried are queued with queueActionResult
 func (s *Slack) SendResultResponse(result *ActionResult) {
+	s.resultEffects(result)
+	s.deliverResult(result)
+}
+
+// resultEffects sends the result to kafka and records feedback, done once however many attempts sending takes
+func (s *Slack) resultEffects(result *ActionResult) {
 	if s.debug {
 		log.Println("ActionResult:", result.String())
 	}
 	if result.SendToKafka {
 		s.KafkaSend(result.KafkaMessageType, result.Data)
 	}
+	if result.KafkaMessageType == Feedback {
+		s.recordFeedback(result)
+	}
+}
+
+// deliverResult sends the result's response to slack, returning why it couldn't be sent
+func (s *Slack) deliverResult(result *ActionResult) error {
 	message := "->"
 	if result.Error != nil {
 		message = fmt.Sprintf("%s Error: %v", message, result.Error)
@@ -972,18 +1317,38 @@ func (s *Slack) SendResultResponse(result *ActionResult) {
 	switch result.ResponseType {
 	case None:
 	case Channel:
-		var msg slack.Message
-		msg, err = ParseMessage(result.ProcessedTemplate)
+		var opts slack.MsgOption
+		var note, sent string
+		opts, note, err = messageOption(result.ProcessedTemplate)
 		if err == nil {
-			var opts slack.MsgOption
-			if msg.Blocks.BlockSet != nil {
-				message = fmt.Sprint(message, " [block set] ")
-				opts = slack.MsgOptionBlocks(msg.Blocks.BlockSet...)
-			} else {
-				message = fmt.Sprint(message, " [not block set] ")
-				opts = slack.MsgOptionText(msg.Text, false)
+			sent, err = s.sendChannelMessage(result, opts)
+			message = fmt.Sprint(message, note, sent)
+		}
+	case Ephemeral:
+		if result.ResponseUrl != "" {
+			// the response url works whether or not the bot is in the channel, chat.postEphemeral doesn't
+			message = fmt.Sprint(message, " [ephemeral response url] ")
+			var body []byte
+			if body, err = ephemeralResponse(result.ProcessedTemplate); err != nil {
+				break
 			}
-			s.SendToChannel(result.TeamId, result.Channel, opts)
+			code, b, err = s.sendResponseURL("response url", result.ResponseUrl, body)
+			break
+		}
+		var opts slack.MsgOption
+		var note string
+		opts, note, err = messageOption(result.ProcessedTemplate)
+		if err == nil {
+			message = fmt.Sprint(message, note, " [ephemeral] ")
+			err = s.sendEphemeral(result, opts)
+		}
+	case DirectMessage:
+		var opts slack.MsgOption
+		var note string
+		opts, note, err = messageOption(result.ProcessedTemplate)
+		if err == nil {
+			message = fmt.Sprint(message, note, " [direct message] ")
+			err = s.sendDirectMessage(result, opts)
 		}
 	case Dialog:
 		var d slack.Dialog
@@ -992,32 +1357,31 @@ func (s *Slack) SendResultResponse(result *ActionResult) {
 			break
 		}
 		message = fmt.Sprint(message, " [open dialog] ")
-		i, ok := s.workspaceApis.Load(result.TeamId)
-		if !ok {
-			err = fmt.Errorf("api for [%s] not found, aborting [open dialog]\n", result.TeamId)
-			break
-		}
-		instance, ok := i.(SlackInstance)
-		if !ok {
-			err = fmt.Errorf("unexpected type %T not *slack.Client\n", i)
+		var instance SlackInstance
+		if instance, err = s.instance(result.TeamId, "open dialog"); err != nil {
 			break
 		}
 		err = instance.client.OpenDialog(result.TriggerId, d)
+	case Modal:
+		message = fmt.Sprintf("%s [%s view] ", message, result.Modal)
+		err = s.sendView(result)
 
 	case Direct:
-		code, b, err = util.SendResponseURL(result.ResponseUrl, result.ProcessedTemplate)
-	case WebHook:
-		i, ok := s.workspaceApis.Load(result.TeamId)
-		if !ok {
-			err = fmt.Errorf("api for [%s] not found, aborting [WebHook response]\n", result.TeamId)
-			break
+		body := result.ProcessedTemplate
+		if result.ReplaceOriginal {
+			message = fmt.Sprint(message, " [replace original] ")
+			body, err = replaceOriginal(body)
+			if err != nil {
+				break
+			}
 		}
-		instance, ok := i.(SlackInstance)
-		if !ok {
-			err = fmt.Errorf("unexpected type %T not *slack.Client\n", i)
+		code, b, err = s.sendResponseURL("response url", result.ResponseUrl, body)
+	case WebHook:
+		var instance SlackInstance
+		if instance, err = s.instance(result.TeamId, "WebHook response"); err != nil {
 			break
 		}
-		code, b, err = util.SendResponseURL(instance.WebHookUrl, result.ProcessedTemplate)
+		code, b, err = s.sendResponseURL("webhook", instance.WebHookUrl, result.ProcessedTemplate)
 	default:
 		err = errors.New("unknown response type")
 	}
@@ -1030,6 +1394,7 @@ func (s *Slack) SendResultResponse(result *ActionResult) {
 	} else {
 		log.Printf("[SUCCESS] %s Status: %d Body: %s\n", message, code, string(b))
 	}
+	return err
 }
 
 // ConvertBlockAction translates a block action into an Action
@@ -1223,6 +1588,10 @@ func (s *Slack) ExecuteAction(action *Action) (*ActionResult, error) {
 		rt = None
 	case meta.Dialog:
 		rt = Dialog
+	case meta.Modal != "":
+		rt = Modal
+	case meta.ResponseType != "":
+		rt = meta.ResponseType
 	default:
 		rt = action.ResponseType
 	}
@@ -1244,7 +1613,17 @@ func (s *Slack) ExecuteAction(action *Action) (*ActionResult, error) {
 		ResponseType:      rt,
 		ResponseUrl:       action.ResponseUrl,
 		Channel:           action.Channel,
+		ChannelId:         action.ChannelId,
+		UserId:            action.UserId,
 		TriggerId:         action.TriggerId,
+		ThreadTs:          action.ThreadTs,
+		Modal:             meta.Modal,
+		ViewId:            action.ViewId,
+		ViewHash:          action.ViewHash,
+		MessageKey:        meta.messageKey(action.Data),
+		Thread:            meta.Thread,
+		Update:            meta.Update,
+		ReplaceOriginal:   meta.ReplaceOriginal,
 		ProcessedTemplate: buf.Bytes(),
 		Data:              action.Data,
 	}, nil
@@ -1260,6 +1639,9 @@ type TemplateData struct {
 	InputText       string
 	Timestamp       int64
 	InteractionData map[string]interface{}
+	Event           map[string]interface{} `json:",omitempty"` // the payload of the event that ran the template
+	MessageKey      string                 `json:",omitempty"` // the key of the message the event is about, e.g. atsu_id=<id>
+	Home            *HomeData              `json:",omitempty"` // set for the home template
 }
 
 // FeedbackMessage generates a FeedbackMessage object from the TemplateData object
@@ -2,23 +2,34 @@ package bot
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"text/template"
+	"time"
 
 	"github.com/atsu/chatops/db"
 
 	"github.com/stretchr/testify/mock"
 
 	"github.com/atsu/chatops/interfaces/mocks"
+	"github.com/atsu/chatops/relay"
 	"github.com/atsu/chatops/util"
+	"github.com/atsu/goat/health"
 	gutil "github.com/atsu/goat/util"
+	"github.com/gorilla/mux"
 	"github.com/nlopes/slack"
+	"github.com/nlopes/slack/slackevents"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -437,10 +448,23 @@ func createSlackTestConfig() SlackConfig {
 }
 
 type TestDb struct {
+	bots     map[string]db.SlackBot
+	messages map[string][2]string
+	deleted  map[string]bool
+	outbound *testOutbound
+}
+
+// testOutbound is the outbound queue, responses are queued from the handlers' goroutines
+type testOutbound struct {
+	sync.Mutex
+	seq         int64
+	queued      map[int64]*db.OutboundMessage
+	deadLetters []db.DeadLetter
 }
 
 func createTestDb() *TestDb {
-	return &TestDb{}
+	return &TestDb{bots: make(map[string]db.SlackBot), messages: make(map[string][2]string), deleted: make(map[string]bool),
+		outbound: &testOutbound{queued: make(map[int64]*db.OutboundMessage)}}
 }
 
 func (t TestDb) Init() error {
@@ -448,13 +472,284 @@ func (t TestDb) Init() error {
 }
 
 func (t TestDb) InsertSlackBot(teamId, botToken, webHookUrl string) error {
+	t.bots[teamId] = db.SlackBot{TeamId: teamId, BotToken: botToken, WebHookUrl: webHookUrl}
 	return nil
 }
 
 func (t TestDb) GetSlackBot(teamId string) (string, string, error) {
-	return "", "", nil
+	if bt, ok := t.bots[teamId]; ok {
+		return bt.BotToken, bt.WebHookUrl, nil
+	}
+	return "", "", sql.ErrNoRows
+}
+
+func (t TestDb) GetSlackMessageKey(teamId, channel, ts string) (string, error) {
+	for k, m := range t.messages {
+		if strings.HasPrefix(k, teamId+"/") && m == [2]string{channel, ts} {
+			return strings.TrimPrefix(k, teamId+"/"), nil
+		}
+	}
+	return "", sql.ErrNoRows
 }
 
 func (t TestDb) GetAllSlackBots() ([]db.SlackBot, error) {
-	return nil, nil
+	bots := make([]db.SlackBot, 0, len(t.bots))
+	for _, bt := range t.bots {
+		bots = append(bots, bt)
+	}
+	return bots, nil
+}
+
+func (t TestDb) DeleteSlackBot(teamId string) error {
+	t.deleted[teamId] = true
+	delete(t.bots, teamId)
+	for k := range t.messages {
+		if strings.HasPrefix(k, teamId+"/") {
+			delete(t.messages, k)
+		}
+	}
+	t.outbound.Lock()
+	defer t.outbound.Unlock()
+	for id, m := range t.outbound.queued {
+		if m.TeamId == teamId {
+			delete(t.outbound.queued, id)
+		}
+	}
+	return nil
+}
+
+func (t TestDb) InsertSlackMessage(teamId, key, channel, ts string) error {
+	t.messages[teamId+"/"+key] = [2]string{channel, ts}
+	return nil
+}
+
+func (t TestDb) GetSlackMessage(teamId, key string) (string, string, error) {
+	if m, ok := t.messages[teamId+"/"+key]; ok {
+		return m[0], m[1], nil
+	}
+	return "", "", sql.ErrNoRows
+}
+
+func (t TestDb) EnqueueOutbound(teamId string, payload []byte, now int64) (int64, error) {
+	t.outbound.Lock()
+	defer t.outbound.Unlock()
+	t.outbound.seq++
+	t.outbound.queued[t.outbound.seq] = &db.OutboundMessage{Id: t.outbound.seq, TeamId: teamId, Payload: payload, NextAttempt: now, Created: now}
+	return t.outbound.seq, nil
+}
+
+func (t TestDb) DueOutbound(now int64, limit int) ([]db.OutboundMessage, error) {
+	t.outbound.Lock()
+	defer t.outbound.Unlock()
+	var due []db.OutboundMessage
+	for _, m := range t.outbound.queued {
+		if m.NextAttempt <= now {
+			due = append(due, *m)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].Id < due[j].Id })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return due, nil
+}
+
+func (t TestDb) RetryOutbound(id int64, attempts int, nextAttempt int64, lastError string) error {
+	t.outbound.Lock()
+	defer t.outbound.Unlock()
+	if m, ok := t.outbound.queued[id]; ok {
+		m.Attempts, m.NextAttempt, m.LastError = attempts, nextAttempt, lastError
+	}
+	return nil
+}
+
+func (t TestDb) DeleteOutbound(id int64) error {
+	t.outbound.Lock()
+	defer t.outbound.Unlock()
+	delete(t.outbound.queued, id)
+	return nil
+}
+
+func (t TestDb) DeadLetterOutbound(id int64, attempts int, lastError string, now int64) error {
+	t.outbound.Lock()
+	defer t.outbound.Unlock()
+	if m, ok := t.outbound.queued[id]; ok {
+		m.Attempts, m.LastError = attempts, lastError
+		t.outbound.deadLetters = append([]db.DeadLetter{{OutboundMessage: *m, Failed: now}}, t.outbound.deadLetters...)
+		delete(t.outbound.queued, id)
+	}
+	return nil
+}
+
+func (t TestDb) GetDeadLetters(limit int) ([]db.DeadLetter, error) {
+	t.outbound.Lock()
+	defer t.outbound.Unlock()
+	if len(t.outbound.deadLetters) < limit {
+		limit = len(t.outbound.deadLetters)
+	}
+	return append([]db.DeadLetter(nil), t.outbound.deadLetters[:limit]...), nil
+}
+
+// queued returns the queued responses, oldest first
+func (t TestDb) queued() []db.OutboundMessage {
+	msgs, _ := t.DueOutbound(math.MaxInt64, math.MaxInt32)
+	return msgs
+}
+
+// waitQueued waits for a response to be queued, returning the result queued
+func waitQueued(t *testing.T, tdb *TestDb) *ActionResult {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if msgs := tdb.queued(); len(msgs) > 0 {
+			var q queuedResult
+			assert.NoError(t, json.Unmarshal(msgs[0].Payload, &q))
+			return q.Result
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("no result queued")
+	return nil
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestSlack_SetHTTPClient(t *testing.T) {
+	var urls []string
+	s := NewSlack(createSlackTestConfig(), nil, createTestDb())
+	s.SetHTTPClient(&http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		urls = append(urls, r.URL.String())
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("ok")), Header: http.Header{}}, nil
+	})})
+	s.workspaceApis.Store("team", SlackInstance{TeamId: "team", WebHookUrl: "https://hooks.slack.com/webhook"})
+
+	s.SendResultResponse(&ActionResult{ResponseType: Direct, ResponseUrl: "https://hooks.slack.com/response", ProcessedTemplate: []byte("{}")})
+	s.SendResultResponse(&ActionResult{ResponseType: WebHook, TeamId: "team", ProcessedTemplate: []byte("{}")})
+	assert.Equal(t, []string{"https://hooks.slack.com/response", "https://hooks.slack.com/webhook"}, urls)
+}
+
+func TestSlack_StartReplay(t *testing.T) {
+	cfg := createSlackTestConfig()
+	cfg.TemplateDir = "testdata"
+	cfg.Replay = true
+	s := NewSlack(cfg, nil, createTestDb())
+	r := relay.NewRelay("", 0, ".+", relay.Handler, nil)
+	if err := r.Init(); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, s.Start(mux.NewRouter(), r))
+	// responses stay queued and nothing is sent to slack
+	assert.Nil(t, s.processorDone)
+	s.queueActionResult(&ActionResult{TeamId: "T1", ResponseType: Direct, ResponseUrl: "https://hooks.slack.com/response"})
+	s.Stop()
+	assert.Len(t, s.database.(*TestDb).queued(), 1)
+}
+
+func TestSlack_StartPassthroughEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relayqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r := relay.NewRelay("", 0, ".+", relay.PassThrough, nil)
+	if err := r.SetQueue(dir, 10); err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	s := NewSlack(createSlackTestConfig(), nil, createTestDb())
+	assert.NoError(t, s.Start(router, r))
+	defer s.Stop()
+	post := func(body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, EventEndpoint, strings.NewReader(body)))
+		return rr
+	}
+
+	// the url verification challenge can't be answered by a queue
+	rr := post(`{"type":"url_verification","token":"t","challenge":"c1"}`)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Equal(t, 0, r.Status().QueueDepth)
+
+	rr = post(`{"type":"event_callback","team_id":"T1","event_id":"Ev1","event":{"type":"member_joined_channel"}}`)
+	assert.Equal(t, `{"status":"queued"}`, rr.Body.String())
+	assert.Equal(t, 1, r.Status().QueueDepth)
+}
+
+func TestSlack_StatusHealth(t *testing.T) {
+	cfg := createSlackTestConfig()
+	cfg.TemplateDir = "testdata"
+	s := NewSlack(cfg, nil, createTestDb())
+	if err := s.LoadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, health.Green, s.Status().Health)
+
+	s.recordError(errors.New("post failed"))
+	status := s.Status()
+	assert.Equal(t, health.Yellow, status.Health)
+	assert.Equal(t, "1 errors in the last hour, last: post failed", status.Message)
+
+	s.templateDirectory = "does-not-exist"
+	assert.Error(t, s.LoadTemplates())
+	assert.Equal(t, health.Red, s.Status().Health)
+}
+
+func TestSlack_SignRequest(t *testing.T) {
+	s := NewSlack(createSlackTestConfig(), nil, createTestDb())
+	body := []byte("token=REDACTED&text=hi")
+	header := http.Header{}
+	header.Set("X-Slack-Signature", "REDACTED")
+	assert.False(t, s.VerifyRequest(header, body))
+
+	s.SignRequest(header, body)
+	assert.NotEmpty(t, header.Get("X-Slack-Request-Timestamp"))
+	assert.True(t, s.VerifyRequest(header, body))
+	assert.False(t, s.VerifyRequest(header, []byte("token=REDACTED&text=changed")))
+}
+
+func TestSlack_ProcessAppMentionEvent(t *testing.T) {
+	tests := []struct {
+		name         string
+		mention      string
+		text         string
+		threadTs     string
+		template     string
+		responseType ResponseType
+		data         map[string]interface{}
+		expectedTs   string
+	}{
+		{"command", "", "<@U0BOT> describe mount -mount /data", "", "describe_mount.tpl", Channel, map[string]interface{}{"mount": "/data"}, "100.1"},
+		{"command in a thread", "", "<@U0BOT> describe mount", "99.9", "describe_mount.tpl", Channel, map[string]interface{}{}, "99.9"},
+		{"no command", "", "<@U0BOT> thanks!", "", DefaultMentionTemplate, None, map[string]interface{}{}, "100.1"},
+		{"configured fallback", "help.tpl", "<@U0BOT> what can you do", "", "help.tpl", Channel, map[string]interface{}{}, "100.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCom := new(mocks.ChatOpsCom)
+			mockCom.On("EnvironmentParams").Return(map[string]string{})
+			cfg := createSlackTestConfig()
+			cfg.MentionTemplate = tt.mention
+			s := NewSlack(cfg, mockCom, createTestDb())
+			s.templates = template.Must(template.New("describe_mount.tpl").Parse(`{"text":"{{ .InteractionData.mount }}"}`))
+			template.Must(s.templates.New("help.tpl").Parse(`{"text":"help"}`))
+			template.Must(s.templates.New(DefaultMentionTemplate).Parse(`{}`))
+			s.templateMetadata = map[string]*TemplateMetadata{DefaultMentionTemplate: {IsTerminating: true, SendToKafka: true}}
+
+			result, err := s.processAppMentionEvent("T1", "atsu", &slackevents.AppMentionEvent{
+				User: "U1", Channel: "C1", Text: tt.text, TimeStamp: "100.1", ThreadTimeStamp: tt.threadTs,
+			})
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tt.template, result.Action.TemplateName)
+			assert.Equal(t, tt.responseType, result.ResponseType)
+			assert.Equal(t, tt.data, result.Data.InteractionData)
+			assert.Equal(t, "C1", result.Channel)
+			assert.Equal(t, "U1", result.UserId)
+			assert.Equal(t, tt.expectedTs, result.ThreadTs)
+		})
+	}
 }
@@ -87,6 +87,13 @@ type TemplateMetadata struct {
 	KafkaMessageType string
 	IsTerminating    bool
 	Dialog           bool
+	Modal            ModalMode    // open, push or update, the template is a modal view sent with the views api
+	MessageKey       string       // the InteractionData field, e.g. atsu_id, the posted message is remembered by
+	Thread           bool         // reply in the thread of the message remembered for the key
+	Update           bool         // update the message remembered for the key in place
+	ReplaceOriginal  bool         // response url responses replace the message the interaction came from
+	ResponseType     ResponseType // overrides how the result is sent, e.g. ephemeral or dm
+	Events           []string     // event types, e.g. reaction_added or message.im, the template runs for
 	Extra            map[string]interface{}
 }
 
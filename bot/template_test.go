@@ -34,6 +34,7 @@ func TestParseTemplateMetadataFile(t *testing.T) {
 	assert.Equal(t, t.Name(), templateMeta.Name)
 	assert.Equal(t, "test description", templateMeta.Description)
 	assert.True(t, templateMeta.Dialog)
+	assert.Equal(t, ModalUpdate, templateMeta.Modal)
 	assert.True(t, templateMeta.SendToKafka)
 	assert.True(t, templateMeta.IsTerminating)
 	assert.Equal(t, "value", templateMeta.Extra["key"])
@@ -3,6 +3,7 @@
 name: TestParseTemplateMetadataFile
 description: test description
 dialog: true
+modal: update
 sendtokafka: true
 isterminating: true
 extra:
@@ -0,0 +1,123 @@
+package bot
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atsu/chatops/relay"
+)
+
+// DefaultMaxRequestAge is how far a request's timestamp may be from now, slack recommends five minutes
+const DefaultMaxRequestAge = 5 * time.Minute
+
+// Request verification failures, also the reasons counted in SlackStatus.RejectedReasons
+var (
+	ErrMissingSignature = errors.New("missing signature")
+	ErrMissingTimestamp = errors.New("missing timestamp")
+	ErrInvalidTimestamp = errors.New("invalid timestamp")
+	ErrStaleTimestamp   = errors.New("stale timestamp")
+	ErrBadSignature     = errors.New("signature mismatch")
+)
+
+const signatureVersion = "v0"
+
+// signingKeys returns the current key followed by the non empty previous keys
+func signingKeys(current string, previous []string) [][]byte {
+	keys := [][]byte{[]byte(current)}
+	for _, k := range previous {
+		if k = strings.TrimSpace(k); k != "" && k != current {
+			keys = append(keys, []byte(k))
+		}
+	}
+	return keys
+}
+
+// VerifyRequest https://api.slack.com/docs/verifying-requests-from-slack
+// The timestamp must be within the maximum request age, so a captured request can't be replayed later,
+// and the signature must match the current or a previous signing key. Rejections are counted by reason.
+func (s *Slack) VerifyRequest(h http.Header, body []byte) bool {
+	return s.verifyReceived(h, body, time.Now())
+}
+
+// verifyReceived verifies a request as of when it was received, see receivedAt
+func (s *Slack) verifyReceived(h http.Header, body []byte, received time.Time) bool {
+	err := s.verifyRequest(h, body, received)
+	if err != nil {
+		s.recordRejection(err)
+		if s.debug {
+			log.Println("slack request verification failed:", err)
+		}
+	}
+	return err == nil
+}
+
+func (s *Slack) verifyRequest(h http.Header, body []byte, now time.Time) error {
+	signature := h.Get("X-Slack-Signature")
+	if signature == "" {
+		return ErrMissingSignature
+	}
+	timestamp := h.Get("X-Slack-Request-Timestamp")
+	if timestamp == "" {
+		return ErrMissingTimestamp
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidTimestamp
+	}
+	age := now.Sub(time.Unix(ts, 0))
+	if age > s.maxRequestAge || -age > s.maxRequestAge {
+		return ErrStaleTimestamp
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, signatureVersion+"="))
+	if err != nil || !strings.HasPrefix(signature, signatureVersion+"=") {
+		return ErrBadSignature
+	}
+	for _, key := range s.signingKeys {
+		if hmac.Equal(got, sign(key, timestamp, body)) {
+			return nil
+		}
+	}
+	return ErrBadSignature
+}
+
+// receivedAt is when the request reached chatops, for an event the passthrough queued while no handler was connected
+// that is when it was queued, so it isn't refused as stale when it is replayed
+func receivedAt(r *http.Request) time.Time {
+	if at, ok := relay.QueuedAt(r); ok {
+		return at
+	}
+	return time.Now()
+}
+
+func (s *Slack) recordRejection(err error) {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+	if s.rejections == nil {
+		s.rejections = make(map[string]int64)
+	}
+	s.rejections[err.Error()]++
+	s.lastRejection = fmt.Sprintf("%s at %s", err, time.Now().UTC().Format(time.RFC3339))
+}
+
+// SignRequest sets a current timestamp and the signature slack would send for the body, so a recorded
+// request, which has its signature redacted, passes verification when it is replayed
+func (s *Slack) SignRequest(h http.Header, body []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	h.Set("X-Slack-Request-Timestamp", timestamp)
+	h.Set("X-Slack-Signature", signatureVersion+"="+hex.EncodeToString(sign(s.signingKeys[0], timestamp, body)))
+}
+
+func sign(key []byte, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signatureVersion + ":" + timestamp + ":"))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,156 @@
+package bot
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/atsu/chatops/interfaces/mocks"
+	"github.com/atsu/chatops/relay"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlack_VerifyRequest(t *testing.T) {
+	now := time.Now()
+	body := []byte("token=t&team_id=T1&command=%2Fatsu&text=help")
+	signed := func(key string, ts time.Time) http.Header {
+		timestamp := strconv.FormatInt(ts.Unix(), 10)
+		h := http.Header{}
+		h.Set("X-Slack-Request-Timestamp", timestamp)
+		h.Set("X-Slack-Signature", "v0="+hex.EncodeToString(sign([]byte(key), timestamp, body)))
+		return h
+	}
+	tests := []struct {
+		name     string
+		header   http.Header
+		expected error
+	}{
+		{"current key", signed("current", now), nil},
+		{"previous key", signed("previous", now), nil},
+		{"unknown key", signed("unknown", now), ErrBadSignature},
+		{"within window", signed("current", now.Add(-4*time.Minute)), nil},
+		{"stale", signed("current", now.Add(-6*time.Minute)), ErrStaleTimestamp},
+		{"future", signed("current", now.Add(6*time.Minute)), ErrStaleTimestamp},
+		{"missing signature", http.Header{"X-Slack-Request-Timestamp": {strconv.FormatInt(now.Unix(), 10)}}, ErrMissingSignature},
+		{"missing timestamp", http.Header{"X-Slack-Signature": {"v0=00"}}, ErrMissingTimestamp},
+		{"invalid timestamp", http.Header{"X-Slack-Signature": {"v0=00"}, "X-Slack-Request-Timestamp": {"yesterday"}}, ErrInvalidTimestamp},
+		{"not hex", http.Header{"X-Slack-Signature": {"v0=zz"}, "X-Slack-Request-Timestamp": {strconv.FormatInt(now.Unix(), 10)}}, ErrBadSignature},
+		{"wrong version", func() http.Header {
+			h := signed("current", now)
+			h.Set("X-Slack-Signature", "v1="+h.Get("X-Slack-Signature")[3:])
+			return h
+		}(), ErrBadSignature},
+	}
+	cfg := createSlackTestConfig()
+	cfg.SecretSigningKey = "current"
+	cfg.PrevSigningKeys = []string{"", "previous"}
+	s := NewSlack(cfg, nil, createTestDb())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, s.verifyRequest(tt.header, body, now))
+		})
+	}
+
+	assert.True(t, s.VerifyRequest(signed("current", now), body))
+	assert.False(t, s.VerifyRequest(signed("current", now.Add(-time.Hour)), body))
+	assert.False(t, s.VerifyRequest(signed("current", now.Add(-time.Hour)), body))
+	assert.False(t, s.VerifyRequest(signed("unknown", now), body))
+	status := s.Status()
+	assert.Equal(t, int64(3), status.Rejected)
+	assert.Equal(t, map[string]int64{"stale timestamp": 2, "signature mismatch": 1}, status.RejectedReasons)
+	assert.Contains(t, status.LastRejection, "signature mismatch")
+}
+
+func TestSlack_MaxRequestAge(t *testing.T) {
+	now := time.Now()
+	body := []byte("{}")
+	cfg := createSlackTestConfig()
+	cfg.MaxRequestAge = time.Minute
+	s := NewSlack(cfg, nil, createTestDb())
+	h := http.Header{}
+	s.SignRequest(h, body)
+	assert.NoError(t, s.verifyRequest(h, body, now))
+	assert.Equal(t, ErrStaleTimestamp, s.verifyRequest(h, body, now.Add(2*time.Minute)))
+}
+
+// events the passthrough queued while no handler was connected are verified as of when they were queued
+func TestSlack_ReplayQueuedEvent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relayqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, err := tls.LoadX509KeyPair("../relay/testdata/test.crt", "../relay/testdata/test.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{cert}}
+	src := relay.NewRelay("", 5050, ".+", relay.PassThrough, conf)
+	dst := relay.NewRelay("", 5050, ".+", relay.Handler, conf)
+	if err := src.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SetQueue(dir, 10); err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	defer dst.Close()
+	src.SetCheckInterval(time.Millisecond * 100)
+	dst.SetCheckInterval(time.Millisecond * 100)
+	if err := src.Listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	mockCom := new(mocks.ChatOpsCom)
+	mockCom.On("EnvironmentParams").Return(map[string]string{})
+	cfg := createSlackTestConfig()
+	cfg.MaxRequestAge = time.Second
+	tdb := createTestDb()
+	s := NewSlack(cfg, mockCom, tdb)
+	s.templates = template.Must(template.New("joined.tpl").Parse(`{"text":"welcome <@{{ .Event.user }}>"}`))
+	s.templateMetadata = map[string]*TemplateMetadata{"joined.tpl": {Events: []string{"member_joined_channel"}}}
+	dst.HandleFunc(EventEndpoint, s.EventHandler)
+
+	queue := func(id, key string) {
+		body := `{"type":"event_callback","team_id":"T1","event_id":"` + id + `","event":{"type":"member_joined_channel","user":"U1","channel":"C1"}}`
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req := httptest.NewRequest(http.MethodPost, EventEndpoint, strings.NewReader(body))
+		req.Header.Set("X-Slack-Request-Timestamp", timestamp)
+		req.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(sign([]byte(key), timestamp, []byte(body))))
+		rr := httptest.NewRecorder()
+		src.BufferedRelayHandler(rr, req)
+		assert.Equal(t, `{"status":"queued"}`, rr.Body.String())
+	}
+	queue("Ev1", cfg.SecretSigningKey)
+	queue("Ev2", "forged")
+
+	// the handler connects after the events' timestamps are older than the max request age
+	time.Sleep(2100 * time.Millisecond)
+	dst.Connect()
+	result := waitQueued(t, tdb)
+	assert.Equal(t, "joined.tpl", result.Action.TemplateName)
+	for i := 0; i < 300 && src.Status().QueueDepth > 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	status := src.Status()
+	assert.Equal(t, 0, status.QueueDepth)
+	assert.Equal(t, int64(1), status.QueueReplayed)
+	// the forged event is refused, and kept rather than dropped
+	assert.Equal(t, int64(1), status.QueueRejected)
+	rejected, _ := filepath.Glob(filepath.Join(dir, "rejected", "*.req"))
+	assert.Len(t, rejected, 1)
+	assert.Equal(t, map[string]int64{ErrBadSignature.Error(): 1}, s.Status().RejectedReasons)
+}
@@ -0,0 +1,258 @@
+package bot
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/nlopes/slack"
+)
+
+// Modal interaction types (https://api.slack.com/reference/interaction-payloads/views), the slack library predates them
+const (
+	InteractionTypeViewSubmission = slack.InteractionType("view_submission")
+	InteractionTypeViewClosed     = slack.InteractionType("view_closed")
+)
+
+// ModalMode is how a modal template's view is sent to slack, set with the `modal` template metadata
+type ModalMode string
+
+const (
+	// ModalOpen opens a new modal with views.open
+	ModalOpen = ModalMode("open")
+	// ModalPush pushes the view onto the open modal's stack with views.push
+	ModalPush = ModalMode("push")
+	// ModalUpdate replaces the view the interaction came from with views.update
+	ModalUpdate = ModalMode("update")
+)
+
+// View is the modal view sent with view_submission, view_closed and block_actions interactions from a modal
+type View struct {
+	Id              string    `json:"id"`
+	Hash            string    `json:"hash"`
+	CallbackId      string    `json:"callback_id"`
+	PrivateMetadata string    `json:"private_metadata"`
+	State           ViewState `json:"state"`
+}
+
+// ViewState holds the values of a view's input blocks, by block id then action id
+type ViewState struct {
+	Values map[string]map[string]ViewStateValue `json:"values"`
+}
+
+// ViewStateValue is the value of a single input element, only the field matching its type is set
+type ViewStateValue struct {
+	Type                  string                    `json:"type"`
+	Value                 string                    `json:"value"`
+	SelectedOption        *slack.OptionBlockObject  `json:"selected_option"`
+	SelectedOptions       []slack.OptionBlockObject `json:"selected_options"`
+	SelectedDate          string                    `json:"selected_date"`
+	SelectedUser          string                    `json:"selected_user"`
+	SelectedUsers         []string                  `json:"selected_users"`
+	SelectedChannel       string                    `json:"selected_channel"`
+	SelectedChannels      []string                  `json:"selected_channels"`
+	SelectedConversation  string                    `json:"selected_conversation"`
+	SelectedConversations []string                  `json:"selected_conversations"`
+}
+
+// Simple returns the value as a template would want it, a string for single value elements
+// and a []string for multi select elements
+func (v ViewStateValue) Simple() interface{} {
+	switch {
+	case v.SelectedOption != nil:
+		return v.SelectedOption.Value
+	case v.SelectedOptions != nil:
+		values := make([]string, 0, len(v.SelectedOptions))
+		for _, o := range v.SelectedOptions {
+			values = append(values, o.Value)
+		}
+		return values
+	case v.SelectedUsers != nil:
+		return v.SelectedUsers
+	case v.SelectedChannels != nil:
+		return v.SelectedChannels
+	case v.SelectedConversations != nil:
+		return v.SelectedConversations
+	case v.SelectedDate != "":
+		return v.SelectedDate
+	case v.SelectedUser != "":
+		return v.SelectedUser
+	case v.SelectedChannel != "":
+		return v.SelectedChannel
+	case v.SelectedConversation != "":
+		return v.SelectedConversation
+	}
+	return v.Value
+}
+
+// interactionData flattens the view into template InteractionData, each input is keyed by its action id,
+// "values" holds every input by block id then action id for templates with clashing action ids
+func (v *View) interactionData() map[string]interface{} {
+	data := map[string]interface{}{
+		"view_id":          v.Id,
+		"private_metadata": v.PrivateMetadata,
+	}
+	values := make(map[string]interface{}, len(v.State.Values))
+	for blockId, actions := range v.State.Values {
+		block := make(map[string]interface{}, len(actions))
+		for actionId, value := range actions {
+			block[actionId] = value.Simple()
+			data[actionId] = block[actionId]
+		}
+		values[blockId] = block
+	}
+	data["values"] = values
+	return data
+}
+
+// ParseView returns the view an interaction payload came from, nil if it is not from a modal
+func ParseView(b []byte) (*View, error) {
+	var payload struct {
+		View *View `json:"view"`
+	}
+	if err := json.Unmarshal(b, &payload); err != nil {
+		return nil, fmt.Errorf("failed unmarshaling %T: %s", payload.View, err)
+	}
+	return payload.View, nil
+}
+
+// ConvertViewInteraction translates a view submission or closure into an Action, the view's callback id
+// chains to the next template in the same "id|template" form as dialogs
+func (s *Slack) ConvertViewInteraction(message slack.InteractionCallback, view *View) *Action {
+	if view == nil {
+		return nil
+	}
+	var id, templateName string
+	spl := strings.Split(view.CallbackId, "|")
+	if len(spl) > 0 {
+		id = spl[0]
+	}
+	if len(spl) > 1 {
+		templateName = fmt.Sprintf("%s.tpl", spl[1])
+	}
+	return s.NewAction(ActionInput{
+		Id:              id,
+		TeamId:          message.Team.ID,
+		Team:            message.Team.Domain,
+		Channel:         message.Channel.Name,
+		User:            message.User.Name,
+		InputText:       "",
+		InteractionData: view.interactionData(),
+		TemplateName:    templateName,
+	})
+}
+
+// respondViewSubmission runs the template the submitted view chains to while slack waits for the response.
+// If the template renders a response_action (errors, update, push or clear) it is the response,
+// otherwise the submission is acknowledged and the modal closes.
+func (s *Slack) respondViewSubmission(r *http.Request, w http.ResponseWriter, message slack.InteractionCallback, view *View) {
+	result, err := s.processInteractionCallback(message, view)
+	if err != nil {
+		s.httpError(r, w, http.StatusInternalServerError, "view submission failure", err)
+		return
+	}
+	if b := viewResponse(result.ProcessedTemplate); b != nil {
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(b); err != nil {
+			log.Println(err)
+		}
+		result.ResponseType = None // the response went back with the submission
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	s.queueActionResult(result)
+}
+
+// viewResponse returns the processed template if it is a view submission response, nil otherwise
+func viewResponse(b []byte) []byte {
+	var resp struct {
+		ResponseAction string `json:"response_action"`
+	}
+	if err := json.Unmarshal(b, &resp); err != nil || resp.ResponseAction == "" {
+		return nil
+	}
+	return b
+}
+
+type viewRequest struct {
+	TriggerId string          `json:"trigger_id,omitempty"`
+	UserId    string          `json:"user_id,omitempty"`
+	ViewId    string          `json:"view_id,omitempty"`
+	Hash      string          `json:"hash,omitempty"`
+	View      json.RawMessage `json:"view"`
+}
+
+// sendView opens, pushes or updates the modal with the processed template
+func (s *Slack) sendView(result *ActionResult) error {
+	if !json.Valid(result.ProcessedTemplate) {
+		return errors.New("view is not valid json")
+	}
+	req := viewRequest{View: result.ProcessedTemplate}
+	var method string
+	switch result.Modal {
+	case ModalOpen:
+		method, req.TriggerId = "views.open", result.TriggerId
+	case ModalPush:
+		method, req.TriggerId = "views.push", result.TriggerId
+	case ModalUpdate:
+		if result.ViewId == "" {
+			return errors.New("no view to update, the interaction did not come from a modal")
+		}
+		method, req.ViewId, req.Hash = "views.update", result.ViewId, result.ViewHash
+	default:
+		return fmt.Errorf("unknown modal mode: %q", result.Modal)
+	}
+	instance, err := s.instance(result.TeamId, method)
+	if err != nil {
+		return err
+	}
+	return s.callViews(instance.BotToken, method, req)
+}
+
+// callViews calls a views api method, which takes a json body the slack library can't send
+func (s *Slack) callViews(token, method string, req viewRequest) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	hr, err := http.NewRequest(http.MethodPost, SlackApiUrl+method, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	hr.Header.Set("Content-Type", "application/json; charset=utf-8")
+	hr.Header.Set("Authorization", "Bearer "+token)
+	resp, err := s.outbound().Do(hr)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return newStatusError(method, resp, body)
+	}
+	var sr struct {
+		Ok               bool   `json:"ok"`
+		Error            string `json:"error"`
+		ResponseMetadata struct {
+			Messages []string `json:"messages"`
+		} `json:"response_metadata"`
+	}
+	if err := json.Unmarshal(body, &sr); err != nil {
+		return fmt.Errorf("%s failed, invalid response: %v", method, err)
+	}
+	if !sr.Ok {
+		if len(sr.ResponseMetadata.Messages) > 0 {
+			return fmt.Errorf("%s failed: %s (%s)", method, sr.Error, strings.Join(sr.ResponseMetadata.Messages, "; "))
+		}
+		return fmt.Errorf("%s failed: %s", method, sr.Error)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package bot
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/atsu/chatops/interfaces/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+const viewSubmission = `{
+  "type": "view_submission",
+  "team": {"id": "T1", "domain": "atsu"},
+  "user": {"id": "U1", "name": "someone"},
+  "trigger_id": "1.2.view",
+  "view": {
+    "id": "V1",
+    "hash": "h1",
+    "callback_id": "001|%s",
+    "private_metadata": "job-42",
+    "state": {
+      "values": {
+        "subject": {"subject": {"type": "plain_text_input", "value": "%s"}},
+        "severity": {"level": {"type": "static_select", "selected_option": {"value": "high"}}},
+        "owners": {"users": {"type": "multi_users_select", "selected_users": ["U1", "U2"]}}
+      }
+    }
+  }
+}`
+
+func TestParseView(t *testing.T) {
+	view, err := ParseView([]byte(strings.Replace(viewSubmission, "%s", "next", -1)))
+	assert.NoError(t, err)
+	if assert.NotNil(t, view) {
+		assert.Equal(t, "V1", view.Id)
+		assert.Equal(t, "h1", view.Hash)
+		assert.Equal(t, "001|next", view.CallbackId)
+		assert.Equal(t, map[string]interface{}{
+			"view_id":          "V1",
+			"private_metadata": "job-42",
+			"subject":          "next",
+			"level":            "high",
+			"users":            []string{"U1", "U2"},
+			"values": map[string]interface{}{
+				"subject":  map[string]interface{}{"subject": "next"},
+				"severity": map[string]interface{}{"level": "high"},
+				"owners":   map[string]interface{}{"users": []string{"U1", "U2"}},
+			},
+		}, view.interactionData())
+	}
+
+	view, err = ParseView([]byte(`{"type":"block_actions"}`))
+	assert.NoError(t, err)
+	assert.Nil(t, view)
+
+	_, err = ParseView([]byte("not json"))
+	assert.Error(t, err)
+}
+
+func TestSlack_ViewSubmission(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		subject  string
+		expected string
+	}{
+		{"validation errors", "_validate", "", `{"response_action":"errors","errors":{"subject":"a subject is required"}}`},
+		{"accepted", "_validate", "disk full", ""},
+		{"update view", "_next", "disk full", `{"response_action":"update","view":{"type":"modal","private_metadata":"job-42"}}`},
+		{"not a view response", "_message", "disk full", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCom := new(mocks.ChatOpsCom)
+			mockCom.On("EnvironmentParams").Return(map[string]string{})
+			tdb := createTestDb()
+			s := NewSlack(createSlackTestConfig(), mockCom, tdb)
+			s.templates = template.Must(template.New("_validate.tpl").Parse(
+				`{{ if .InteractionData.subject }}{}{{ else }}{"response_action":"errors","errors":{"subject":"a subject is required"}}{{ end }}`))
+			template.Must(s.templates.New("_next.tpl").Parse(
+				`{"response_action":"update","view":{"type":"modal","private_metadata":"{{ .InteractionData.private_metadata }}"}}`))
+			template.Must(s.templates.New("_message.tpl").Parse(`{"text":"{{ .InteractionData.level }}"}`))
+			s.templateMetadata = map[string]*TemplateMetadata{"_validate.tpl": {SendToKafka: true}}
+
+			payload := strings.Replace(strings.Replace(viewSubmission, "%s", tt.template, 1), "%s", tt.subject, 1)
+			body := "payload=" + url.QueryEscape(payload)
+			req := httptest.NewRequest(http.MethodPost, InterctEndpoint, strings.NewReader(body))
+			s.SignRequest(req.Header, []byte(body))
+			rr := httptest.NewRecorder()
+			s.DelayedInteractionHandler(rr, req)
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, tt.expected, rr.Body.String())
+
+			// the submission template's result is still queued, e.g. to send to kafka, but with nothing to send to slack
+			if queued := tdb.queued(); assert.Len(t, queued, 1, "no result queued") {
+				var q queuedResult
+				assert.NoError(t, json.Unmarshal(queued[0].Payload, &q))
+				assert.Equal(t, None, q.Result.ResponseType)
+				assert.Equal(t, "V1", q.Result.ViewId)
+				assert.Equal(t, tt.template == "_validate", q.Result.SendToKafka)
+			}
+		})
+	}
+}
+
+func TestSlack_SendView(t *testing.T) {
+	type call struct {
+		url  string
+		auth string
+		body map[string]interface{}
+	}
+	tests := []struct {
+		name     string
+		result   ActionResult
+		response string
+		expected *call
+		err      string
+	}{
+		{"open", ActionResult{Modal: ModalOpen, TriggerId: "1.2.a"}, `{"ok":true}`,
+			&call{SlackApiUrl + "views.open", "Bearer xoxb", map[string]interface{}{"trigger_id": "1.2.a", "view": map[string]interface{}{"type": "modal"}}}, ""},
+		{"push", ActionResult{Modal: ModalPush, TriggerId: "1.2.b"}, `{"ok":true}`,
+			&call{SlackApiUrl + "views.push", "Bearer xoxb", map[string]interface{}{"trigger_id": "1.2.b", "view": map[string]interface{}{"type": "modal"}}}, ""},
+		{"update", ActionResult{Modal: ModalUpdate, TriggerId: "1.2.c", ViewId: "V1", ViewHash: "h1"}, `{"ok":true}`,
+			&call{SlackApiUrl + "views.update", "Bearer xoxb", map[string]interface{}{"view_id": "V1", "hash": "h1", "view": map[string]interface{}{"type": "modal"}}}, ""},
+		{"update without view", ActionResult{Modal: ModalUpdate, TriggerId: "1.2.d"}, `{"ok":true}`,
+			nil, "no view to update, the interaction did not come from a modal"},
+		{"unknown mode", ActionResult{Modal: ModalMode("true")}, `{"ok":true}`,
+			nil, `unknown modal mode: "true"`},
+		{"slack error", ActionResult{Modal: ModalOpen, TriggerId: "1.2.e"}, `{"ok":false,"error":"invalid_arguments","response_metadata":{"messages":["[ERROR] missing required field: title"]}}`,
+			&call{SlackApiUrl + "views.open", "Bearer xoxb", map[string]interface{}{"trigger_id": "1.2.e", "view": map[string]interface{}{"type": "modal"}}},
+			"views.open failed: invalid_arguments ([ERROR] missing required field: title)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *call
+			s := NewSlack(createSlackTestConfig(), nil, createTestDb())
+			s.SetHTTPClient(&http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				got = &call{url: r.URL.String(), auth: r.Header.Get("Authorization")}
+				b, _ := ioutil.ReadAll(r.Body)
+				assert.NoError(t, json.Unmarshal(b, &got.body))
+				return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(tt.response)), Header: http.Header{}}, nil
+			})})
+			s.workspaceApis.Store("team", SlackInstance{TeamId: "team", BotToken: "xoxb"})
+
+			result := tt.result
+			result.TeamId, result.ResponseType, result.ProcessedTemplate = "team", Modal, []byte(`{"type":"modal"}`)
+			err := s.sendView(&result)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
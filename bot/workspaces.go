@@ -0,0 +1,286 @@
+package bot
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultTokenSweepInterval is how often every workspace's bot token is checked with auth.test
+const DefaultTokenSweepInterval = time.Hour
+
+// DefaultWorkspaceTTL is how long a workspace's client is used before it is loaded from the database again
+const DefaultWorkspaceTTL = time.Hour
+
+// a workspace that failed to load is retried after a backoff doubling from the min to the max
+const (
+	workspaceRetryMin = 10 * time.Second
+	workspaceRetryMax = 5 * time.Minute
+)
+
+// WorkspaceStatus states
+const (
+	WorkspaceActive   = "active"   // loaded and in use
+	WorkspaceFailing  = "failing"  // failed to load, retried after RetryAt
+	WorkspaceInactive = "inactive" // its token no longer works, used again once reinstalled
+)
+
+// WorkspaceStatus is the state of a workspace's client, times are unix seconds
+type WorkspaceStatus struct {
+	TeamId    string `json:"teamId"`
+	State     string `json:"state"`
+	Loaded    int64  `json:"loaded,omitempty"`
+	Expires   int64  `json:"expires,omitempty"`
+	Failures  int    `json:"failures,omitempty"` // consecutive failed loads
+	LastError string `json:"lastError,omitempty"`
+	RetryAt   int64  `json:"retryAt,omitempty"`
+}
+
+// authErrors are the auth.test errors of a token that will never work again, anything else may be transient
+var authErrors = map[string]bool{
+	"invalid_auth":     true,
+	"not_authed":       true,
+	"account_inactive": true,
+	"token_revoked":    true,
+	"token_expired":    true,
+	"team_disabled":    true,
+}
+
+// removeWorkspace forgets a workspace that removed the app, its token is deleted from the database
+// along with the messages remembered for it
+func (s *Slack) removeWorkspace(team, reason string) {
+	s.workspaceApis.Delete(team)
+	s.home.remove(team)
+	if err := s.database.DeleteSlackBot(team); err != nil {
+		log.Printf("failed to delete workspace %s: %v", team, err)
+		s.recordError(err)
+	}
+	s.wsLock.Lock()
+	delete(s.workspaces, team)
+	s.wsLock.Unlock()
+	log.Printf("removed workspace %s: %s", team, reason)
+}
+
+// flagWorkspace stops using a workspace whose token no longer works, it is kept in the database
+// so a restart checks it again, and reported in SlackStatus.InactiveWorkspaces until it is reinstalled
+func (s *Slack) flagWorkspace(team, reason string) {
+	s.workspaceApis.Delete(team)
+	s.wsLock.Lock()
+	s.workspaces[team] = &WorkspaceStatus{TeamId: team, State: WorkspaceInactive, LastError: reason}
+	s.wsLock.Unlock()
+	log.Printf("flagged workspace %s inactive: %s", team, reason)
+}
+
+// cacheWorkspace uses the instance for the workspace until it expires, clearing any earlier failure
+func (s *Slack) cacheWorkspace(inst SlackInstance) {
+	now := time.Now()
+	s.workspaceApis.Store(inst.TeamId, inst)
+	s.wsLock.Lock()
+	s.workspaces[inst.TeamId] = &WorkspaceStatus{
+		TeamId:  inst.TeamId,
+		State:   WorkspaceActive,
+		Loaded:  now.Unix(),
+		Expires: now.Add(s.workspaceTTL).Unix(),
+	}
+	s.wsLock.Unlock()
+}
+
+// workspaceFailed records a failed load, the next load is attempted after a backoff
+func (s *Slack) workspaceFailed(team string, err error, now time.Time) {
+	s.wsLock.Lock()
+	defer s.wsLock.Unlock()
+	ws, ok := s.workspaces[team]
+	if !ok || ws.State == WorkspaceInactive {
+		ws = &WorkspaceStatus{TeamId: team}
+		s.workspaces[team] = ws
+	}
+	ws.State = WorkspaceFailing
+	ws.Failures++
+	ws.LastError = err.Error()
+	backoff := workspaceRetryMin << uint(ws.Failures-1)
+	if backoff > workspaceRetryMax || backoff <= 0 {
+		backoff = workspaceRetryMax
+	}
+	ws.RetryAt = now.Add(backoff).Unix()
+}
+
+// workspaceExpired reports whether the cached client should be loaded again, once it expired or,
+// if reloading it failed, after the backoff. A client cached without a status, such as one set up by hand, never expires.
+func (s *Slack) workspaceExpired(team string, now time.Time) bool {
+	s.wsLock.Lock()
+	defer s.wsLock.Unlock()
+	ws, ok := s.workspaces[team]
+	switch {
+	case !ok:
+		return false
+	case ws.State == WorkspaceActive:
+		return now.Unix() >= ws.Expires
+	case ws.State == WorkspaceFailing:
+		return now.Unix() >= ws.RetryAt
+	}
+	return false
+}
+
+// workspaceUnavailable returns why the workspace can't be loaded now, nil if it can
+func (s *Slack) workspaceUnavailable(team string, now time.Time) error {
+	s.wsLock.Lock()
+	defer s.wsLock.Unlock()
+	ws, ok := s.workspaces[team]
+	switch {
+	case !ok:
+		return nil
+	case ws.State == WorkspaceInactive:
+		return fmt.Errorf("workspace inactive: %s", ws.LastError)
+	case ws.State == WorkspaceFailing && now.Unix() < ws.RetryAt:
+		return fmt.Errorf("workspace unavailable for %s after %d failures, last: %s",
+			time.Unix(ws.RetryAt, 0).Sub(now).Round(time.Second), ws.Failures, ws.LastError)
+	}
+	return nil
+}
+
+// instance returns the workspace's slack instance, loading it on first use or once it expired,
+// what names the call that needs it for the error.
+// If reloading an expired instance fails the expired one is used until a reload succeeds.
+func (s *Slack) instance(team, what string) (SlackInstance, error) {
+	i, cached := s.workspaceApis.Load(team)
+	if !cached || s.workspaceExpired(team, time.Now()) {
+		inst, err := s.loadWorkspace(team)
+		if err == nil {
+			return inst, nil
+		}
+		if !cached {
+			return SlackInstance{}, fmt.Errorf("api for [%s] not available, aborting [%s]: %v", team, what, err)
+		}
+		log.Printf("reloading workspace %s failed, using the expired client: %v", team, err)
+	}
+	instance, ok := i.(SlackInstance)
+	if !ok {
+		return SlackInstance{}, fmt.Errorf("unexpected type %T not *slack.Client", i)
+	}
+	return instance, nil
+}
+
+// loadWorkspace loads the workspace's token from the database and checks it with auth.test, one load of a workspace
+// at a time so concurrent first uses of it load it once, while other workspaces load alongside.
+// A failed load is retried after a backoff, a token that no longer works flags the workspace inactive.
+func (s *Slack) loadWorkspace(team string) (SlackInstance, error) {
+	l, _ := s.loadLocks.LoadOrStore(team, &sync.Mutex{})
+	lock := l.(*sync.Mutex)
+	lock.Lock()
+	defer lock.Unlock()
+	now := time.Now()
+	if i, ok := s.workspaceApis.Load(team); ok && !s.workspaceExpired(team, now) {
+		if inst, ok := i.(SlackInstance); ok {
+			return inst, nil // loaded while waiting
+		}
+	}
+	if err := s.workspaceUnavailable(team, now); err != nil {
+		return SlackInstance{}, err
+	}
+	token, webHookUrl, err := s.database.GetSlackBot(team)
+	if err == sql.ErrNoRows || (err == nil && token == "") {
+		return SlackInstance{}, errors.New("workspace not installed")
+	}
+	if err != nil {
+		s.workspaceFailed(team, err, now)
+		return SlackInstance{}, err
+	}
+	inst := SlackInstance{TeamId: team, BotToken: token, WebHookUrl: webHookUrl, client: s.newClient(token)}
+	if _, err := inst.client.AuthTest(); err != nil {
+		if authErrors[err.Error()] {
+			s.flagWorkspace(team, fmt.Sprintf("auth.test failed: %v", err))
+		} else {
+			s.workspaceFailed(team, err, now)
+		}
+		return SlackInstance{}, err
+	}
+	s.cacheWorkspace(inst)
+	log.Printf("loaded workspace %s", team)
+	return inst, nil
+}
+
+// workspaceStatuses returns the workspaces loaded or that failed to load, by team id
+func (s *Slack) workspaceStatuses() []WorkspaceStatus {
+	s.wsLock.Lock()
+	defer s.wsLock.Unlock()
+	statuses := make([]WorkspaceStatus, 0, len(s.workspaces))
+	for _, ws := range s.workspaces {
+		statuses = append(statuses, *ws)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].TeamId < statuses[j].TeamId })
+	return statuses
+}
+
+// workspaceEvent removes the workspace for app_uninstalled, and for tokens_revoked if the bot token was revoked,
+// user tokens aren't kept so revoking only those changes nothing
+func (s *Slack) workspaceEvent(team, evType string, event map[string]interface{}) {
+	switch evType {
+	case "app_uninstalled":
+		s.removeWorkspace(team, "app uninstalled")
+	case "tokens_revoked":
+		tokens, _ := event["tokens"].(map[string]interface{})
+		if bots, _ := tokens["bot"].([]interface{}); len(bots) > 0 {
+			s.removeWorkspace(team, "bot token revoked")
+		}
+	}
+}
+
+// sweepTokens checks every workspace's token with auth.test and flags those rejected as no longer authorized.
+// Workspaces in the database that haven't been used since the start are loaded, which checks their token,
+// unless they are already inactive or backing off after a failed load.
+func (s *Slack) sweepTokens() {
+	checked := make(map[string]bool)
+	s.workspaceApis.Range(func(key, value interface{}) bool {
+		team, _ := key.(string)
+		instance, ok := value.(SlackInstance)
+		if !ok || instance.client == nil {
+			return true
+		}
+		checked[team] = true
+		if _, err := instance.client.AuthTest(); err != nil {
+			if authErrors[err.Error()] {
+				s.flagWorkspace(team, fmt.Sprintf("auth.test failed: %v", err))
+			} else {
+				log.Printf("auth.test for workspace %s failed: %v", team, err)
+			}
+		}
+		return true
+	})
+	bots, err := s.database.GetAllSlackBots()
+	if err != nil {
+		log.Println("failed to read the workspaces to sweep:", err)
+		s.recordError(err)
+		return
+	}
+	for _, bot := range bots {
+		if checked[bot.TeamId] || s.workspaceUnavailable(bot.TeamId, time.Now()) != nil {
+			continue
+		}
+		if _, err := s.loadWorkspace(bot.TeamId); err != nil {
+			log.Printf("auth.test for workspace %s failed: %v", bot.TeamId, err)
+		}
+	}
+}
+
+// startTokenSweep sweeps the tokens every interval until the bot is stopped, a negative interval disables it
+func (s *Slack) startTokenSweep(interval time.Duration) {
+	if interval < 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.doneCh:
+				return
+			case <-ticker.C:
+				s.sweepTokens()
+			}
+		}
+	}()
+}
@@ -0,0 +1,121 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// envelopePrefix marks an encrypted value, "enc:v1:<key id>:<base64 nonce and ciphertext>"
+const envelopePrefix = "enc:v1:"
+
+var (
+	ErrNoKey      = errors.New("database has encrypted tokens but no key is set")
+	ErrUnknownKey = errors.New("database has tokens encrypted with an unknown key")
+)
+
+// ParseKey decodes a base64 AES key, which must be 16, 24 or 32 bytes
+func ParseKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key, not base64: %v", err)
+	}
+	if _, err := aes.NewCipher(key); err != nil {
+		return nil, fmt.Errorf("invalid key: %v", err)
+	}
+	return key, nil
+}
+
+// sealer encrypts with the current key and decrypts with the current or a previous key
+type sealer struct {
+	current string // id of the current key
+	aeads   map[string]cipher.AEAD
+}
+
+func newSealer(key []byte, previous [][]byte) (*sealer, error) {
+	s := &sealer{aeads: make(map[string]cipher.AEAD)}
+	for i, k := range append([][]byte{key}, previous...) {
+		block, err := aes.NewCipher(k)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		id := keyId(k)
+		if i == 0 {
+			s.current = id
+		}
+		s.aeads[id] = aead
+	}
+	return s, nil
+}
+
+// keyId identifies the key an envelope was sealed with without revealing it
+func keyId(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+func encrypted(v string) bool {
+	return strings.HasPrefix(v, envelopePrefix)
+}
+
+// envelopeKey returns the id of the key the envelope was sealed with
+func envelopeKey(v string) string {
+	id := strings.TrimPrefix(v, envelopePrefix)
+	if i := strings.Index(id, ":"); i >= 0 {
+		return id[:i]
+	}
+	return ""
+}
+
+// seal encrypts the value with the current key, an empty value stays empty
+func (s *sealer) seal(v string) (string, error) {
+	if s == nil || v == "" {
+		return v, nil
+	}
+	aead := s.aeads[s.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(v), nil)
+	return envelopePrefix + s.current + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts an envelope, a value that isn't one is returned as is
+func (s *sealer) open(v string) (string, error) {
+	if !encrypted(v) {
+		return v, nil
+	}
+	if s == nil {
+		return "", ErrNoKey
+	}
+	id := envelopeKey(v)
+	aead, ok := s.aeads[id]
+	if !ok {
+		return "", ErrUnknownKey
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(v, envelopePrefix+id+":"))
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("invalid encrypted value")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt: %v", err)
+	}
+	return string(plain), nil
+}
+
+// stale reports whether the value should be sealed again, it is plaintext or sealed with a previous key
+func (s *sealer) stale(v string) bool {
+	return s != nil && v != "" && (!encrypted(v) || envelopeKey(v) != s.current)
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestParseKey(t *testing.T) {
+	key, err := ParseKey(" " + base64.StdEncoding.EncodeToString(testKey(1)) + "\n")
+	assert.NoError(t, err)
+	assert.Equal(t, testKey(1), key)
+	_, err = ParseKey("not base64!")
+	assert.Error(t, err)
+	_, err = ParseKey(base64.StdEncoding.EncodeToString([]byte("short")))
+	assert.Error(t, err)
+}
+
+func TestSealer(t *testing.T) {
+	old, err := newSealer(testKey(1), nil)
+	assert.NoError(t, err)
+	current, err := newSealer(testKey(2), [][]byte{testKey(1)})
+	assert.NoError(t, err)
+
+	sealed, err := old.seal("xoxb-1")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(sealed, envelopePrefix))
+	assert.NotContains(t, sealed, "xoxb-1")
+	again, err := old.seal("xoxb-1")
+	assert.NoError(t, err)
+	assert.NotEqual(t, sealed, again, "nonces must differ")
+
+	for _, s := range []*sealer{old, current} {
+		plain, err := s.open(sealed)
+		assert.NoError(t, err)
+		assert.Equal(t, "xoxb-1", plain)
+	}
+	assert.False(t, old.stale(sealed))
+	assert.True(t, current.stale(sealed))
+	assert.True(t, current.stale("xoxb-plain"))
+	assert.False(t, current.stale(""))
+
+	// plaintext and empty values pass through
+	plain, err := current.open("xoxb-plain")
+	assert.NoError(t, err)
+	assert.Equal(t, "xoxb-plain", plain)
+	empty, err := current.seal("")
+	assert.NoError(t, err)
+	assert.Equal(t, "", empty)
+
+	newer, err := current.seal("xoxb-2")
+	assert.NoError(t, err)
+	_, err = old.open(newer)
+	assert.Equal(t, ErrUnknownKey, err)
+	var none *sealer
+	_, err = none.open(newer)
+	assert.Equal(t, ErrNoKey, err)
+
+	_, err = current.open(newer[:len(newer)-4] + "AAAA")
+	assert.Error(t, err)
+}
@@ -2,12 +2,16 @@ package db
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 const (
-	TableInitQuery = "CREATE TABLE IF NOT EXISTS tokens (teamId TEXT PRIMARY KEY, botToken TEXT, webHookUrl TEXT)"
+	TableInitQuery         = "CREATE TABLE IF NOT EXISTS tokens (teamId TEXT PRIMARY KEY, botToken TEXT, webHookUrl TEXT)"
+	MessagesTableInitQuery = "CREATE TABLE IF NOT EXISTS messages (teamId TEXT, key TEXT, channel TEXT, ts TEXT, PRIMARY KEY (teamId, key))"
+	MessagesTsIndexQuery   = "CREATE INDEX IF NOT EXISTS messages_ts ON messages (teamId, channel, ts)"
 )
 
 type Database interface {
@@ -15,11 +19,22 @@ type Database interface {
 	InsertSlackBot(teamId, botToken, webHookUrl string) error
 	GetSlackBot(teamId string) (string, string, error)
 	GetAllSlackBots() ([]SlackBot, error)
+	DeleteSlackBot(teamId string) error
+	InsertSlackMessage(teamId, key, channel, ts string) error
+	GetSlackMessage(teamId, key string) (string, string, error)
+	GetSlackMessageKey(teamId, channel, ts string) (string, error)
+	EnqueueOutbound(teamId string, payload []byte, now int64) (int64, error)
+	DueOutbound(now int64, limit int) ([]OutboundMessage, error)
+	RetryOutbound(id int64, attempts int, nextAttempt int64, lastError string) error
+	DeleteOutbound(id int64) error
+	DeadLetterOutbound(id int64, attempts int, lastError string, now int64) error
+	GetDeadLetters(limit int) ([]DeadLetter, error)
 }
 
 type SqliteDb struct {
-	db   *sql.DB
-	file string
+	db     *sql.DB
+	file   string
+	sealer *sealer // encrypts bot tokens and webhook urls, nil stores them in plaintext
 }
 
 func NewSqliteDB(file string) *SqliteDb {
@@ -28,23 +43,105 @@ func NewSqliteDB(file string) *SqliteDb {
 	}
 }
 
+// SetKeys encrypts the bot tokens and webhook urls with the key, rows encrypted with a previous key
+// or stored in plaintext are encrypted with the key by Init. Must be called before Init.
+func (sdb *SqliteDb) SetKeys(key []byte, previous [][]byte) error {
+	if key == nil {
+		if len(previous) > 0 {
+			return errors.New("previous database keys need a current key")
+		}
+		sdb.sealer = nil
+		return nil
+	}
+	sealer, err := newSealer(key, previous)
+	if err != nil {
+		return err
+	}
+	sdb.sealer = sealer
+	return nil
+}
+
+// Init creates the tables and encrypts the tokens stored in plaintext or with a previous key,
+// it fails if there are encrypted tokens it has no key for
 func (sdb *SqliteDb) Init() error {
 	if db, err := sql.Open("sqlite3", sdb.file); err != nil {
 		return err
 	} else {
-		statement, err := db.Prepare(TableInitQuery)
+		for _, q := range []string{TableInitQuery, MessagesTableInitQuery, MessagesTsIndexQuery, OutboundTableInitQuery, DeadLettersTableInitQuery} {
+			statement, err := db.Prepare(q)
+			if err != nil {
+				return err
+			}
+			if _, err := statement.Exec(); err != nil {
+				return err
+			}
+		}
+		sdb.db = db
+	}
+	return sdb.rekey()
+}
+
+// rekey seals every token and payload not sealed with the current key
+func (sdb *SqliteDb) rekey() error {
+	for _, table := range []string{"outbound", "deadletters"} {
+		if err := sdb.rekeyPayloads(table); err != nil {
+			return err
+		}
+	}
+	rows, err := sdb.db.Query("SELECT teamId, botToken, webHookUrl FROM tokens")
+	if err != nil {
+		return err
+	}
+	var stale []SlackBot
+	for rows.Next() {
+		bt := SlackBot{}
+		if err := rows.Scan(&bt.TeamId, &bt.BotToken, &bt.WebHookUrl); err != nil {
+			rows.Close()
+			return err
+		}
+		if sdb.sealer.stale(bt.BotToken) || sdb.sealer.stale(bt.WebHookUrl) {
+			stale = append(stale, bt)
+		} else if _, err := sdb.open(bt); err != nil {
+			rows.Close()
+			return err
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, bt := range stale {
+		plain, err := sdb.open(bt)
 		if err != nil {
 			return err
 		}
-		if _, err := statement.Exec(); err != nil {
+		if err := sdb.InsertSlackBot(plain.TeamId, plain.BotToken, plain.WebHookUrl); err != nil {
 			return err
 		}
-		sdb.db = db
 	}
 	return nil
 }
 
+// open decrypts the bot's token and webhook url
+func (sdb *SqliteDb) open(bt SlackBot) (SlackBot, error) {
+	var err error
+	if bt.BotToken, err = sdb.sealer.open(bt.BotToken); err != nil {
+		return bt, fmt.Errorf("team %s: %v", bt.TeamId, err)
+	}
+	if bt.WebHookUrl, err = sdb.sealer.open(bt.WebHookUrl); err != nil {
+		return bt, fmt.Errorf("team %s: %v", bt.TeamId, err)
+	}
+	return bt, nil
+}
+
 func (sdb *SqliteDb) InsertSlackBot(teamId, botToken, webHookUrl string) error {
+	botToken, err := sdb.sealer.seal(botToken)
+	if err != nil {
+		return err
+	}
+	if webHookUrl, err = sdb.sealer.seal(webHookUrl); err != nil {
+		return err
+	}
 	if query, err := sdb.db.Prepare("REPLACE INTO tokens (teamId , botToken, webHookUrl) VALUES (?, ?, ?)"); err != nil {
 		return err
 	} else {
@@ -57,9 +154,15 @@ func (sdb *SqliteDb) InsertSlackBot(teamId, botToken, webHookUrl string) error {
 
 func (sdb *SqliteDb) GetSlackBot(teamId string) (string, string, error) {
 	row := sdb.db.QueryRow("SELECT botToken, webHookUrl FROM tokens WHERE teamId = :teamId", sql.Named("teamId", teamId))
-	botToken, webHookUrl := "", ""
-	err := row.Scan(&botToken, &webHookUrl)
-	return botToken, webHookUrl, err
+	bt := SlackBot{TeamId: teamId}
+	if err := row.Scan(&bt.BotToken, &bt.WebHookUrl); err != nil {
+		return "", "", err
+	}
+	bt, err := sdb.open(bt)
+	if err != nil {
+		return "", "", err
+	}
+	return bt.BotToken, bt.WebHookUrl, nil
 }
 
 type SlackBot struct {
@@ -70,16 +173,59 @@ type SlackBot struct {
 
 func (sdb *SqliteDb) GetAllSlackBots() ([]SlackBot, error) {
 	bots := make([]SlackBot, 0)
-	rows, err := sdb.db.Query("SELECT * FROM tokens")
+	rows, err := sdb.db.Query("SELECT teamId, botToken, webHookUrl FROM tokens")
 	if err != nil {
 		return bots, err
 	}
+	defer rows.Close()
 	for rows.Next() {
 		bt := SlackBot{}
 		if err = rows.Scan(&bt.TeamId, &bt.BotToken, &bt.WebHookUrl); err != nil {
 			return bots, err
 		}
+		if bt, err = sdb.open(bt); err != nil {
+			return bots, err
+		}
 		bots = append(bots, bt)
 	}
 	return bots, err
 }
+
+// DeleteSlackBot forgets the workspace, its token, the messages remembered for it and the responses waiting to be sent to it
+func (sdb *SqliteDb) DeleteSlackBot(teamId string) error {
+	for _, q := range []string{"DELETE FROM tokens WHERE teamId = ?", "DELETE FROM messages WHERE teamId = ?", "DELETE FROM outbound WHERE teamId = ?"} {
+		if _, err := sdb.db.Exec(q, teamId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InsertSlackMessage remembers the channel and ts of the message posted for the key
+func (sdb *SqliteDb) InsertSlackMessage(teamId, key, channel, ts string) error {
+	if query, err := sdb.db.Prepare("REPLACE INTO messages (teamId, key, channel, ts) VALUES (?, ?, ?, ?)"); err != nil {
+		return err
+	} else {
+		if _, err := query.Exec(teamId, key, channel, ts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetSlackMessage returns the channel and ts of the message posted for the key, sql.ErrNoRows if there is none
+func (sdb *SqliteDb) GetSlackMessage(teamId, key string) (string, string, error) {
+	row := sdb.db.QueryRow("SELECT channel, ts FROM messages WHERE teamId = :teamId AND key = :key", sql.Named("teamId", teamId), sql.Named("key", key))
+	channel, ts := "", ""
+	err := row.Scan(&channel, &ts)
+	return channel, ts, err
+}
+
+// GetSlackMessageKey returns the key the message posted at the channel and ts is remembered by, sql.ErrNoRows if it isn't
+func (sdb *SqliteDb) GetSlackMessageKey(teamId, channel, ts string) (string, error) {
+	row := sdb.db.QueryRow("SELECT key FROM messages WHERE teamId = :teamId AND channel = :channel AND ts = :ts",
+		sql.Named("teamId", teamId), sql.Named("channel", channel), sql.Named("ts", ts))
+	key := ""
+	err := row.Scan(&key)
+	return key, err
+}
@@ -1,8 +1,14 @@
 package db
 
 import (
+	"database/sql"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestSqliteDB(t *testing.T) {
@@ -36,3 +42,129 @@ func TestSqliteDB(t *testing.T) {
 	//	}
 	//}
 }
+
+func TestSqliteDB_Messages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatops-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db := NewSqliteDB(filepath.Join(dir, "chatops.db"))
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = db.GetSlackMessage("T1", "atsu_id=a1")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	assert.NoError(t, db.InsertSlackMessage("T1", "atsu_id=a1", "C1", "100.1"))
+	assert.NoError(t, db.InsertSlackMessage("T2", "atsu_id=a1", "C2", "200.1"))
+	assert.NoError(t, db.InsertSlackMessage("T1", "atsu_id=a1", "C1", "100.2"))
+	channel, ts, err := db.GetSlackMessage("T1", "atsu_id=a1")
+	assert.NoError(t, err)
+	assert.Equal(t, "C1", channel)
+	assert.Equal(t, "100.2", ts)
+	channel, ts, err = db.GetSlackMessage("T2", "atsu_id=a1")
+	assert.NoError(t, err)
+	assert.Equal(t, "C2", channel)
+	assert.Equal(t, "200.1", ts)
+
+	key, err := db.GetSlackMessageKey("T1", "C1", "100.2")
+	assert.NoError(t, err)
+	assert.Equal(t, "atsu_id=a1", key)
+	// the replaced message and other teams' messages aren't found
+	_, err = db.GetSlackMessageKey("T1", "C1", "100.1")
+	assert.Equal(t, sql.ErrNoRows, err)
+	_, err = db.GetSlackMessageKey("T1", "C2", "200.1")
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+func TestSqliteDB_DeleteSlackBot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatops-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db := NewSqliteDB(filepath.Join(dir, "chatops.db"))
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, db.InsertSlackBot("T1", "xoxb-1", "https://hooks.slack.com/1"))
+	assert.NoError(t, db.InsertSlackBot("T2", "xoxb-2", "https://hooks.slack.com/2"))
+	assert.NoError(t, db.InsertSlackMessage("T1", "atsu_id=a1", "C1", "100.1"))
+	assert.NoError(t, db.InsertSlackMessage("T2", "atsu_id=a1", "C2", "200.1"))
+
+	assert.NoError(t, db.DeleteSlackBot("T1"))
+	assert.NoError(t, db.DeleteSlackBot("T3"))
+	bots, err := db.GetAllSlackBots()
+	assert.NoError(t, err)
+	assert.Equal(t, []SlackBot{{TeamId: "T2", BotToken: "xoxb-2", WebHookUrl: "https://hooks.slack.com/2"}}, bots)
+	_, _, err = db.GetSlackBot("T1")
+	assert.Equal(t, sql.ErrNoRows, err)
+	_, _, err = db.GetSlackMessage("T1", "atsu_id=a1")
+	assert.Equal(t, sql.ErrNoRows, err)
+	_, _, err = db.GetSlackMessage("T2", "atsu_id=a1")
+	assert.NoError(t, err)
+}
+
+func TestSqliteDB_Encryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatops-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "chatops.db")
+	open := func(key []byte, previous ...[]byte) (*SqliteDb, error) {
+		db := NewSqliteDB(file)
+		if err := db.SetKeys(key, previous); err != nil {
+			return nil, err
+		}
+		return db, db.Init()
+	}
+	raw := func(db *SqliteDb) (string, string) {
+		botToken, webHookUrl := "", ""
+		assert.NoError(t, db.db.QueryRow("SELECT botToken, webHookUrl FROM tokens WHERE teamId = 'T1'").Scan(&botToken, &webHookUrl))
+		return botToken, webHookUrl
+	}
+	expected := []SlackBot{{TeamId: "T1", BotToken: "xoxb-1", WebHookUrl: "https://hooks.slack.com/1"}}
+
+	// a plaintext database is encrypted once a key is set
+	db, err := open(nil)
+	assert.NoError(t, err)
+	assert.NoError(t, db.InsertSlackBot("T1", "xoxb-1", "https://hooks.slack.com/1"))
+	botToken, _ := raw(db)
+	assert.Equal(t, "xoxb-1", botToken)
+
+	db, err = open(testKey(1))
+	assert.NoError(t, err)
+	botToken, webHookUrl := raw(db)
+	assert.Equal(t, keyId(testKey(1)), envelopeKey(botToken))
+	assert.Equal(t, keyId(testKey(1)), envelopeKey(webHookUrl))
+	bots, err := db.GetAllSlackBots()
+	assert.NoError(t, err)
+	assert.Equal(t, expected, bots)
+
+	// rotating re-encrypts with the new key
+	db, err = open(testKey(2), testKey(1))
+	assert.NoError(t, err)
+	botToken, _ = raw(db)
+	assert.Equal(t, keyId(testKey(2)), envelopeKey(botToken))
+	token, url, err := db.GetSlackBot("T1")
+	assert.NoError(t, err)
+	assert.Equal(t, "xoxb-1", token)
+	assert.Equal(t, "https://hooks.slack.com/1", url)
+
+	// encrypted rows need the key
+	_, err = open(nil)
+	assert.Error(t, err)
+	_, err = open(testKey(1))
+	assert.Error(t, err)
+	_, err = open(nil, testKey(2))
+	assert.Error(t, err)
+	db, err = open(testKey(2))
+	assert.NoError(t, err)
+	bots, err = db.GetAllSlackBots()
+	assert.NoError(t, err)
+	assert.Equal(t, expected, bots)
+}
@@ -0,0 +1,156 @@
+package db
+
+import (
+	"fmt"
+)
+
+const (
+	OutboundTableInitQuery    = "CREATE TABLE IF NOT EXISTS outbound (id INTEGER PRIMARY KEY AUTOINCREMENT, teamId TEXT, payload TEXT, attempts INTEGER, nextAttempt INTEGER, lastError TEXT, created INTEGER)"
+	DeadLettersTableInitQuery = "CREATE TABLE IF NOT EXISTS deadletters (id INTEGER PRIMARY KEY, teamId TEXT, payload TEXT, attempts INTEGER, lastError TEXT, created INTEGER, failed INTEGER)"
+)
+
+// OutboundMessage is a response waiting to be sent to slack, times are unix seconds
+type OutboundMessage struct {
+	Id          int64
+	TeamId      string
+	Payload     []byte
+	Attempts    int
+	NextAttempt int64
+	LastError   string
+	Created     int64
+}
+
+// DeadLetter is a response that could not be sent, Failed is when it was given up on
+type DeadLetter struct {
+	OutboundMessage
+	Failed int64
+}
+
+// EnqueueOutbound stores a response to send, due now
+func (sdb *SqliteDb) EnqueueOutbound(teamId string, payload []byte, now int64) (int64, error) {
+	sealed, err := sdb.sealer.seal(string(payload))
+	if err != nil {
+		return 0, err
+	}
+	res, err := sdb.db.Exec("INSERT INTO outbound (teamId, payload, attempts, nextAttempt, lastError, created) VALUES (?, ?, 0, ?, '', ?)",
+		teamId, sealed, now, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// DueOutbound returns up to limit responses due by now, oldest first
+func (sdb *SqliteDb) DueOutbound(now int64, limit int) ([]OutboundMessage, error) {
+	rows, err := sdb.db.Query("SELECT id, teamId, payload, attempts, nextAttempt, lastError, created FROM outbound WHERE nextAttempt <= ? ORDER BY id LIMIT ?", now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var msgs []OutboundMessage
+	for rows.Next() {
+		var m OutboundMessage
+		var payload string
+		if err := rows.Scan(&m.Id, &m.TeamId, &payload, &m.Attempts, &m.NextAttempt, &m.LastError, &m.Created); err != nil {
+			return msgs, err
+		}
+		if payload, err = sdb.sealer.open(payload); err != nil {
+			return msgs, err
+		}
+		m.Payload = []byte(payload)
+		msgs = append(msgs, m)
+	}
+	return msgs, rows.Err()
+}
+
+// RetryOutbound records a failed attempt, the response is due again at nextAttempt
+func (sdb *SqliteDb) RetryOutbound(id int64, attempts int, nextAttempt int64, lastError string) error {
+	_, err := sdb.db.Exec("UPDATE outbound SET attempts = ?, nextAttempt = ?, lastError = ? WHERE id = ?", attempts, nextAttempt, lastError, id)
+	return err
+}
+
+// DeleteOutbound forgets a sent response
+func (sdb *SqliteDb) DeleteOutbound(id int64) error {
+	_, err := sdb.db.Exec("DELETE FROM outbound WHERE id = ?", id)
+	return err
+}
+
+// DeadLetterOutbound moves a response that won't be sent to the dead letters
+func (sdb *SqliteDb) DeadLetterOutbound(id int64, attempts int, lastError string, now int64) error {
+	tx, err := sdb.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO deadletters (id, teamId, payload, attempts, lastError, created, failed) SELECT id, teamId, payload, ?, ?, created, ? FROM outbound WHERE id = ?",
+		attempts, lastError, now, id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM outbound WHERE id = ?", id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// rekeyPayloads seals the table's payloads not sealed with the current key
+func (sdb *SqliteDb) rekeyPayloads(table string) error {
+	rows, err := sdb.db.Query("SELECT id, payload FROM " + table)
+	if err != nil {
+		return err
+	}
+	stale := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var payload string
+		if err := rows.Scan(&id, &payload); err != nil {
+			rows.Close()
+			return err
+		}
+		plain, err := sdb.sealer.open(payload)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("%s %d: %v", table, id, err)
+		}
+		if sdb.sealer.stale(payload) {
+			stale[id] = plain
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, plain := range stale {
+		sealed, err := sdb.sealer.seal(plain)
+		if err != nil {
+			return err
+		}
+		if _, err := sdb.db.Exec("UPDATE "+table+" SET payload = ? WHERE id = ?", sealed, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetDeadLetters returns up to limit dead letters, most recently failed first
+func (sdb *SqliteDb) GetDeadLetters(limit int) ([]DeadLetter, error) {
+	rows, err := sdb.db.Query("SELECT id, teamId, payload, attempts, lastError, created, failed FROM deadletters ORDER BY failed DESC, id DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var letters []DeadLetter
+	for rows.Next() {
+		var l DeadLetter
+		var payload string
+		if err := rows.Scan(&l.Id, &l.TeamId, &payload, &l.Attempts, &l.LastError, &l.Created, &l.Failed); err != nil {
+			return letters, err
+		}
+		if payload, err = sdb.sealer.open(payload); err != nil {
+			return letters, err
+		}
+		l.Payload = []byte(payload)
+		letters = append(letters, l)
+	}
+	return letters, rows.Err()
+}
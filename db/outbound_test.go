@@ -0,0 +1,120 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSqliteDB_Outbound(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatops-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db := NewSqliteDB(filepath.Join(dir, "chatops.db"))
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	id1, err := db.EnqueueOutbound("T1", []byte(`{"n":1}`), 100)
+	assert.NoError(t, err)
+	id2, err := db.EnqueueOutbound("T2", []byte(`{"n":2}`), 100)
+	assert.NoError(t, err)
+	_, err = db.EnqueueOutbound("T1", []byte(`{"n":3}`), 200)
+	assert.NoError(t, err)
+
+	due, err := db.DueOutbound(100, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []OutboundMessage{
+		{Id: id1, TeamId: "T1", Payload: []byte(`{"n":1}`), NextAttempt: 100, Created: 100},
+		{Id: id2, TeamId: "T2", Payload: []byte(`{"n":2}`), NextAttempt: 100, Created: 100},
+	}, due)
+	due, err = db.DueOutbound(200, 1)
+	assert.NoError(t, err)
+	assert.Len(t, due, 1)
+
+	// a retried response is due again later
+	assert.NoError(t, db.RetryOutbound(id1, 1, 300, "ratelimited"))
+	due, err = db.DueOutbound(200, 10)
+	assert.NoError(t, err)
+	assert.Len(t, due, 2)
+	assert.Equal(t, id2, due[0].Id)
+	due, err = db.DueOutbound(300, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, due, 3) {
+		assert.Equal(t, 1, due[0].Attempts)
+		assert.Equal(t, "ratelimited", due[0].LastError)
+	}
+
+	// a sent response is forgotten, one that won't be sent is dead lettered
+	assert.NoError(t, db.DeleteOutbound(id2))
+	assert.NoError(t, db.DeadLetterOutbound(id1, 2, "channel_not_found", 400))
+	due, err = db.DueOutbound(300, 10)
+	assert.NoError(t, err)
+	assert.Len(t, due, 1)
+	letters, err := db.GetDeadLetters(10)
+	assert.NoError(t, err)
+	assert.Equal(t, []DeadLetter{{OutboundMessage: OutboundMessage{Id: id1, TeamId: "T1", Payload: []byte(`{"n":1}`),
+		Attempts: 2, LastError: "channel_not_found", Created: 100}, Failed: 400}}, letters)
+
+	// uninstalling a workspace drops its queued responses
+	assert.NoError(t, db.DeleteSlackBot("T1"))
+	due, err = db.DueOutbound(300, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, due)
+}
+
+func TestSqliteDB_OutboundEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatops-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "chatops.db")
+	open := func(key []byte, previous ...[]byte) (*SqliteDb, error) {
+		db := NewSqliteDB(file)
+		if err := db.SetKeys(key, previous); err != nil {
+			return nil, err
+		}
+		return db, db.Init()
+	}
+	raw := func(db *SqliteDb, table string) string {
+		payload := ""
+		assert.NoError(t, db.db.QueryRow("SELECT payload FROM "+table).Scan(&payload))
+		return payload
+	}
+
+	// response urls in queued payloads are sealed like tokens
+	db, err := open(testKey(1))
+	assert.NoError(t, err)
+	id, err := db.EnqueueOutbound("T1", []byte(`{"url":"https://hooks.slack.com/1"}`), 100)
+	assert.NoError(t, err)
+	_, err = db.EnqueueOutbound("T1", []byte(`{"url":"https://hooks.slack.com/2"}`), 100)
+	assert.NoError(t, err)
+	assert.NoError(t, db.DeadLetterOutbound(id, 1, "failed", 200))
+	assert.Equal(t, keyId(testKey(1)), envelopeKey(raw(db, "outbound")))
+	assert.Equal(t, keyId(testKey(1)), envelopeKey(raw(db, "deadletters")))
+
+	// and re-encrypted when the key rotates
+	db, err = open(testKey(2), testKey(1))
+	assert.NoError(t, err)
+	assert.Equal(t, keyId(testKey(2)), envelopeKey(raw(db, "outbound")))
+	assert.Equal(t, keyId(testKey(2)), envelopeKey(raw(db, "deadletters")))
+	due, err := db.DueOutbound(100, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, due, 1) {
+		assert.Equal(t, `{"url":"https://hooks.slack.com/2"}`, string(due[0].Payload))
+	}
+	letters, err := db.GetDeadLetters(10)
+	assert.NoError(t, err)
+	if assert.Len(t, letters, 1) {
+		assert.Equal(t, `{"url":"https://hooks.slack.com/1"}`, string(letters[0].Payload))
+	}
+
+	_, err = open(testKey(1))
+	assert.Error(t, err)
+}
@@ -0,0 +1,124 @@
+package relay
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// AccessList decides which addresses may connect to a passthrough relay.
+// An address is refused if it is in any deny block, otherwise it must be in one of the allow blocks
+// (if there are any) and match the legacy whitelist pattern (if there is one).
+type AccessList struct {
+	allow   []*net.IPNet
+	deny    []*net.IPNet
+	pattern *regexp.Regexp
+}
+
+// AccessListConfig is the file form of an AccessList, blocks are CIDRs or single addresses
+//
+//	allow: [10.0.0.0/8, "fd00::/8"]
+//	deny: [10.1.2.3]
+//	match: '10\.\d+\.\d+\.\d+'
+type AccessListConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+	Match string   `yaml:"match"`
+}
+
+// NewAccessList builds an AccessList from allow and deny blocks and an optional legacy regex pattern
+func NewAccessList(allow, deny []string, pattern string) (*AccessList, error) {
+	acl := &AccessList{}
+	var err error
+	if acl.allow, err = parseBlocks(allow); err != nil {
+		return nil, err
+	}
+	if acl.deny, err = parseBlocks(deny); err != nil {
+		return nil, err
+	}
+	if pattern != "" {
+		if acl.pattern, err = regexp.Compile(pattern); err != nil {
+			return nil, err
+		}
+	}
+	return acl, nil
+}
+
+// LoadAccessListConfig reads an AccessListConfig from a yaml file
+func LoadAccessListConfig(file string) (AccessListConfig, error) {
+	var conf AccessListConfig
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return conf, err
+	}
+	if err := yaml.UnmarshalStrict(b, &conf); err != nil {
+		return conf, fmt.Errorf("invalid access list %q: %v", file, err)
+	}
+	return conf, nil
+}
+
+// parseBlocks parses CIDR blocks, a bare address is treated as a block of one
+func parseBlocks(blocks []string) ([]*net.IPNet, error) {
+	out := make([]*net.IPNet, 0, len(blocks))
+	for _, b := range blocks {
+		b = strings.TrimSpace(b)
+		if b == "" {
+			continue
+		}
+		if !strings.Contains(b, "/") {
+			ip := net.ParseIP(b)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", b)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, block, err := net.ParseCIDR(b)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, block)
+	}
+	return out, nil
+}
+
+// Allowed returns nil if the ip may connect, otherwise an error describing why it was refused
+func (a *AccessList) Allowed(ip net.IP) error {
+	for _, block := range a.deny {
+		if block.Contains(ip) {
+			return fmt.Errorf("denied by %s", block)
+		}
+	}
+	if len(a.allow) > 0 {
+		allowed := false
+		for _, block := range a.allow {
+			if block.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("not in allowed blocks")
+		}
+	}
+	if a.pattern != nil && !a.pattern.MatchString(ip.String()) {
+		return fmt.Errorf("failed to match whitelist %q", a.pattern.String())
+	}
+	return nil
+}
+
+func (a *AccessList) String() string {
+	pattern := ""
+	if a.pattern != nil {
+		pattern = a.pattern.String()
+	}
+	return fmt.Sprintf("allow: %v deny: %v match: %q", a.allow, a.deny, pattern)
+}
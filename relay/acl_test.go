@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessList_Allowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		ip      string
+		allow   []string
+		deny    []string
+		pattern string
+		allowed bool
+	}{
+		{"empty allows all", "1.2.3.4", nil, nil, "", true},
+		{"in allowed block", "10.1.2.3", []string{"10.0.0.0/8"}, nil, "", true},
+		{"outside allowed block", "11.1.2.3", []string{"10.0.0.0/8"}, nil, "", false},
+		{"single address", "192.168.1.1", []string{"192.168.1.1"}, nil, "", true},
+		{"single address mismatch", "192.168.1.2", []string{"192.168.1.1"}, nil, "", false},
+		{"deny wins over allow", "10.1.2.3", []string{"10.0.0.0/8"}, []string{"10.1.2.0/24"}, "", false},
+		{"deny only", "10.1.2.3", nil, []string{"10.1.2.3"}, "", false},
+		{"ipv6 block", "fd00::1", []string{"fd00::/8"}, nil, "", true},
+		{"ipv6 outside block", "fe80::1", []string{"fd00::/8"}, nil, "", false},
+		{"ipv4 mapped ipv6", "::ffff:10.1.2.3", []string{"10.0.0.0/8"}, nil, "", true},
+		{"legacy pattern", "1.2.3.100", nil, nil, `1.2.3.\d+`, true},
+		{"legacy pattern mismatch", "1.2.4.100", nil, nil, `1.2.3.\d+`, false},
+		{"block and pattern", "10.1.2.3", []string{"10.0.0.0/8"}, nil, `^11\.`, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			acl, err := NewAccessList(test.allow, test.deny, test.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = acl.Allowed(net.ParseIP(test.ip))
+			assert.Equal(t, test.allowed, err == nil, err)
+		})
+	}
+}
+
+func TestNewAccessList_Invalid(t *testing.T) {
+	_, err := NewAccessList([]string{"10.0.0.0/33"}, nil, "")
+	assert.Error(t, err)
+	_, err = NewAccessList(nil, []string{"not an ip"}, "")
+	assert.Error(t, err)
+	_, err = NewAccessList(nil, nil, "(")
+	assert.Error(t, err)
+}
+
+func TestLoadAccessListConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relayacl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "acl.yaml")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("allow: [10.0.0.0/8, \"fd00::/8\"]\ndeny: [10.1.2.3]\nmatch: '.+'\n"), 0600))
+	conf, err := LoadAccessListConfig(file)
+	assert.NoError(t, err)
+	assert.Equal(t, AccessListConfig{
+		Allow: []string{"10.0.0.0/8", "fd00::/8"},
+		Deny:  []string{"10.1.2.3"},
+		Match: ".+",
+	}, conf)
+
+	assert.NoError(t, ioutil.WriteFile(file, []byte("allowed: [10.0.0.0/8]\n"), 0600))
+	_, err = LoadAccessListConfig(file)
+	assert.Error(t, err)
+}
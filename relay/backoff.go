@@ -0,0 +1,57 @@
+package relay
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ConnState describes where a handler relay is in its connection cycle
+type ConnState string
+
+const (
+	// StateConnecting is a handler dialing the passthrough
+	StateConnecting = ConnState("connecting")
+
+	// StateConnected is a handler with an established relay connection
+	StateConnected = ConnState("connected")
+
+	// StateBackingOff is a handler waiting to retry after a failed or refused connection
+	StateBackingOff = ConnState("backing-off")
+)
+
+// Backoff describes how long a handler waits between connection attempts. The wait starts at Initial
+// and grows by Multiplier with each failed attempt up to Max, Jitter is the fraction of each wait that is
+// randomized so a fleet of handlers doesn't reconnect in lockstep.
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     float64 // 0 - 1
+}
+
+// DefaultBackoff waits 500ms after the first failure, doubling up to 30s, with half of each wait randomized
+var DefaultBackoff = Backoff{
+	Initial:    500 * time.Millisecond,
+	Max:        30 * time.Second,
+	Multiplier: 2,
+	Jitter:     0.5,
+}
+
+// Duration returns the wait before the given retry, starting at 0 for the first retry
+func (b Backoff) Duration(retry int) time.Duration {
+	if b.Initial <= 0 {
+		return 0
+	}
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	d := float64(b.Initial) * math.Pow(multiplier, float64(retry))
+	if b.Max > 0 && d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	jitter := math.Min(math.Max(b.Jitter, 0), 1)
+	d -= d * jitter * rand.Float64()
+	return time.Duration(d)
+}
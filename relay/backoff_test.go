@@ -0,0 +1,34 @@
+package relay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff_Duration(t *testing.T) {
+	tests := []struct {
+		name     string
+		backoff  Backoff
+		retry    int
+		min, max time.Duration
+	}{
+		{"first retry", Backoff{Initial: time.Second, Max: time.Minute, Multiplier: 2}, 0, time.Second, time.Second},
+		{"grows", Backoff{Initial: time.Second, Max: time.Minute, Multiplier: 2}, 3, 8 * time.Second, 8 * time.Second},
+		{"capped", Backoff{Initial: time.Second, Max: time.Minute, Multiplier: 2}, 20, time.Minute, time.Minute},
+		{"constant without multiplier", Backoff{Initial: time.Second, Max: time.Minute}, 5, time.Second, time.Second},
+		{"jitter", Backoff{Initial: time.Second, Max: time.Minute, Multiplier: 2, Jitter: 0.5}, 2, 2 * time.Second, 4 * time.Second},
+		{"full jitter", Backoff{Initial: time.Second, Max: time.Minute, Multiplier: 2, Jitter: 1}, 2, 0, 4 * time.Second},
+		{"jitter under cap", Backoff{Initial: time.Second, Max: time.Minute, Multiplier: 2, Jitter: 0.5}, 20, 30 * time.Second, time.Minute},
+		{"disabled", Backoff{}, 3, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				d := test.backoff.Duration(test.retry)
+				assert.True(t, d >= test.min && d <= test.max, "%s not in [%s, %s]", d, test.min, test.max)
+			}
+		})
+	}
+}
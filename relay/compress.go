@@ -0,0 +1,132 @@
+package relay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+// EncodingGzip is the only relay body encoding so far
+const EncodingGzip = "gzip"
+
+// DefaultCompressThreshold is the body size above which relayed bodies are compressed
+const DefaultCompressThreshold = 1024
+
+// maxDecompressedSize bounds how large a compressed body may expand to
+const maxDecompressedSize = 64 << 20
+
+// compressor compresses request and response bodies sent over relay connections that negotiated
+// compression, and counts the bytes going in and out of the compressor in both directions.
+type compressor struct {
+	threshold int64 // bodies larger than this are compressed, 0 disables compression
+	bytesIn   int64 // uncompressed bytes
+	bytesOut  int64 // compressed bytes
+	count     int64
+}
+
+func (c *compressor) setThreshold(threshold int) {
+	atomic.StoreInt64(&c.threshold, int64(threshold))
+}
+
+// encodings returns the encodings this side offers during the handshake
+func (c *compressor) encodings() []string {
+	if atomic.LoadInt64(&c.threshold) <= 0 {
+		return nil
+	}
+	return []string{EncodingGzip}
+}
+
+// negotiate picks the encoding both sides support, "" if there is none
+func (c *compressor) negotiate(theirs []string) string {
+	for _, mine := range c.encodings() {
+		for _, t := range theirs {
+			if mine == t {
+				return mine
+			}
+		}
+	}
+	return ""
+}
+
+// compress returns the body encoded, if it is over the threshold and encoding makes it smaller,
+// otherwise the body is returned as it was with no encoding.
+func (c *compressor) compress(body []byte, encoding string) ([]byte, string) {
+	threshold := atomic.LoadInt64(&c.threshold)
+	if encoding != EncodingGzip || threshold <= 0 || int64(len(body)) <= threshold {
+		return body, ""
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return body, ""
+	}
+	if err := zw.Close(); err != nil {
+		return body, ""
+	}
+	if buf.Len() >= len(body) {
+		return body, ""
+	}
+	c.record(len(body), buf.Len())
+	return buf.Bytes(), EncodingGzip
+}
+
+// decompress decodes a body that was sent with the given encoding
+func (c *compressor) decompress(body []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return body, nil
+	case EncodingGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		out, err := ioutil.ReadAll(io.LimitReader(zr, maxDecompressedSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > maxDecompressedSize {
+			return nil, fmt.Errorf("relay body expands past %d bytes", maxDecompressedSize)
+		}
+		c.record(len(out), len(body))
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unsupported relay body encoding %q", encoding)
+	}
+}
+
+func (c *compressor) record(raw, compressed int) {
+	atomic.AddInt64(&c.bytesIn, int64(raw))
+	atomic.AddInt64(&c.bytesOut, int64(compressed))
+	atomic.AddInt64(&c.count, 1)
+}
+
+// CompressionStatus describes the bodies compressed and decompressed on relay connections
+type CompressionStatus struct {
+	Threshold int64   `json:"threshold"`
+	Count     int64   `json:"count"`
+	BytesIn   int64   `json:"bytesIn"`  // uncompressed
+	BytesOut  int64   `json:"bytesOut"` // compressed
+	Ratio     float64 `json:"ratio,omitempty"`
+}
+
+func (c *compressor) status() *CompressionStatus {
+	s := &CompressionStatus{
+		Threshold: atomic.LoadInt64(&c.threshold),
+		Count:     atomic.LoadInt64(&c.count),
+		BytesIn:   atomic.LoadInt64(&c.bytesIn),
+		BytesOut:  atomic.LoadInt64(&c.bytesOut),
+	}
+	if s.BytesIn > 0 {
+		s.Ratio = float64(s.BytesOut) / float64(s.BytesIn)
+	}
+	return s
+}
+
+// SetCompression sets the body size above which relayed bodies are compressed, 0 disables compression.
+// Compression is only used on connections where both sides enable it. Must be called before Listen or Connect.
+func (r *Relay) SetCompression(threshold int) {
+	r.compressor.setThreshold(threshold)
+}
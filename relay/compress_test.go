@@ -0,0 +1,104 @@
+package relay
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressor(t *testing.T) {
+	large := bytes.Repeat([]byte(`{"type":"section","text":{"type":"mrkdwn","text":"hello"}},`), 100)
+	tests := []struct {
+		name      string
+		threshold int
+		body      []byte
+		encoding  string
+		expected  string
+	}{
+		{"large body", DefaultCompressThreshold, large, EncodingGzip, EncodingGzip},
+		{"small body", DefaultCompressThreshold, []byte("small"), EncodingGzip, ""},
+		{"disabled", 0, large, EncodingGzip, ""},
+		{"not negotiated", DefaultCompressThreshold, large, "", ""},
+		{"incompressible", 8, []byte{0x1f, 0x8b, 0x00, 0xff, 0x10, 0x42, 0x99, 0x7e, 0x01}, EncodingGzip, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &compressor{threshold: int64(tt.threshold)}
+			body, encoding := c.compress(tt.body, tt.encoding)
+			assert.Equal(t, tt.expected, encoding)
+			if encoding == "" {
+				assert.Equal(t, tt.body, body)
+				assert.Equal(t, int64(0), c.status().Count)
+				return
+			}
+			assert.True(t, len(body) < len(tt.body))
+			out, err := c.decompress(body, encoding)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.body, out)
+
+			status := c.status()
+			assert.Equal(t, int64(2), status.Count)
+			assert.Equal(t, int64(2*len(tt.body)), status.BytesIn)
+			assert.Equal(t, int64(2*len(body)), status.BytesOut)
+			assert.True(t, status.Ratio > 0 && status.Ratio < 1)
+		})
+	}
+}
+
+func TestCompressor_Negotiate(t *testing.T) {
+	c := &compressor{threshold: DefaultCompressThreshold}
+	assert.Equal(t, EncodingGzip, c.negotiate([]string{"br", EncodingGzip}))
+	assert.Equal(t, "", c.negotiate(nil))
+	assert.Equal(t, "", c.negotiate([]string{"br"}))
+
+	c.setThreshold(0)
+	assert.Nil(t, c.encodings())
+	assert.Equal(t, "", c.negotiate([]string{EncodingGzip}))
+}
+
+func TestCompressor_DecompressInvalid(t *testing.T) {
+	c := &compressor{}
+	_, err := c.decompress([]byte("not gzip"), EncodingGzip)
+	assert.Error(t, err)
+	_, err = c.decompress([]byte("body"), "br")
+	assert.Error(t, err)
+}
+
+func TestRelay_Compression(t *testing.T) {
+	src, dst := connectedRelays(t, 5040, "/echo", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		_, _ = w.Write(b)
+	})
+	defer src.Close()
+	defer dst.Close()
+	handlers := src.Status().Handlers
+	if assert.Len(t, handlers, 1) {
+		assert.Equal(t, EncodingGzip, handlers[0].Compression)
+	}
+
+	relayServer := httptest.NewServer(http.HandlerFunc(src.RelayHandler))
+	defer relayServer.Close()
+	body := bytes.Repeat([]byte("payload="), 1000)
+	resp, err := http.Post(relayServer.URL+"/echo", "text/plain", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, body, b)
+
+	// the passthrough compresses the request and decompresses the response, the handler the reverse
+	for _, r := range []*Relay{src, dst} {
+		status := r.Status().Compression
+		if assert.NotNil(t, status) {
+			assert.Equal(t, int64(2), status.Count)
+			assert.Equal(t, int64(2*len(body)), status.BytesIn)
+			assert.True(t, status.Ratio < 0.1)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/zserge/metric"
+)
+
+// Rpc call handles
+const (
+	EgressDo   = "Egress.Do"
+	EgressPing = "Egress.Ping"
+)
+
+const (
+	// ChannelRelay is a connection carrying relayed requests from the passthrough to a handler
+	ChannelRelay = "relay"
+
+	// ChannelEgress is a connection carrying a handler's outbound requests to the passthrough
+	ChannelEgress = "egress"
+)
+
+// DefaultEgressTimeout is the time budget of an outbound request that has no deadline of its own
+const DefaultEgressTimeout = 30 * time.Second
+
+// DefaultEgressHosts are the hosts, and their subdomains, a passthrough will send outbound requests to
+var DefaultEgressHosts = []string{"slack.com"}
+
+// ErrNoEgress is returned by the handler's transport when there is no egress connection to the passthrough
+var ErrNoEgress = errors.New("relay egress failed, not connected to a passthrough")
+
+// egressStats counts outbound requests sent over the relay, on the handler as they are sent
+// and on the passthrough as they are performed
+type egressStats struct {
+	inFlight     int64
+	rpcCount     int64
+	timeoutCount int64
+	failureCount int64
+	connections  int64
+
+	rpcsCounter  metric.Metric
+	rpcHistogram metric.Metric
+}
+
+func newEgressStats() *egressStats {
+	return &egressStats{
+		rpcsCounter:  metric.NewCounter("1h1h"),   // 1 hour history, 1 hour precision
+		rpcHistogram: metric.NewHistogram("1h1h"), // 1 hour history, 1 hour precision
+	}
+}
+
+func (s *egressStats) done(start time.Time, err error) {
+	atomic.AddInt64(&s.rpcCount, 1)
+	s.rpcsCounter.Add(1)
+	s.rpcHistogram.Add(time.Since(start).Seconds())
+	switch {
+	case err == ErrRelayTimeout:
+		atomic.AddInt64(&s.timeoutCount, 1)
+	case err != nil:
+		atomic.AddInt64(&s.failureCount, 1)
+	}
+}
+
+// EgressStatus describes the outbound requests sent over the relay
+type EgressStatus struct {
+	Connected      bool        `json:"isConnected"`
+	InFlight       int64       `json:"inFlight"`
+	RpcCount       int64       `json:"rpcCount,omitempty"`
+	TimeoutCount   int64       `json:"timeoutCount,omitempty"`
+	FailureCount   int64       `json:"failureCount,omitempty"`
+	RpcsCounter    interface{} `json:"rpcsCounter,omitempty"`
+	RpcLatencySecs interface{} `json:"rpcLatencySecs,omitempty"`
+}
+
+func (s *egressStats) status() *EgressStatus {
+	return &EgressStatus{
+		Connected:      atomic.LoadInt64(&s.connections) > 0,
+		InFlight:       atomic.LoadInt64(&s.inFlight),
+		RpcCount:       atomic.LoadInt64(&s.rpcCount),
+		TimeoutCount:   atomic.LoadInt64(&s.timeoutCount),
+		FailureCount:   atomic.LoadInt64(&s.failureCount),
+		RpcsCounter:    s.rpcsCounter,
+		RpcLatencySecs: s.rpcHistogram,
+	}
+}
+
+// Egress performs outbound http requests on behalf of handlers, it runs on the passthrough.
+// It must be exported to enable registering as an rpc
+type Egress struct {
+	client     *http.Client
+	hosts      []string
+	stats      *egressStats
+	compressor *compressor
+}
+
+// Do performs the request and records the response, only requests to the allowed hosts are sent
+func (e *Egress) Do(req FauxRequest, response *Response) error {
+	start := time.Now()
+	atomic.AddInt64(&e.stats.inFlight, 1)
+	defer atomic.AddInt64(&e.stats.inFlight, -1)
+
+	err := e.do(req, response)
+	if err == nil {
+		response.encode(e.compressor, req.AcceptEncoding)
+	}
+	e.stats.done(start, err)
+	return err
+}
+
+func (e *Egress) do(req FauxRequest, response *Response) error {
+	if req.URL == nil || !e.hostAllowed(req.URL.Hostname()) {
+		return fmt.Errorf("relay egress to %q is not allowed", req.URL)
+	}
+	body, err := e.compressor.decompress(req.Body, req.BodyEncoding)
+	if err != nil {
+		return err
+	}
+	req.Body, req.BodyEncoding = body, ""
+	timeout := req.Timeout
+	if timeout <= 0 {
+		timeout = DefaultEgressTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	res, err := e.client.Do(req.Request().WithContext(ctx))
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return ErrRelayTimeout
+		}
+		return err
+	}
+	defer func() {
+		if err := res.Body.Close(); err != nil {
+			log.Println(err)
+		}
+	}()
+	for k, v := range res.Header {
+		response.Header()[k] = v
+	}
+	response.WriteHeader(res.StatusCode)
+	body, err = ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	_, err = response.Write(body)
+	return err
+}
+
+// hostAllowed matches the host, or any of its parent domains, against the allowed hosts
+func (e *Egress) hostAllowed(host string) bool {
+	host = strings.ToLower(host)
+	for _, h := range e.hosts {
+		h = strings.ToLower(h)
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ping lets the handler check its egress connection is still alive
+func (e *Egress) Ping(t time.Time, recv *string) error {
+	*recv = PingReply
+	return nil
+}
+
+// EnableEgress lets handlers send their outbound requests through this passthrough, only requests to
+// the given hosts and their subdomains are sent. Must be called before Listen.
+func (r *Relay) EnableEgress(hosts []string) error {
+	if r.Mode != PassThrough {
+		return errors.New("relay egress is served by a passthrough")
+	}
+	r.egressServer = rpc.NewServer()
+	return r.egressServer.Register(&Egress{
+		client:     &http.Client{},
+		hosts:      hosts,
+		stats:      r.egressStats,
+		compressor: r.compressor,
+	})
+}
+
+// SetEgress makes a handler open an egress connection alongside its relay connection, so that
+// outbound requests made with Transport are sent from the passthrough. Must be called before Connect.
+func (r *Relay) SetEgress(enabled bool) {
+	r.egressEnabled = enabled
+}
+
+// serveEgress performs a handler's outbound requests until the handler hangs up
+func (r *Relay) serveEgress(conn net.Conn) {
+	r.lock.Lock()
+	r.egressConns[conn] = true
+	r.lock.Unlock()
+	atomic.AddInt64(&r.egressStats.connections, 1)
+	log.Println("egress connected to:", conn.RemoteAddr())
+
+	r.egressServer.ServeConn(conn)
+
+	atomic.AddInt64(&r.egressStats.connections, -1)
+	r.lock.Lock()
+	delete(r.egressConns, conn)
+	r.lock.Unlock()
+	log.Println("egress disconnected from:", conn.RemoteAddr())
+}
+
+// useEgress sends outbound requests over the connection until it stops answering pings
+func (r *Relay) useEgress(conn net.Conn, info *PeerInfo) {
+	client := rpc.NewClient(conn)
+	r.lock.Lock()
+	r.egressClient = client
+	r.egressEncoding = info.Compression
+	r.lock.Unlock()
+	atomic.AddInt64(&r.egressStats.connections, 1)
+	log.Println("egress connected to:", conn.RemoteAddr())
+
+	for alive := true; alive; {
+		select {
+		case <-r.doneCh:
+			alive = false
+		case <-time.After(r.checkInterval):
+			var resp string
+			if err := client.Call(EgressPing, time.Now(), &resp); err != nil {
+				log.Println("egress ping failed:", err)
+				alive = false
+			}
+		}
+	}
+
+	atomic.AddInt64(&r.egressStats.connections, -1)
+	r.lock.Lock()
+	r.egressClient = nil
+	r.lock.Unlock()
+	if err := client.Close(); err != nil && err != rpc.ErrShutdown {
+		log.Println(err)
+	}
+	log.Println("egress disconnected from:", conn.RemoteAddr())
+}
+
+// Transport returns a RoundTripper that sends requests over the handler's egress connection,
+// to be performed by the passthrough
+func (r *Relay) Transport() http.RoundTripper {
+	return &egressTransport{r: r}
+}
+
+type egressTransport struct {
+	r *Relay
+}
+
+func (t *egressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := t.r
+	r.lock.Lock()
+	client := r.egressClient
+	encoding := r.egressEncoding
+	r.lock.Unlock()
+	if client == nil {
+		return nil, ErrNoEgress
+	}
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	faux := CreateFauxRequest(req, body)
+	ctx, cancel := context.WithTimeout(req.Context(), DefaultEgressTimeout)
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); ok {
+		faux.Timeout = time.Until(deadline)
+	}
+	if encoding != "" {
+		faux.AcceptEncoding = encoding
+		faux.Body, faux.BodyEncoding = r.compressor.compress(faux.Body, encoding)
+	}
+
+	start := time.Now()
+	atomic.AddInt64(&r.egressStats.inFlight, 1)
+	resp := &Response{}
+	call := client.Go(EgressDo, faux, resp, make(chan *rpc.Call, 1))
+	var err error
+	select {
+	case <-call.Done:
+		err = call.Error
+		if serr, ok := err.(rpc.ServerError); ok && string(serr) == ErrRelayTimeout.Error() {
+			err = ErrRelayTimeout
+		}
+		if err == nil {
+			err = resp.decode(r.compressor)
+		}
+	case <-ctx.Done():
+		err = ErrRelayTimeout
+	}
+	atomic.AddInt64(&r.egressStats.inFlight, -1)
+	r.egressStats.done(start, err)
+	if r.Debug {
+		log.Printf("egress to %s took: %s\n", req.URL.Host, time.Since(start))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	status := resp.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	header := resp.Headers
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(resp.Body)),
+		ContentLength: int64(len(resp.Body)),
+		Request:       req,
+	}, nil
+}
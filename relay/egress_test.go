@@ -0,0 +1,114 @@
+package relay
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEgress_HostAllowed(t *testing.T) {
+	e := &Egress{hosts: DefaultEgressHosts}
+	assert.True(t, e.hostAllowed("slack.com"))
+	assert.True(t, e.hostAllowed("hooks.slack.com"))
+	assert.True(t, e.hostAllowed("Hooks.Slack.com"))
+	assert.False(t, e.hostAllowed("notslack.com"))
+	assert.False(t, e.hostAllowed("slack.com.example.com"))
+}
+
+func TestRelay_Egress(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Auth", r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write(b)
+	}))
+	defer upstream.Close()
+
+	conf := generateTlsConfig(t)
+	src := NewRelay("", 5017, ".+", PassThrough, conf)
+	dst := NewRelay("", 5017, ".+", Handler, conf)
+	if err := src.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.EnableEgress([]string{"127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	dst.SetEgress(true)
+	src.SetCheckInterval(time.Millisecond * 100)
+	dst.SetCheckInterval(time.Millisecond * 100)
+	client := &http.Client{Transport: dst.Transport()}
+
+	// not connected yet
+	_, err := client.Post(upstream.URL, "application/json", bytes.NewReader(nil))
+	assert.Error(t, err)
+
+	if err := src.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	dst.Connect()
+	defer src.Close()
+	defer dst.Close()
+	for i := 0; i < 100 && !dst.Status().Egress.Connected; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.True(t, src.Status().Egress.Connected)
+
+	req, _ := http.NewRequest(http.MethodPost, upstream.URL+"/api/chat.postMessage", bytes.NewReader([]byte(`{"text":"hi"}`)))
+	req.Header.Set("Authorization", "Bearer xoxb")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "Bearer xoxb", resp.Header.Get("X-Auth"))
+	assert.Equal(t, `{"text":"hi"}`, string(b))
+
+	// the passthrough only sends to allowed hosts
+	_, err = client.Get("http://localhost:1/")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "is not allowed")
+	}
+
+	for _, status := range []*EgressStatus{src.Status().Egress, dst.Status().Egress} {
+		assert.Equal(t, int64(2), status.RpcCount)
+		assert.Equal(t, int64(1), status.FailureCount)
+		assert.Equal(t, int64(0), status.InFlight)
+	}
+	// the relay connection is unaffected
+	assert.Len(t, src.Status().Handlers, 1)
+}
+
+func TestRelay_EgressNotEnabled(t *testing.T) {
+	conf := generateTlsConfig(t)
+	src := NewRelay("", 5018, ".+", PassThrough, conf)
+	dst := NewRelay("", 5018, ".+", Handler, conf)
+	if err := src.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Init(); err != nil {
+		t.Fatal(err)
+	}
+	dst.SetEgress(true)
+	if err := src.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	dst.Connect()
+	defer src.Close()
+	defer dst.Close()
+	for i := 0; i < 100 && src.Status().HandshakeErrors == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Contains(t, src.Status().HandshakeError, "egress is not enabled")
+}
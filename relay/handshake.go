@@ -0,0 +1,208 @@
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/atsu/goat/build"
+)
+
+const (
+	// ProtocolVersion is the relay protocol spoken by this build, 2 adds the egress channel
+	// and 3 adds the handler's health to pings
+	ProtocolVersion = 3
+
+	// MinProtocolVersion is the oldest relay protocol this build can still speak, older builds
+	// are refused during the handshake rather than failing later on what they lack
+	MinProtocolVersion = ProtocolVersion
+)
+
+// maxHandshakeFrame bounds the size of a handshake message
+const maxHandshakeFrame = 64 * 1024
+
+// exporterLabel binds the handshake mac to the tls session, so a mac can't be replayed on another connection
+const exporterLabel = "EXPORTER-chatops-relay"
+
+// hello is the first message each side sends once tls is established
+type hello struct {
+	Mode        RelayMode
+	Channel     string
+	Protocol    int
+	MinProtocol int
+	Info        build.Info
+	Compression []string // body encodings this side can use, empty if compression is disabled
+	MAC         []byte
+}
+
+// verdict is each side's answer to the other's hello
+type verdict struct {
+	Accepted bool
+	Protocol int
+	Reason   string
+}
+
+// PeerInfo describes the other end of an established relay connection
+type PeerInfo struct {
+	Protocol    int        `json:"protocol"`
+	Channel     string     `json:"channel,omitempty"`
+	Compression string     `json:"compression,omitempty"` // body encoding both sides agreed on
+	Build       build.Info `json:"build"`
+}
+
+// HandshakeError is returned when a relay handshake is refused, by either side
+type HandshakeError struct {
+	Reason string
+	ByPeer bool
+}
+
+func (e *HandshakeError) Error() string {
+	if e.ByPeer {
+		return "relay handshake refused by peer: " + e.Reason
+	}
+	return "relay handshake refused: " + e.Reason
+}
+
+// handshake identifies this relay to the peer and checks the peer's identity in return. Both sides
+// send a hello, then each sends a verdict on the other's hello, so a refused peer learns why.
+// The channel is the kind of connection this side is opening, empty for a passthrough.
+func (r *Relay) handshake(conn net.Conn, channel string) (*PeerInfo, error) {
+	binding, err := channelBinding(conn)
+	if err != nil {
+		return nil, err
+	}
+	mine := hello{
+		Mode:        r.Mode,
+		Channel:     channel,
+		Protocol:    ProtocolVersion,
+		MinProtocol: MinProtocolVersion,
+		Info:        r.info,
+		Compression: r.compressor.encodings(),
+		MAC:         handshakeMAC(r.secret, r.Mode, channel, ProtocolVersion, binding),
+	}
+	if err := writeFrame(conn, mine); err != nil {
+		return nil, err
+	}
+	var theirs hello
+	if err := readFrame(conn, &theirs); err != nil {
+		// builds from before the handshake send nothing we can read as a hello
+		return nil, &HandshakeError{Reason: fmt.Sprintf("no relay handshake from peer, it may be older than relay protocol %d: %v",
+			MinProtocolVersion, err)}
+	}
+
+	v := verdict{Accepted: true}
+	v.Protocol, err = r.checkHello(theirs, binding)
+	if err != nil {
+		v = verdict{Reason: err.Error()}
+	}
+	if err := writeFrame(conn, v); err != nil {
+		return nil, err
+	}
+	var answer verdict
+	if err := readFrame(conn, &answer); err != nil {
+		return nil, err
+	}
+	if !v.Accepted {
+		return nil, &HandshakeError{Reason: v.Reason}
+	}
+	if !answer.Accepted {
+		return nil, &HandshakeError{Reason: answer.Reason, ByPeer: true}
+	}
+	return &PeerInfo{
+		Protocol:    v.Protocol,
+		Channel:     theirs.Channel,
+		Compression: r.compressor.negotiate(theirs.Compression),
+		Build:       theirs.Info,
+	}, nil
+}
+
+// checkHello validates the peer's hello and returns the protocol version both sides will speak
+func (r *Relay) checkHello(h hello, binding []byte) (int, error) {
+	if h.Mode == r.Mode || (h.Mode != PassThrough && h.Mode != Handler) {
+		return 0, fmt.Errorf("peer is in %q mode, expected the opposite of %q", h.Mode, r.Mode)
+	}
+	if len(r.secret) > 0 {
+		if len(h.MAC) == 0 {
+			return 0, errors.New("peer did not authenticate, a shared secret is required")
+		}
+		if !hmac.Equal(h.MAC, handshakeMAC(r.secret, h.Mode, h.Channel, h.Protocol, binding)) {
+			return 0, errors.New("peer authentication failed, shared secret mismatch")
+		}
+	}
+	protocol := ProtocolVersion
+	if h.Protocol < protocol {
+		protocol = h.Protocol
+	}
+	min := MinProtocolVersion
+	if h.MinProtocol > min {
+		min = h.MinProtocol
+	}
+	if protocol < min {
+		return 0, fmt.Errorf("incompatible relay protocol, peer (%s) speaks %d-%d, this relay speaks %d-%d",
+			h.Info.String(), h.MinProtocol, h.Protocol, MinProtocolVersion, ProtocolVersion)
+	}
+	if h.Channel == ChannelEgress && r.egressServer == nil {
+		return 0, errors.New("relay egress is not enabled on this passthrough")
+	}
+	return protocol, nil
+}
+
+// handshakeMAC authenticates the sender's hello on this connection, nil if there is no secret
+func handshakeMAC(secret []byte, mode RelayMode, channel string, protocol int, binding []byte) []byte {
+	if len(secret) == 0 {
+		return nil
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(mode))
+	mac.Write([]byte(channel))
+	mac.Write([]byte(strconv.Itoa(protocol)))
+	mac.Write(binding)
+	return mac.Sum(nil)
+}
+
+// channelBinding returns keying material unique to the tls session, nil for a plain connection
+func channelBinding(conn net.Conn) ([]byte, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+	state := tlsConn.ConnectionState()
+	return state.ExportKeyingMaterial(exporterLabel, nil, 32)
+}
+
+// writeFrame writes v as length prefixed json, so the reader consumes exactly the handshake
+// and leaves the rest of the stream to rpc
+func writeFrame(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	copy(buf[4:], b)
+	_, err = w.Write(buf)
+	return err
+}
+
+func readFrame(rd io.Reader, v interface{}) error {
+	var size [4]byte
+	if _, err := io.ReadFull(rd, size[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxHandshakeFrame {
+		return fmt.Errorf("handshake message too large (%d bytes)", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rd, b); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,137 @@
+package relay
+
+import (
+	"net"
+	"testing"
+
+	"github.com/atsu/goat/build"
+	"github.com/stretchr/testify/assert"
+)
+
+// handshakePair runs the handshake between two relays over a loopback tcp connection
+func handshakePair(t *testing.T, a, b *Relay) (*PeerInfo, error, *PeerInfo, error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	type result struct {
+		info *PeerInfo
+		err  error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			resCh <- result{err: err}
+			return
+		}
+		defer conn.Close()
+		info, err := b.handshake(conn, "")
+		resCh <- result{info, err}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	infoA, errA := a.handshake(conn, "")
+	res := <-resCh
+	return infoA, errA, res.info, res.err
+}
+
+func TestRelay_Handshake(t *testing.T) {
+	tests := []struct {
+		name         string
+		modeA, modeB RelayMode
+		secretA      string
+		secretB      string
+		errA, errB   string
+		peerRefusedA bool
+		peerRefusedB bool
+	}{
+		{"no secret", Handler, PassThrough, "", "", "", "", false, false},
+		{"shared secret", Handler, PassThrough, "s3cret", "s3cret", "", "", false, false},
+		{"secret mismatch", Handler, PassThrough, "s3cret", "other", "shared secret mismatch", "shared secret mismatch", false, false},
+		{"handler without secret", Handler, PassThrough, "", "s3cret", "a shared secret is required", "a shared secret is required", true, false},
+		{"same mode", Handler, Handler, "", "", "expected the opposite", "expected the opposite", false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := NewRelay("", 0, ".+", test.modeA, nil)
+			a.SetInfo(build.Info{Component: "a"})
+			a.SetSecret(test.secretA)
+			b := NewRelay("", 0, ".+", test.modeB, nil)
+			b.SetInfo(build.Info{Component: "b"})
+			b.SetSecret(test.secretB)
+
+			infoA, errA, infoB, errB := handshakePair(t, a, b)
+			if test.errA == "" {
+				assert.NoError(t, errA)
+				assert.NoError(t, errB)
+				assert.Equal(t, ProtocolVersion, infoA.Protocol)
+				assert.Equal(t, "b", infoA.Build.Component)
+				assert.Equal(t, "a", infoB.Build.Component)
+				return
+			}
+			if assert.Error(t, errA) && assert.Error(t, errB) {
+				assert.Contains(t, errA.Error(), test.errA)
+				assert.Contains(t, errB.Error(), test.errB)
+				assert.Equal(t, test.peerRefusedA, errA.(*HandshakeError).ByPeer)
+				assert.Equal(t, test.peerRefusedB, errB.(*HandshakeError).ByPeer)
+			}
+		})
+	}
+}
+
+func TestRelay_CheckHelloProtocol(t *testing.T) {
+	r := NewRelay("", 0, ".+", PassThrough, nil)
+	tests := []struct {
+		name     string
+		min, max int
+		protocol int
+		err      bool
+	}{
+		{"same version", MinProtocolVersion, ProtocolVersion, ProtocolVersion, false},
+		{"newer peer speaks ours", MinProtocolVersion, ProtocolVersion + 1, ProtocolVersion, false},
+		{"peer too new", ProtocolVersion + 1, ProtocolVersion + 2, 0, true},
+		{"peer too old", 0, MinProtocolVersion - 1, 0, true},
+		{"peer before health pings", 1, 2, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			protocol, err := r.checkHello(hello{Mode: Handler, MinProtocol: test.min, Protocol: test.max}, nil)
+			assert.Equal(t, test.err, err != nil, err)
+			assert.Equal(t, test.protocol, protocol)
+		})
+	}
+}
+
+func TestRelay_HandshakeLegacyPeer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// a build from before the handshake speaks rpc right away
+		_, _ = conn.Write([]byte("legacy rpc request"))
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := NewRelay("", 0, ".+", Handler, nil)
+	_, err = r.handshake(conn, "")
+	if assert.Error(t, err) {
+		assert.IsType(t, &HandshakeError{}, err)
+		assert.Contains(t, err.Error(), "no relay handshake from peer, it may be older than relay protocol 3")
+	}
+}
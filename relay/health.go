@@ -0,0 +1,122 @@
+package relay
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/atsu/goat/health"
+)
+
+// Rpc call handle
+const RelayerPingHealth = "Relayer.PingHealth"
+
+// HealthSummary is a handler's own health, sent to the passthrough with each ping
+type HealthSummary struct {
+	Health     health.State               `json:"health"`
+	Message    string                     `json:"message,omitempty"`
+	Components map[string]ComponentHealth `json:"components,omitempty"`
+	Time       int64                      `json:"time"`
+}
+
+// ComponentHealth is the health of one part of a handler, such as slack or kafka
+type ComponentHealth struct {
+	Health  health.State `json:"health"`
+	Message string       `json:"message,omitempty"`
+}
+
+// NewHealthSummary combines the component healths, the summary is as healthy as its least healthy component
+func NewHealthSummary(components map[string]ComponentHealth) HealthSummary {
+	summary := HealthSummary{Health: health.Green, Components: components, Time: time.Now().Unix()}
+	for name, c := range components {
+		if healthRank(c.Health) > healthRank(summary.Health) {
+			summary.Health = c.Health
+			summary.Message = fmt.Sprintf("%s: %s", name, c.Message)
+		}
+	}
+	return summary
+}
+
+// PingStatus is the reply to PingHealth
+type PingStatus struct {
+	Reply  string // PingReply or DrainReply
+	Health *HealthSummary
+}
+
+// PingHealth is Ping with the handler's health summary attached to the reply
+func (r *Relayer) PingHealth(t time.Time, recv *PingStatus) error {
+	if err := r.Ping(t, &recv.Reply); err != nil {
+		return err
+	}
+	if r.healthhook != nil {
+		recv.Health = r.healthhook()
+	}
+	return nil
+}
+
+// SetHealthFunc sets how a handler reports its own health to the passthrough
+func (r *Relay) SetHealthFunc(f func() HealthSummary) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.healthFunc = f
+}
+
+func (r *Relay) localHealth() *HealthSummary {
+	r.lock.Lock()
+	f := r.healthFunc
+	r.lock.Unlock()
+	if f == nil {
+		return nil
+	}
+	summary := f()
+	return &summary
+}
+
+// WorstHealth returns the least healthy of the states
+func WorstHealth(states ...health.State) health.State {
+	worst := health.Green
+	for _, s := range states {
+		if healthRank(s) > healthRank(worst) {
+			worst = s
+		}
+	}
+	return worst
+}
+
+func healthRank(s health.State) int {
+	switch s {
+	case health.Green:
+		return 0
+	case health.Blue:
+		return 1
+	case health.Yellow:
+		return 2
+	case health.Red:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// handlersHealth combines the health reported by the connected handlers: red if none are connected
+// or all are red, yellow if any are not green, a handler that doesn't report its health counts as green.
+func handlersHealth(handlers []HandlerStatus) (health.State, string) {
+	if len(handlers) == 0 {
+		return health.Red, "no handler connected"
+	}
+	red := 0
+	state, message := health.Green, ""
+	for _, h := range handlers {
+		if h.Health == nil || h.Health.Health == health.Green {
+			continue
+		}
+		if h.Health.Health == health.Red {
+			red++
+		}
+		state = health.Yellow
+		message = fmt.Sprintf("handler %d (%s) is %s: %s", h.Id, h.Addr, h.Health.Health, h.Health.Message)
+	}
+	if red == len(handlers) {
+		state = health.Red
+	}
+	return state, message
+}
@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/atsu/goat/health"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewHealthSummary(t *testing.T) {
+	summary := NewHealthSummary(map[string]ComponentHealth{
+		"slack": {Health: health.Yellow, Message: "recent errors"},
+		"kafka": {Health: health.Green},
+	})
+	assert.Equal(t, health.Yellow, summary.Health)
+	assert.Equal(t, "slack: recent errors", summary.Message)
+
+	summary = NewHealthSummary(nil)
+	assert.Equal(t, health.Green, summary.Health)
+}
+
+func TestWorstHealth(t *testing.T) {
+	assert.Equal(t, health.Green, WorstHealth())
+	assert.Equal(t, health.Green, WorstHealth(health.Green, health.Green))
+	assert.Equal(t, health.Yellow, WorstHealth(health.Green, health.Yellow, health.Blue))
+	assert.Equal(t, health.Red, WorstHealth(health.Red, health.Yellow))
+}
+
+func TestHandlersHealth(t *testing.T) {
+	green := &HealthSummary{Health: health.Green}
+	yellow := &HealthSummary{Health: health.Yellow}
+	red := &HealthSummary{Health: health.Red}
+	tests := []struct {
+		name     string
+		handlers []HandlerStatus
+		expected health.State
+	}{
+		{"no handlers", nil, health.Red},
+		{"unreported", []HandlerStatus{{}}, health.Green},
+		{"all green", []HandlerStatus{{Health: green}, {Health: green}}, health.Green},
+		{"one yellow", []HandlerStatus{{Health: green}, {Health: yellow}}, health.Yellow},
+		{"one red", []HandlerStatus{{Health: green}, {Health: red}}, health.Yellow},
+		{"all red", []HandlerStatus{{Health: red}, {Health: red}}, health.Red},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state, _ := handlersHealth(test.handlers)
+			assert.Equal(t, test.expected, state)
+		})
+	}
+}
+
+func TestRelay_HealthOnPing(t *testing.T) {
+	src, dst := connectedRelays(t, 5019, "/unused", func(w http.ResponseWriter, r *http.Request) {})
+	defer src.Close()
+	defer dst.Close()
+	dst.SetHealthFunc(func() HealthSummary {
+		return NewHealthSummary(map[string]ComponentHealth{
+			"kafka": {Health: health.Yellow, Message: "produce failing"},
+		})
+	})
+	for i := 0; i < 100; i++ {
+		if handlers := src.Status().Handlers; len(handlers) == 1 && handlers[0].Health != nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	status := src.Status()
+	if assert.Len(t, status.Handlers, 1) && assert.NotNil(t, status.Handlers[0].Health) {
+		assert.Equal(t, health.Yellow, status.Handlers[0].Health.Health)
+		assert.Equal(t, "kafka: produce failing", status.Handlers[0].Health.Message)
+	}
+	assert.Equal(t, health.Yellow, status.Health)
+	assert.Contains(t, status.HealthMessage, "kafka: produce failing")
+}
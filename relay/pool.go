@@ -0,0 +1,221 @@
+package relay
+
+import (
+	"log"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atsu/goat/build"
+	"github.com/zserge/metric"
+)
+
+// HandlerState describes the state of a handler connection as seen by the passthrough
+type HandlerState string
+
+const (
+	// HandlerConnected is a handler that is accepting relayed requests
+	HandlerConnected = HandlerState("connected")
+
+	// HandlerDraining is a handler that is shutting down, it finishes the requests it has but gets no new ones
+	HandlerDraining = HandlerState("draining")
+)
+
+// handlerConn is a single handler connected to a passthrough relay
+type handlerConn struct {
+	inFlight int64
+	rpcCount int64
+
+	id          int64
+	addr        string
+	peer        string // verified client certificate name, when using mutual tls
+	info        *PeerInfo
+	client      *rpc.Client
+	connectTime int64
+
+	lock     sync.Mutex
+	state    HandlerState
+	lastPing time.Time
+	health   *HealthSummary
+
+	rpcHistogram  metric.Metric
+	pingHistogram metric.Metric
+}
+
+func (h *handlerConn) State() HandlerState {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.state
+}
+
+func (h *handlerConn) setState(state HandlerState) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.state != state {
+		log.Printf("handler %d (%s) is %s\n", h.id, h.addr, state)
+	}
+	h.state = state
+}
+
+func (h *handlerConn) setHealth(summary *HealthSummary) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if summary != nil && (h.health == nil || h.health.Health != summary.Health) {
+		log.Printf("handler %d (%s) health is %s %s\n", h.id, h.addr, summary.Health, summary.Message)
+	}
+	h.health = summary
+}
+
+func (h *handlerConn) pinged(t time.Time, d time.Duration) {
+	h.lock.Lock()
+	h.lastPing = t
+	h.lock.Unlock()
+	h.pingHistogram.Add(d.Seconds())
+}
+
+// HandlerStatus describes a single handler connected to a passthrough relay
+type HandlerStatus struct {
+	Id              int64          `json:"id"`
+	Addr            string         `json:"addr"`
+	Peer            string         `json:"peer,omitempty"`
+	Protocol        int            `json:"protocol,omitempty"`
+	Compression     string         `json:"compression,omitempty"`
+	Build           *build.Info    `json:"build,omitempty"`
+	Health          *HealthSummary `json:"health,omitempty"`
+	State           HandlerState   `json:"state"`
+	ConnectTime     int64          `json:"connectTime"`
+	LastPingTime    int64          `json:"lastPingTime,omitempty"`
+	InFlight        int64          `json:"inFlight"`
+	RpcCount        int64          `json:"rpcCount"`
+	RpcLatencySecs  interface{}    `json:"rpcLatencySecs,omitempty"`
+	PingLatencySecs interface{}    `json:"pingLatencySecs,omitempty"`
+}
+
+func (h *handlerConn) Status() HandlerStatus {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	status := HandlerStatus{
+		Id:              h.id,
+		Addr:            h.addr,
+		Peer:            h.peer,
+		State:           h.state,
+		Health:          h.health,
+		ConnectTime:     h.connectTime,
+		LastPingTime:    h.lastPing.Unix(),
+		InFlight:        atomic.LoadInt64(&h.inFlight),
+		RpcCount:        atomic.LoadInt64(&h.rpcCount),
+		RpcLatencySecs:  h.rpcHistogram,
+		PingLatencySecs: h.pingHistogram,
+	}
+	if h.info != nil {
+		status.Protocol = h.info.Protocol
+		status.Compression = h.info.Compression
+		status.Build = &h.info.Build
+	}
+	return status
+}
+
+// handlerPool holds the handlers connected to a passthrough relay and chooses which one
+// receives the next relayed request.
+type handlerPool struct {
+	lock     sync.Mutex
+	handlers []*handlerConn
+	next     int
+	lastId   int64
+}
+
+func (p *handlerPool) add(addr, peer string, info *PeerInfo, client *rpc.Client) *handlerConn {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.lastId++
+	h := &handlerConn{
+		id:            p.lastId,
+		addr:          addr,
+		peer:          peer,
+		info:          info,
+		client:        client,
+		connectTime:   time.Now().Unix(),
+		state:         HandlerConnected,
+		rpcHistogram:  metric.NewHistogram("1h1h"), // 1 hour history, 1 hour precision
+		pingHistogram: metric.NewHistogram("1h1h"), // 1 hour history, 1 hour precision
+	}
+	p.handlers = append(p.handlers, h)
+	return h
+}
+
+func (p *handlerPool) remove(h *handlerConn) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i, hc := range p.handlers {
+		if hc == h {
+			p.handlers = append(p.handlers[:i], p.handlers[i+1:]...)
+			break
+		}
+	}
+	if err := h.client.Close(); err != nil && err != rpc.ErrShutdown {
+		log.Println(err)
+	}
+}
+
+// pick returns the connected handler with the fewest in-flight requests, ties are broken
+// round-robin. Handlers in the exclude set are skipped, nil is returned if none are available.
+func (p *handlerPool) pick(exclude map[*handlerConn]bool) *handlerConn {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var picked *handlerConn
+	var least int64
+	cnt := len(p.handlers)
+	for i := 0; i < cnt; i++ {
+		h := p.handlers[(p.next+i)%cnt]
+		if exclude[h] || h.State() != HandlerConnected {
+			continue
+		}
+		inFlight := atomic.LoadInt64(&h.inFlight)
+		if picked == nil || inFlight < least {
+			picked, least = h, inFlight
+		}
+	}
+	p.next++
+	return picked
+}
+
+// available returns the number of handlers accepting new requests
+func (p *handlerPool) available() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	cnt := 0
+	for _, h := range p.handlers {
+		if h.State() == HandlerConnected {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// list returns a copy of the connected handlers
+func (p *handlerPool) list() []*handlerConn {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]*handlerConn(nil), p.handlers...)
+}
+
+func (p *handlerPool) status() []HandlerStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	out := make([]HandlerStatus, 0, len(p.handlers))
+	for _, h := range p.handlers {
+		out = append(out, h.Status())
+	}
+	return out
+}
+
+func (p *handlerPool) closeAll() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, h := range p.handlers {
+		if err := h.client.Close(); err != nil && err != rpc.ErrShutdown {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package relay
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const queueFileExt = ".req"
+
+// rejectedDirName is the queue subdirectory requests the handler refused are kept in,
+// moving them back into the queue directory replays them on the next start
+const rejectedDirName = "rejected"
+
+// requestQueue is a bounded, durable, first in first out queue of relayed requests.
+// Each request is a gob encoded file in the queue directory, named by sequence number
+// so the directory listing is the queue order and survives a restart.
+type requestQueue struct {
+	dropped  int64
+	rejected int64
+
+	dir   string
+	max   int
+	lock  sync.Mutex
+	names []string // oldest first
+	seq   uint64
+}
+
+type queuedRequest struct {
+	name    string
+	Request *FauxRequest
+}
+
+func newRequestQueue(dir string, max int) (*requestQueue, error) {
+	if max < 1 {
+		return nil, fmt.Errorf("invalid queue size %d", max)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	q := &requestQueue{dir: dir, max: max, names: make([]string, 0)}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), queueFileExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), queueFileExt), 10, 64)
+		if err != nil {
+			log.Printf("ignoring unexpected file in relay queue: %s\n", f.Name())
+			continue
+		}
+		if seq > q.seq {
+			q.seq = seq
+		}
+		q.names = append(q.names, f.Name())
+	}
+	sort.Strings(q.names)
+	return q, nil
+}
+
+// Push stores the request at the back of the queue, dropping the oldest requests if the queue is full
+func (q *requestQueue) Push(req *FauxRequest) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.seq++
+	name := fmt.Sprintf("%020d%s", q.seq, queueFileExt)
+	tmp, err := ioutil.TempFile(q.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(tmp).Encode(req); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	// rename so a partially written request is never picked up
+	if err := os.Rename(tmp.Name(), filepath.Join(q.dir, name)); err != nil {
+		return err
+	}
+	q.names = append(q.names, name)
+	for len(q.names) > q.max {
+		log.Printf("relay queue full, dropping %s\n", q.names[0])
+		q.remove(q.names[0])
+		atomic.AddInt64(&q.dropped, 1)
+	}
+	return nil
+}
+
+// Peek returns the request at the front of the queue without removing it, nil if the queue is empty.
+// Requests that can no longer be read are dropped.
+func (q *requestQueue) Peek() *queuedRequest {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for len(q.names) > 0 {
+		name := q.names[0]
+		req, err := q.read(name)
+		if err == nil {
+			return &queuedRequest{name: name, Request: req}
+		}
+		log.Printf("dropping unreadable relay queue entry %s: %v\n", name, err)
+		q.remove(name)
+		atomic.AddInt64(&q.dropped, 1)
+	}
+	return nil
+}
+
+func (q *requestQueue) read(name string) (*FauxRequest, error) {
+	f, err := os.Open(filepath.Join(q.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var req FauxRequest
+	if err := gob.NewDecoder(f).Decode(&req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// Remove takes a request previously returned by Peek off the queue
+func (q *requestQueue) Remove(item *queuedRequest) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.remove(item.name)
+}
+
+// remove deletes the named entry, the lock must be held
+func (q *requestQueue) remove(name string) {
+	for i, n := range q.names {
+		if n == name {
+			q.names = append(q.names[:i], q.names[i+1:]...)
+			break
+		}
+	}
+	if err := os.Remove(filepath.Join(q.dir, name)); err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+}
+
+func (q *requestQueue) rejectedDir() string {
+	return filepath.Join(q.dir, rejectedDirName)
+}
+
+// Reject takes a request previously returned by Peek off the queue and keeps it in the rejected directory,
+// which holds at most as many requests as the queue, the oldest are dropped
+func (q *requestQueue) Reject(item *queuedRequest) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	atomic.AddInt64(&q.rejected, 1)
+	dir := q.rejectedDir()
+	if err := os.MkdirAll(dir, 0700); err == nil {
+		if err := os.Rename(filepath.Join(q.dir, item.name), filepath.Join(dir, item.name)); err != nil {
+			log.Println(err)
+		}
+		if files, err := ioutil.ReadDir(dir); err == nil && len(files) > q.max {
+			// ReadDir sorts by name, which is the queue order
+			for _, f := range files[:len(files)-q.max] {
+				_ = os.Remove(filepath.Join(dir, f.Name()))
+			}
+		}
+	} else {
+		log.Println(err)
+	}
+	q.remove(item.name)
+}
+
+func (q *requestQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.names)
+}
+
+func (q *requestQueue) Dropped() int64 {
+	return atomic.LoadInt64(&q.dropped)
+}
+
+// Rejected is how many requests were refused by the handler and kept in the rejected directory
+func (q *requestQueue) Rejected() int64 {
+	return atomic.LoadInt64(&q.rejected)
+}
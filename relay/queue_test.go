@@ -0,0 +1,117 @@
+package relay
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relayqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := newRequestQueue(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, q.Peek())
+	for _, path := range []string{"/1", "/2", "/3"} {
+		assert.NoError(t, q.Push(&FauxRequest{Method: "POST", URL: &url.URL{Path: path}, Body: []byte(path)}))
+	}
+	// the oldest request is dropped once full
+	assert.Equal(t, 2, q.Len())
+	assert.Equal(t, int64(1), q.Dropped())
+
+	// requests survive a restart in order
+	q, err = newRequestQueue(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, q.Len())
+	item := q.Peek()
+	if assert.NotNil(t, item) {
+		assert.Equal(t, "/2", item.Request.URL.Path)
+		assert.Equal(t, []byte("/2"), item.Request.Body)
+		q.Remove(item)
+	}
+	assert.NoError(t, q.Push(&FauxRequest{Method: "POST", URL: &url.URL{Path: "/4"}}))
+	for _, path := range []string{"/3", "/4"} {
+		item := q.Peek()
+		if assert.NotNil(t, item) {
+			assert.Equal(t, path, item.Request.URL.Path)
+			q.Remove(item)
+		}
+	}
+	assert.Nil(t, q.Peek())
+	assert.Equal(t, 0, q.Len())
+
+	_, err = newRequestQueue(dir, 0)
+	assert.Error(t, err)
+}
+
+func TestRequestQueue_Unreadable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relayqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := newRequestQueue(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, q.Push(&FauxRequest{URL: &url.URL{Path: "/1"}}))
+	assert.NoError(t, q.Push(&FauxRequest{URL: &url.URL{Path: "/2"}}))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, q.names[0]), []byte("garbage"), 0600))
+
+	item := q.Peek()
+	if assert.NotNil(t, item) {
+		assert.Equal(t, "/2", item.Request.URL.Path)
+	}
+	assert.Equal(t, int64(1), q.Dropped())
+}
+
+func TestRequestQueue_Reject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relayqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := newRequestQueue(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/1", "/2", "/3", "/4"} {
+		assert.NoError(t, q.Push(&FauxRequest{URL: &url.URL{Path: path}}))
+	}
+	// /1 and /2 were dropped, rejected requests are kept up to the queue size
+	for q.Len() > 0 {
+		q.Reject(q.Peek())
+	}
+	assert.NoError(t, q.Push(&FauxRequest{URL: &url.URL{Path: "/5"}}))
+	q.Reject(q.Peek())
+	assert.Equal(t, int64(3), q.Rejected())
+	files, err := ioutil.ReadDir(q.rejectedDir())
+	assert.NoError(t, err)
+	if assert.Len(t, files, 2) {
+		assert.Empty(t, q.names)
+		req, err := q.read(filepath.Join(rejectedDirName, files[1].Name()))
+		assert.NoError(t, err)
+		assert.Equal(t, "/5", req.URL.Path)
+	}
+
+	// the rejected directory isn't read as part of the queue
+	q, err = newRequestQueue(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, q.Len())
+}
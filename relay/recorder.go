@@ -0,0 +1,321 @@
+package relay
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Redacted replaces secrets in recorded requests and responses
+const Redacted = "REDACTED"
+
+// RedactedHeaders are the request and response headers whose values are never recorded
+var RedactedHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Slack-Signature",
+}
+
+// redactedBody matches tokens in form encoded, json and url encoded json bodies
+var redactedBody = []*regexp.Regexp{
+	regexp.MustCompile(`((?:^|&)(?:token|code|client_secret)=)[^&]*`),
+	regexp.MustCompile(`("(?:token|bot_access_token|access_token|client_secret)"\s*:\s*")[^"]*`),
+	regexp.MustCompile(`(%22(?:token|bot_access_token|access_token|client_secret)%22%3A%22)[^%]*`),
+}
+
+// Recording is a relayed request and the response, or error, it got
+type Recording struct {
+	Time     time.Time     `json:"time"`
+	Duration time.Duration `json:"duration"`
+	Request  *FauxRequest  `json:"request"`
+	Response *Response     `json:"response,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Recorder writes the requests relayed by a passthrough and their responses to a file, one json
+// recording per line, with secrets redacted. Once the file reaches its maximum size it is rotated,
+// the previous files are kept as file.1 (the most recent) up to file.N.
+type Recorder struct {
+	recorded int64
+	failures int64
+
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+// RecorderStatus describes the recorder
+type RecorderStatus struct {
+	Path     string `json:"path"`
+	Recorded int64  `json:"recorded"`
+	Failures int64  `json:"failures,omitempty"`
+}
+
+// NewRecorder appends recordings to the file at path, rotating it once it is larger than maxSize bytes
+// and keeping at most maxFiles rotated files.
+func NewRecorder(path string, maxSize int64, maxFiles int) (*Recorder, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("invalid recording size %d", maxSize)
+	}
+	rec := &Recorder{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := rec.open(); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (rec *Recorder) open() error {
+	f, err := os.OpenFile(rec.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	rec.file, rec.size = f, info.Size()
+	return nil
+}
+
+// Record redacts and writes the recording
+func (rec *Recorder) Record(r Recording) error {
+	err := rec.record(r)
+	if err != nil {
+		atomic.AddInt64(&rec.failures, 1)
+		return err
+	}
+	atomic.AddInt64(&rec.recorded, 1)
+	return nil
+}
+
+func (rec *Recorder) record(r Recording) error {
+	r.Request = redactRequest(r.Request)
+	r.Response = redactResponse(r.Response)
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	if rec.file == nil {
+		return errors.New("recorder is closed")
+	}
+	if rec.size > 0 && rec.size+int64(len(b)) > rec.maxSize {
+		if err := rec.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := rec.file.Write(b)
+	rec.size += int64(n)
+	return err
+}
+
+// rotate moves file to file.1, file.1 to file.2 and so on, the oldest past maxFiles is removed
+func (rec *Recorder) rotate() error {
+	if err := rec.file.Close(); err != nil {
+		log.Println(err)
+	}
+	rec.file = nil
+	if rec.maxFiles < 1 {
+		if err := os.Remove(rec.path); err != nil {
+			return err
+		}
+		return rec.open()
+	}
+	if err := os.Remove(fmt.Sprintf("%s.%d", rec.path, rec.maxFiles)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := rec.maxFiles - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", rec.path, i), fmt.Sprintf("%s.%d", rec.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(rec.path, rec.path+".1"); err != nil {
+		return err
+	}
+	return rec.open()
+}
+
+// Close closes the recording file, later recordings fail
+func (rec *Recorder) Close() error {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	if rec.file == nil {
+		return nil
+	}
+	err := rec.file.Close()
+	rec.file = nil
+	return err
+}
+
+func (rec *Recorder) status() *RecorderStatus {
+	return &RecorderStatus{
+		Path:     rec.path,
+		Recorded: atomic.LoadInt64(&rec.recorded),
+		Failures: atomic.LoadInt64(&rec.failures),
+	}
+}
+
+// redactRequest returns a copy of the request with secret headers, form values and body tokens redacted
+func redactRequest(req *FauxRequest) *FauxRequest {
+	if req == nil {
+		return nil
+	}
+	out := *req
+	out.Header = redactHeader(req.Header)
+	if req.Form != nil {
+		out.Form = make(map[string][]string, len(req.Form))
+		for k, v := range req.Form {
+			out.Form[k] = v
+		}
+		for _, k := range []string{"token", "code", "client_secret"} {
+			if _, ok := out.Form[k]; ok {
+				out.Form[k] = []string{Redacted}
+			}
+		}
+	}
+	out.Body = redactBody(req.Body)
+	if req.ContentLength == int64(len(req.Body)) {
+		out.ContentLength = int64(len(out.Body))
+	}
+	if req.URL != nil {
+		u := *req.URL
+		u.RawQuery = string(redactBody([]byte(u.RawQuery)))
+		out.URL = &u
+	}
+	out.Timeout, out.BodyEncoding, out.AcceptEncoding = 0, "", ""
+	return &out
+}
+
+// redactResponse returns a copy of the response with secret headers and body tokens redacted
+func redactResponse(resp *Response) *Response {
+	if resp == nil {
+		return nil
+	}
+	return &Response{Status: resp.Status, Headers: redactHeader(resp.Headers), Body: redactBody(resp.Body)}
+}
+
+func redactHeader(h http.Header) http.Header {
+	if h == nil {
+		return nil
+	}
+	out := h.Clone()
+	for _, k := range RedactedHeaders {
+		if out.Get(k) != "" {
+			out.Set(k, Redacted)
+		}
+	}
+	return out
+}
+
+func redactBody(body []byte) []byte {
+	for _, rx := range redactedBody {
+		body = rx.ReplaceAll(body, []byte("${1}"+Redacted))
+	}
+	return body
+}
+
+// SetRecorder records every request sent through RelayHandler and BufferedRelayHandler, and its response.
+// The recorder is closed with the relay.
+func (r *Relay) SetRecorder(rec *Recorder) {
+	r.recorder = rec
+}
+
+// record writes the relayed request to the recorder, if there is one
+func (r *Relay) record(start time.Time, faux *FauxRequest, resp *Response, err error) {
+	if r.recorder == nil {
+		return
+	}
+	rec := Recording{Time: start, Duration: time.Since(start), Request: faux, Response: resp}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if err := r.recorder.Record(rec); err != nil {
+		log.Println("failed to record relay request:", err)
+	}
+}
+
+// ReadRecordings reads the recordings written by a Recorder
+func ReadRecordings(in io.Reader) ([]Recording, error) {
+	var out []Recording
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), maxDecompressedSize)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec Recording
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("invalid recording on line %d: %v", line, err)
+		}
+		if rec.Request == nil {
+			return nil, fmt.Errorf("invalid recording on line %d: no request", line)
+		}
+		out = append(out, rec)
+	}
+	return out, scanner.Err()
+}
+
+// ReplayResult is a recording and the response its request got when replayed
+type ReplayResult struct {
+	Recording Recording
+	Response  *Response
+	Err       error
+}
+
+// Matches reports whether the replayed request got the recorded status and body
+func (r ReplayResult) Matches() bool {
+	if r.Recording.Error != "" || r.Err != nil {
+		return r.Recording.Error != "" && r.Err != nil
+	}
+	if r.Recording.Response == nil || r.Response == nil {
+		return false
+	}
+	return r.Recording.Response.Status == r.Response.Status &&
+		string(r.Recording.Response.Body) == string(r.Response.Body)
+}
+
+// Replay sends each recorded request, in the order they were recorded, to the handlers registered with
+// HandleFunc as though it was relayed from a passthrough, one at a time and without a deadline.
+// If prepare is not nil it may alter each request before it is handled, e.g. to sign it again
+// since signatures are redacted from recordings. The relay does not need to be connected.
+func (r *Relay) Replay(recordings []Recording, prepare func(*FauxRequest)) []ReplayResult {
+	results := make([]ReplayResult, 0, len(recordings))
+	for _, rec := range recordings {
+		req := *rec.Request
+		req.Header = rec.Request.Header.Clone()
+		if req.Header == nil {
+			req.Header = http.Header{}
+		}
+		req.Timeout, req.BodyEncoding, req.AcceptEncoding = 0, "", ""
+		if prepare != nil {
+			prepare(&req)
+		}
+		resp := &Response{}
+		err := r.relayer.RelayRequest(req, resp)
+		if err != nil {
+			resp = nil
+		}
+		results = append(results, ReplayResult{Recording: rec, Response: resp, Err: err})
+	}
+	return results
+}
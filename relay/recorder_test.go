@@ -0,0 +1,178 @@
+package relay
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{"slash command", "token=abc123&team_id=T1&text=hi", "token=REDACTED&team_id=T1&text=hi"},
+		{"event", `{"token": "abc123","type":"event_callback"}`, `{"token": "REDACTED","type":"event_callback"}`},
+		{"interaction", "payload=%7B%22token%22%3A%22abc123%22%2C%22type%22%3A%22block_actions%22%7D",
+			"payload=%7B%22token%22%3A%22REDACTED%22%2C%22type%22%3A%22block_actions%22%7D"},
+		{"nothing to redact", `{"type":"url_verification"}`, `{"type":"url_verification"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			header.Set("X-Slack-Signature", "v0=secret")
+			header.Set("X-Slack-Request-Timestamp", "1600000000")
+			req := &FauxRequest{
+				Method:        http.MethodPost,
+				URL:           &url.URL{Path: "/slack/callback", RawQuery: "code=secret&state=s1"},
+				Header:        header,
+				Body:          []byte(tt.body),
+				ContentLength: int64(len(tt.body)),
+			}
+			out := redactRequest(req)
+			assert.Equal(t, tt.expected, string(out.Body))
+			assert.Equal(t, int64(len(tt.expected)), out.ContentLength)
+			assert.Equal(t, Redacted, out.Header.Get("X-Slack-Signature"))
+			assert.Equal(t, "1600000000", out.Header.Get("X-Slack-Request-Timestamp"))
+			assert.Equal(t, "code=REDACTED&state=s1", out.URL.RawQuery)
+
+			// the relayed request is untouched
+			assert.Equal(t, tt.body, string(req.Body))
+			assert.Equal(t, "v0=secret", req.Header.Get("X-Slack-Signature"))
+			assert.Equal(t, "code=secret&state=s1", req.URL.RawQuery)
+		})
+	}
+}
+
+func TestRecorder_Rotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "relay.rec")
+
+	rec, err := NewRecorder(path, 2048, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		req := &FauxRequest{Method: http.MethodPost, URL: &url.URL{Path: "/slack/event"}, Body: bytes.Repeat([]byte("x"), 100)}
+		assert.NoError(t, rec.Record(Recording{Request: req, Response: &Response{Status: http.StatusOK}}))
+	}
+	assert.NoError(t, rec.Close())
+	assert.Error(t, rec.Record(Recording{Request: &FauxRequest{}}))
+	assert.Equal(t, &RecorderStatus{Path: path, Recorded: 20, Failures: 1}, rec.status())
+
+	files, err := filepath.Glob(path + "*")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{path, path + ".1", path + ".2"}, files)
+	for _, f := range files {
+		info, err := os.Stat(f)
+		assert.NoError(t, err)
+		assert.True(t, info.Size() <= 2048, f)
+
+		b, err := ioutil.ReadFile(f)
+		assert.NoError(t, err)
+		recordings, err := ReadRecordings(bytes.NewReader(b))
+		assert.NoError(t, err)
+		assert.NotEmpty(t, recordings)
+	}
+
+	_, err = ReadRecordings(strings.NewReader("not json\n"))
+	assert.Error(t, err)
+}
+
+func TestRelay_RecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "relay.rec")
+
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Resigned", strconv.FormatBool(r.Header.Get("X-Slack-Signature") == "v0=resigned"))
+		_, _ = w.Write([]byte(strings.ToUpper(r.FormValue("text"))))
+	}
+	src, dst := connectedRelays(t, 5041, "/echo", echo)
+	defer dst.Close()
+	rec, err := NewRecorder(path, 1<<20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.SetRecorder(rec)
+
+	relayServer := httptest.NewServer(http.HandlerFunc(src.RelayHandler))
+	defer relayServer.Close()
+	for _, body := range []string{"token=abc&text=one", "text=two", "text=three"} {
+		req, err := http.NewRequest(http.MethodPost, relayServer.URL+"/echo", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Slack-Signature", "v0=secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+	}
+	assert.Equal(t, int64(3), src.Status().Recorder.Recorded)
+	src.Close()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, string(b), "secret")
+	assert.NotContains(t, string(b), "abc")
+	recordings, err := ReadRecordings(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Len(t, recordings, 3) {
+		return
+	}
+	assert.Equal(t, "TWO", string(recordings[1].Response.Body))
+	assert.Equal(t, "false", recordings[1].Response.Headers.Get("X-Resigned"))
+
+	// replay against a handler that is not connected to anything
+	local := NewRelay("", 0, ".+", Handler, nil)
+	if err := local.Init(); err != nil {
+		t.Fatal(err)
+	}
+	local.HandleFunc("/echo", echo)
+	results := local.Replay(recordings, func(req *FauxRequest) {
+		req.Header.Set("X-Slack-Signature", "v0=resigned")
+	})
+	if assert.Len(t, results, 3) {
+		for _, res := range results {
+			assert.NoError(t, res.Err)
+			assert.True(t, res.Matches(), string(res.Response.Body))
+			assert.Equal(t, "true", res.Response.Headers.Get("X-Resigned"))
+		}
+	}
+
+	// a handler that behaves differently is reported
+	changed := NewRelay("", 0, ".+", Handler, nil)
+	if err := changed.Init(); err != nil {
+		t.Fatal(err)
+	}
+	changed.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	for _, res := range changed.Replay(recordings, nil) {
+		assert.False(t, res.Matches())
+	}
+}
@@ -2,6 +2,7 @@ package relay
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -14,59 +15,140 @@ import (
 	"net/url"
 	"regexp"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/atsu/goat/build"
 	"github.com/atsu/goat/health"
 	"github.com/gorilla/mux"
 	"github.com/zserge/metric"
 )
 
 // Response is a container that encapsulates a response from a relayed request
+// Response records what a handler writes so it can be sent back over the relay, it behaves like
+// the net/http response writer: headers are fixed once the status is written and writes append to the body.
 type Response struct {
-	Status int
-	Body   []byte
+	Status       int
+	Headers      http.Header // headers as they were when the status was written
+	Body         []byte
+	BodyEncoding string // set while the body is compressed for the relay
+
+	header      http.Header
+	wroteHeader bool
+	read        int
 }
 
 var _ http.ResponseWriter = &Response{}
 var _ io.Reader = &Response{}
 
 func (r *Response) Header() http.Header {
-	return http.Header{}
+	if r.header == nil {
+		r.header = http.Header{}
+	}
+	return r.header
 }
 
 func (r *Response) Write(b []byte) (int, error) {
-	r.Body = make([]byte, len(b))
-	return copy(r.Body, b), nil
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	r.Body = append(r.Body, b...)
+	return len(b), nil
 }
 
 func (r *Response) Read(p []byte) (int, error) {
-	// Is one shot body copy enough?
-	// if not, we might need to track how many bytes were copied to pick up where
-	// we left off in a subsequent call
-	return copy(p, r.Body), io.EOF
+	if r.read >= len(r.Body) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.Body[r.read:])
+	r.read += n
+	return n, nil
 }
 
+// WriteHeader records the status and a snapshot of the headers, later calls are ignored
 func (r *Response) WriteHeader(statusCode int) {
+	if r.wroteHeader {
+		return
+	}
+	r.wroteHeader = true
 	r.Status = statusCode
+	r.Headers = r.Header().Clone()
+}
+
+// finish completes a response the handler returned from without writing, as net/http would
+func (r *Response) finish() {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+}
+
+// encode compresses the body for the trip back over the relay, if the requester accepts the encoding
+func (r *Response) encode(c *compressor, accept string) {
+	r.Body, r.BodyEncoding = c.compress(r.Body, accept)
+}
+
+// decode reverses encode
+func (r *Response) decode(c *compressor) error {
+	body, err := c.decompress(r.Body, r.BodyEncoding)
+	if err != nil {
+		return err
+	}
+	r.Body, r.BodyEncoding = body, ""
+	return nil
 }
 
+// WriteResponse copies the recorded status, headers and body to w
+func (r *Response) WriteResponse(w http.ResponseWriter) error {
+	for k, v := range r.Headers {
+		w.Header()[k] = v
+	}
+	status := r.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	_, err := w.Write(r.Body)
+	return err
+}
+
+// DefaultRequestTimeout is the time budget given to a relayed request when the incoming
+// request does not carry a tighter deadline, slack expects a response within 3 seconds.
+const DefaultRequestTimeout = 2500 * time.Millisecond
+
+// handshakeTimeout bounds how long a new relay connection may take to establish itself
+const handshakeTimeout = 10 * time.Second
+
+// ErrRelayTimeout is returned when a relayed request does not complete before its deadline
+var ErrRelayTimeout = errors.New("relay request timed out")
+
+// ErrNoHandler is returned when there is no handler connected that can take a relayed request
+var ErrNoHandler = errors.New("relay failed, no handler available")
+
 // Relayer is an internal object specifically for relaying requests via rpc.
 // it must be exported to enable registering as an rpc
 type Relayer struct {
+	inFlight int64
+	draining int32
+
 	router   *mux.Router
 	lastPing time.Time
 
-	relayhook func()
+	relayhook   func()
+	timeouthook func()
+	healthhook  func() *HealthSummary
+	compressor  *compressor
 }
 
 // creating a new relayer should never happen outside of this package
 // the relay hook allows the Relay to execute a function when the request is being relayed
-// useful for counting the number of relayed requests
-func newRelayer(hook func()) *Relayer {
+// useful for counting the number of relayed requests, the timeout hook is executed when a
+// relayed request runs past its deadline.
+func newRelayer(hook, timeouthook func()) *Relayer {
 	return &Relayer{
-		router:    mux.NewRouter(),
-		lastPing:  time.Unix(0, 0),
-		relayhook: hook,
+		router:      mux.NewRouter(),
+		lastPing:    time.Unix(0, 0),
+		relayhook:   hook,
+		timeouthook: timeouthook,
 	}
 }
 
@@ -80,24 +162,86 @@ const RelayerRelayRequest = "Relayer.RelayRequest"
 // RelayRequest calls a local handler with a relayed request, this should only
 // be called by the RelayHandler, the method signature should not change as it
 // is required to satisfy the rpc.Register receiver input
+//
+// When the request carries a timeout, the handler is given a request context with
+// that deadline, if the handler has not finished by then ErrRelayTimeout is returned
+// and anything the handler writes afterwards is discarded.
 func (r *Relayer) RelayRequest(req FauxRequest, response *Response) error {
 	r.relayhook()
+	atomic.AddInt64(&r.inFlight, 1)
+	defer atomic.AddInt64(&r.inFlight, -1)
+	body, err := r.compressor.decompress(req.Body, req.BodyEncoding)
+	if err != nil {
+		return err
+	}
+	req.Body, req.BodyEncoding = body, ""
 	match := &mux.RouteMatch{}
-	if r.router.Match(req.Request(), match) {
-		match.Handler.ServeHTTP(response, req.Request())
-	} else {
+	base := context.Background()
+	if req.QueuedAt > 0 {
+		base = context.WithValue(base, queuedAtKey{}, time.Unix(req.QueuedAt, 0))
+	}
+	hreq := req.Request().WithContext(base)
+	if !r.router.Match(hreq, match) {
 		return match.MatchErr
 	}
-	return nil
+	if req.Timeout <= 0 {
+		match.Handler.ServeHTTP(response, hreq)
+		response.finish()
+		response.encode(r.compressor, req.AcceptEncoding)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(base, req.Timeout)
+	defer cancel()
+	local := &Response{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		match.Handler.ServeHTTP(local, hreq.WithContext(ctx))
+	}()
+	select {
+	case <-done:
+		local.finish()
+		*response = *local
+		response.encode(r.compressor, req.AcceptEncoding)
+		return nil
+	case <-ctx.Done():
+		if r.timeouthook != nil {
+			r.timeouthook()
+		}
+		return ErrRelayTimeout
+	}
+}
+
+type queuedAtKey struct{}
+
+// QueuedAt returns when the passthrough queued a relayed request while no handler was connected,
+// false for a request relayed as it arrived or one that wasn't relayed
+func QueuedAt(req *http.Request) (time.Time, bool) {
+	at, ok := req.Context().Value(queuedAtKey{}).(time.Time)
+	return at, ok
 }
 
 // Rpc call handle
 const RelayerPing = "Relayer.Ping"
 
-// Ping is used to check if the Relay is still isConnected
+const (
+	// PingReply is the reply to a Ping from a handler accepting requests
+	PingReply = "pong"
+
+	// DrainReply is the reply to a Ping from a handler that is shutting down
+	DrainReply = "draining"
+)
+
+// Ping is used to check if the Relay is still isConnected, the reply tells the
+// passthrough whether this handler is still accepting requests.
 func (r *Relayer) Ping(t time.Time, recv *string) error {
 	r.lastPing = t
-	*recv = "pong"
+	if atomic.LoadInt32(&r.draining) == 1 {
+		*recv = DrainReply
+	} else {
+		*recv = PingReply
+	}
 	return nil
 }
 
@@ -126,21 +270,32 @@ const (
 
 // Relay
 type Relay struct {
-	Host      string
-	Port      int
-	WhiteList *regexp.Regexp
-	Mode      RelayMode
-	Debug     bool
-	conf      *tls.Config
+	Host  string
+	Port  int
+	Mode  RelayMode
+	Debug bool
+	conf  *tls.Config
 
 	relayer *Relayer
+	info    build.Info
+	secret  []byte
 
-	checkInterval time.Duration
+	checkInterval  time.Duration
+	requestTimeout time.Duration
+	drainTimeout   time.Duration
 
-	rpcsCounter    metric.Metric
-	connectCounter metric.Metric
-	pingHistogram  metric.Metric
-	rpcHistogram   metric.Metric
+	rpcsCounter     metric.Metric
+	connectCounter  metric.Metric
+	timeoutsCounter metric.Metric
+	failuresCounter metric.Metric
+	pingHistogram   metric.Metric
+	rpcHistogram    metric.Metric
+
+	inFlight      int64
+	timeoutCount  int64
+	failureCount  int64
+	replayedCount int64
+	replaying     int32
 
 	lock            sync.Mutex
 	isConnected     bool
@@ -148,37 +303,70 @@ type Relay struct {
 	disconnectTimes []int64
 	connectTime     int64
 	connectCnt      int64
+	connections     int
+	acl             *AccessList
+	rejectedCount   int64
+	rejected        []RejectedConn
+	handshakeErrors int64
+	handshakeError  string
+	peerInfo        *PeerInfo            // handler only
+	backoff         Backoff              // handler only
+	healthFunc      func() HealthSummary // handler only
+	connState       ConnState            // handler only
+	nextAttempt     time.Time            // handler only
+
+	compressor     *compressor
+	egressStats    *egressStats
+	egressEnabled  bool              // handler only
+	egressClient   *rpc.Client       // handler only
+	egressEncoding string            // handler only, body encoding negotiated on the egress connection
+	egressServer   *rpc.Server       // passthrough only, nil unless enabled
+	egressConns    map[net.Conn]bool // passthrough only
 
+	wg        sync.WaitGroup // tracks handleConn and the listener
 	doneCh    chan struct{}
-	rpcClient *rpc.Client
+	queue     *requestQueue // passthrough only, nil unless enabled
+	recorder  *Recorder     // passthrough only, nil unless enabled
+	handlers  handlerPool   // passthrough only
+	conn      net.Conn      // handler only
 	rpcServer *rpc.Server
 }
 
 func NewRelay(host string, port int, whitelist string, mode RelayMode, conf *tls.Config) *Relay {
 
 	r := &Relay{
-		Host:      host,
-		Port:      port,
-		WhiteList: regexp.MustCompile(whitelist),
-		Mode:      mode,
-		conf:      conf,
+		Host: host,
+		Port: port,
+		Mode: mode,
+		conf: conf,
+		acl:  &AccessList{pattern: regexp.MustCompile(whitelist)},
 
 		connectTimes:    make([]int64, 0, 100),
 		disconnectTimes: make([]int64, 0, 100),
 		rpcsCounter:     metric.NewCounter("1h1h"),   // 1 hour history, 1 hour precision
 		connectCounter:  metric.NewCounter("1h1h"),   // 1 hour history, 1 hour precision
+		timeoutsCounter: metric.NewCounter("1h1h"),   // 1 hour history, 1 hour precision
+		failuresCounter: metric.NewCounter("1h1h"),   // 1 hour history, 1 hour precision
 		pingHistogram:   metric.NewHistogram("1h1h"), // 1 hour history, 1 hour precision
 		rpcHistogram:    metric.NewHistogram("1h1h"), // 1 hour history, 1 hour precision
 
-		checkInterval: time.Second * 2,
-		doneCh:        make(chan struct{}),
+		checkInterval:  time.Second * 2,
+		requestTimeout: DefaultRequestTimeout,
+		drainTimeout:   time.Second * 5,
+		backoff:        DefaultBackoff,
+		compressor:     &compressor{threshold: DefaultCompressThreshold},
+		egressStats:    newEgressStats(),
+		egressConns:    make(map[net.Conn]bool),
+		doneCh:         make(chan struct{}),
 	}
 	return r
 }
 
 // Init is used to initialize the relay
 func (r *Relay) Init() error {
-	r.relayer = newRelayer(func() { r.rpcsCounter.Add(1) })
+	r.relayer = newRelayer(func() { r.rpcsCounter.Add(1) }, r.recordTimeout)
+	r.relayer.healthhook = r.localHealth
+	r.relayer.compressor = r.compressor
 	if r.Mode == Handler {
 		r.rpcServer = rpc.NewServer()
 		if err := r.rpcServer.Register(r.relayer); err != nil {
@@ -198,6 +386,33 @@ func (r *Relay) SetCheckInterval(duration time.Duration) {
 	r.checkInterval = duration
 }
 
+// SetInfo sets the build info presented to the peer during the handshake
+func (r *Relay) SetInfo(info build.Info) {
+	r.info = info
+}
+
+// SetSecret sets the secret shared by the passthrough and its handlers, when set the peer must prove
+// it holds the same secret during the handshake. An empty secret disables authentication.
+func (r *Relay) SetSecret(secret string) {
+	r.secret = []byte(secret)
+}
+
+// SetBackoff sets how long a handler waits between connection attempts
+func (r *Relay) SetBackoff(b Backoff) {
+	r.backoff = b
+}
+
+// SetDrainTimeout sets how long a handler waits for in-flight requests to finish when closing
+func (r *Relay) SetDrainTimeout(duration time.Duration) {
+	r.drainTimeout = duration
+}
+
+// SetRequestTimeout sets the upper bound on how long a relayed request may take,
+// a tighter deadline on the incoming request takes precedence.
+func (r *Relay) SetRequestTimeout(duration time.Duration) {
+	r.requestTimeout = duration
+}
+
 func (r *Relay) LastPingTime() time.Time {
 	if r.relayer != nil {
 		return r.relayer.lastPing
@@ -207,17 +422,39 @@ func (r *Relay) LastPingTime() time.Time {
 
 // RelayStatus describes the health of the relay
 type RelayStatus struct {
-	Health          health.State `json:"health"`
-	Mode            string       `json:"mode"`
-	LastPingTime    int64        `json:"lastPingTime,omitempty"`
-	Connected       bool         `json:"isConnected"`
-	ConnectTime     int64        `json:"connectTime,omitempty"`
-	ConnectCount    int64        `json:"connectCount,omitempty"`
-	RpcCount        int64        `json:"rpcCount,omitempty"`
-	RpcsCounter     interface{}  `json:"rpcsCounter,omitempty"`
-	ConnectCounter  interface{}  `json:"connectCounter,omitempty"`
-	RpcLatencySecs  interface{}  `json:"rpcLatencySecs,omitempty"`
-	PingLatencySecs interface{}  `json:"pingLatencySecs,omitempty"`
+	Health          health.State       `json:"health"`
+	HealthMessage   string             `json:"healthMessage,omitempty"`
+	Mode            string             `json:"mode"`
+	LastPingTime    int64              `json:"lastPingTime,omitempty"`
+	Connected       bool               `json:"isConnected"`
+	ConnectTime     int64              `json:"connectTime,omitempty"`
+	ConnectCount    int64              `json:"connectCount,omitempty"`
+	RpcCount        int64              `json:"rpcCount,omitempty"`
+	InFlight        int64              `json:"inFlight"`
+	TimeoutCount    int64              `json:"timeoutCount,omitempty"`
+	FailureCount    int64              `json:"failureCount,omitempty"`
+	RpcsCounter     interface{}        `json:"rpcsCounter,omitempty"`
+	ConnectCounter  interface{}        `json:"connectCounter,omitempty"`
+	TimeoutsCounter interface{}        `json:"timeoutsCounter,omitempty"`
+	FailuresCounter interface{}        `json:"failuresCounter,omitempty"`
+	RpcLatencySecs  interface{}        `json:"rpcLatencySecs,omitempty"`
+	PingLatencySecs interface{}        `json:"pingLatencySecs,omitempty"`
+	Handlers        []HandlerStatus    `json:"handlers,omitempty"`
+	State           ConnState          `json:"state,omitempty"`
+	NextAttempt     int64              `json:"nextAttempt,omitempty"`
+	Protocol        int                `json:"protocol"`
+	Peer            *PeerInfo          `json:"peer,omitempty"`
+	HandshakeErrors int64              `json:"handshakeErrors,omitempty"`
+	HandshakeError  string             `json:"handshakeError,omitempty"`
+	Egress          *EgressStatus      `json:"egress,omitempty"`
+	Compression     *CompressionStatus `json:"compression,omitempty"`
+	Recorder        *RecorderStatus    `json:"recorder,omitempty"`
+	QueueDepth      int                `json:"queueDepth,omitempty"`
+	QueueDropped    int64              `json:"queueDropped,omitempty"`
+	QueueReplayed   int64              `json:"queueReplayed,omitempty"`
+	QueueRejected   int64              `json:"queueRejected,omitempty"`
+	RejectedCount   int64              `json:"rejectedCount,omitempty"`
+	Rejected        []RejectedConn     `json:"rejected,omitempty"`
 }
 
 // Status create and return a RelayStatus for the current status
@@ -227,18 +464,56 @@ func (r *Relay) Status() RelayStatus {
 		h = health.Red
 	}
 	status := RelayStatus{
-		Health:         h,
-		Mode:           r.Mode.String(),
-		LastPingTime:   r.LastPingTime().Unix(),
-		Connected:      r.isConnected,
-		ConnectTime:    r.connectTime,
-		RpcsCounter:    r.rpcsCounter,
-		ConnectCounter: r.connectCounter,
-		ConnectCount:   r.connectCnt,
+		Health:          h,
+		Mode:            r.Mode.String(),
+		LastPingTime:    r.LastPingTime().Unix(),
+		Connected:       r.isConnected,
+		ConnectTime:     r.connectTime,
+		InFlight:        atomic.LoadInt64(&r.inFlight),
+		TimeoutCount:    atomic.LoadInt64(&r.timeoutCount),
+		FailureCount:    atomic.LoadInt64(&r.failureCount),
+		RpcsCounter:     r.rpcsCounter,
+		ConnectCounter:  r.connectCounter,
+		TimeoutsCounter: r.timeoutsCounter,
+		FailuresCounter: r.failuresCounter,
+		ConnectCount:    r.connectCnt,
+		Protocol:        ProtocolVersion,
 	}
+	r.lock.Lock()
+	status.HandshakeErrors = r.handshakeErrors
+	status.HandshakeError = r.handshakeError
+	if r.egressEnabled || r.egressServer != nil {
+		status.Egress = r.egressStats.status()
+	}
+	if r.compressor != nil {
+		status.Compression = r.compressor.status()
+	}
+	if r.Mode == Handler {
+		status.Peer = r.peerInfo
+		status.State = r.connState
+		if !r.nextAttempt.IsZero() {
+			status.NextAttempt = r.nextAttempt.Unix()
+		}
+	}
+	r.lock.Unlock()
 	if r.Mode == PassThrough {
 		status.RpcLatencySecs = r.rpcHistogram
 		status.PingLatencySecs = r.pingHistogram
+		status.Handlers = r.handlers.status()
+		status.Health, status.HealthMessage = handlersHealth(status.Handlers)
+		r.lock.Lock()
+		status.RejectedCount = r.rejectedCount
+		status.Rejected = append([]RejectedConn(nil), r.rejected...)
+		r.lock.Unlock()
+		if r.recorder != nil {
+			status.Recorder = r.recorder.status()
+		}
+		if r.queue != nil {
+			status.QueueDepth = r.queue.Len()
+			status.QueueDropped = r.queue.Dropped()
+			status.QueueReplayed = atomic.LoadInt64(&r.replayedCount)
+			status.QueueRejected = r.queue.Rejected()
+		}
 	}
 	return status
 }
@@ -250,7 +525,9 @@ func (r *Relay) HandleFunc(path string, f func(http.ResponseWriter, *http.Reques
 }
 
 // RelayHandler takes the place of an actual handler to glue an existing http server to the Relay
-// invoking this handler will forward the request directly to a relay in handle mode
+// invoking this handler will forward the request directly to a relay in handle mode.
+// The request is given a deadline derived from the incoming request, if the relayed request
+// does not complete in time the response is a 504 rather than a relay failure.
 func (r *Relay) RelayHandler(w http.ResponseWriter, req *http.Request) {
 	if r.Debug {
 		log.Println("Relaying Request from:", req.URL.String())
@@ -260,47 +537,274 @@ func (r *Relay) RelayHandler(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, "invalid body", http.StatusBadRequest)
 		return
 	}
-	faux := CreateFauxRequest(req, body)
-	resp := &Response{}
-	if r.rpcClient == nil {
-		err = errors.New("relay failed, no rpc client")
-	} else {
-		start := time.Now()
-		err = r.rpcClient.Call(RelayerRelayRequest, faux, &resp)
-		if err != nil {
-			log.Println(err)
-		}
-		r.rpcsCounter.Add(1)
+	r.serve(req.Context(), w, CreateFauxRequest(req, body), false)
+}
 
-		duration := time.Since(start)
-		r.rpcHistogram.Add(duration.Seconds())
-		if r.Debug {
-			log.Println("RPC took:", duration.String())
-		}
+// BufferedRelayHandler behaves like RelayHandler, except that when no handler is connected the request
+// is acknowledged and stored in the relay queue, to be replayed in order once a handler connects.
+// This should only be used for endpoints where the caller needs nothing back but the acknowledgement.
+func (r *Relay) BufferedRelayHandler(w http.ResponseWriter, req *http.Request) {
+	if r.queue == nil {
+		r.RelayHandler(w, req)
+		return
 	}
+	if r.Debug {
+		log.Println("Relaying Request from:", req.URL.String())
+	}
+	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	faux := CreateFauxRequest(req, body)
+	if r.queue.Len() > 0 {
+		// keep the order, requests wait their turn behind anything already queued
+		r.enqueue(w, faux)
+		return
+	}
+	r.serve(req.Context(), w, faux, true)
+}
+
+// serve relays the request and writes the response, when buffered a request that has no handler to go to is queued
+func (r *Relay) serve(ctx context.Context, w http.ResponseWriter, faux *FauxRequest, buffered bool) {
+	ctx, cancel := context.WithTimeout(ctx, r.requestTimeout)
+	defer cancel()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		faux.Timeout = time.Until(deadline)
+	}
+	start := time.Now()
+	resp, err := r.relay(ctx, faux)
+	r.record(start, faux, resp, err)
+	switch {
+	case err == ErrRelayTimeout:
+		log.Println(err)
+		http.Error(w, "relay timeout", http.StatusGatewayTimeout)
+		return
+	case err == ErrNoHandler && buffered:
+		r.enqueue(w, faux)
+		return
+	case err != nil:
+		log.Println(err)
+		r.recordFailure()
+		http.Error(w, "relay failure", http.StatusInternalServerError)
+		return
+	}
+	if err := resp.WriteResponse(w); err != nil {
 		log.Println(err)
+	}
+}
+
+// enqueue stores the request for replay and acknowledges it, the handler is told when it was queued
+// so a request that was fresh then isn't refused as stale once it is replayed
+func (r *Relay) enqueue(w http.ResponseWriter, faux *FauxRequest) {
+	faux.QueuedAt = time.Now().Unix()
+	if err := r.queue.Push(faux); err != nil {
+		log.Println("failed to queue relay request:", err)
+		r.recordFailure()
 		http.Error(w, "relay failure", http.StatusInternalServerError)
 		return
 	}
-	if resp.Status == 0 {
-		resp.Status = 200
+	if r.Debug {
+		log.Printf("queued relay request %s, queue depth: %d\n", faux.URL, r.queue.Len())
 	}
-	w.WriteHeader(resp.Status)
-	if _, err := w.Write(resp.Body); err != nil {
+	if _, err := w.Write([]byte(`{"status":"queued"}`)); err != nil {
 		log.Println(err)
 	}
+	// a handler may have connected while this was being queued
+	go r.replayQueue()
+}
+
+// replayQueue sends queued requests, oldest first, while there is a handler to take them.
+// A request the handler failed, timed out on or refused as unauthorized is kept aside in the queue's
+// rejected directory, so a request that can never succeed doesn't hold up the rest of the queue.
+// If no handler takes a request the replay stops, the next connect or queued request resumes it.
+func (r *Relay) replayQueue() {
+	if r.queue == nil {
+		return
+	}
+	for atomic.CompareAndSwapInt32(&r.replaying, 0, 1) {
+		for r.handlers.available() > 0 {
+			select {
+			case <-r.doneCh:
+				atomic.StoreInt32(&r.replaying, 0)
+				return
+			default:
+			}
+			item := r.queue.Peek()
+			if item == nil {
+				break
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), r.requestTimeout)
+			item.Request.Timeout = r.requestTimeout
+			resp, err := r.relay(ctx, item.Request)
+			cancel()
+			if err == ErrNoHandler {
+				// a handler that is gone but not yet noticed still counts as available, don't spin on it
+				atomic.StoreInt32(&r.replaying, 0)
+				return
+			}
+			if err != nil {
+				log.Printf("replay of queued request %s failed, kept in %s: %v\n", item.Request.URL, r.queue.rejectedDir(), err)
+				r.queue.Reject(item)
+				continue
+			}
+			if resp.Status == http.StatusUnauthorized {
+				log.Printf("replay of queued request %s was refused as unauthorized, kept in %s\n", item.Request.URL, r.queue.rejectedDir())
+				r.queue.Reject(item)
+				continue
+			}
+			r.queue.Remove(item)
+			atomic.AddInt64(&r.replayedCount, 1)
+		}
+		atomic.StoreInt32(&r.replaying, 0)
+		// check again in case something was queued after the last peek
+		if r.queue.Len() == 0 || r.handlers.available() == 0 {
+			return
+		}
+	}
+}
+
+// SetQueue enables queueing requests received by the BufferedRelayHandler while no handler
+// is connected, requests are stored in dir and at most size requests are kept.
+func (r *Relay) SetQueue(dir string, size int) error {
+	q, err := newRequestQueue(dir, size)
+	if err != nil {
+		return err
+	}
+	r.queue = q
+	if q.Len() > 0 {
+		log.Printf("relay queue has %d requests waiting for a handler\n", q.Len())
+	}
+	return nil
+}
+
+// relay sends the request to the least busy handler without waiting on any other in-flight requests,
+// if the handler connection fails the request is retried against the remaining handlers.
+// If the context is done before the response arrives ErrRelayTimeout is returned.
+func (r *Relay) relay(ctx context.Context, faux *FauxRequest) (*Response, error) {
+	atomic.AddInt64(&r.inFlight, 1)
+	defer atomic.AddInt64(&r.inFlight, -1)
+
+	tried := make(map[*handlerConn]bool)
+	for {
+		h := r.handlers.pick(tried)
+		if h == nil {
+			if len(tried) > 0 {
+				log.Printf("relay failed, tried %d handler(s)\n", len(tried))
+			}
+			return nil, ErrNoHandler
+		}
+		tried[h] = true
+		resp, err := r.relayTo(ctx, h, faux)
+		if _, ok := err.(*unsentError); !ok {
+			// the handler may have the request, sending it to another could handle it twice
+			return resp, err
+		}
+		log.Printf("relay to handler %d (%s) failed: %v\n", h.id, h.addr, err)
+	}
+}
+
+// unsentError is a transport failure before the request was written to the handler, another handler can take it
+type unsentError struct {
+	err error
+}
+
+func (e *unsentError) Error() string {
+	return "request not sent: " + e.err.Error()
+}
+
+// notWritten reports whether the call failed because the request couldn't be written, the client was already
+// shut down or writing to the connection failed
+func notWritten(err error) bool {
+	var opErr *net.OpError
+	return err == rpc.ErrShutdown || (errors.As(err, &opErr) && opErr.Op == "write")
+}
+
+// callError returns the call's error, a handler timeout as ErrRelayTimeout
+func callError(call *rpc.Call) error {
+	if serr, ok := call.Error.(rpc.ServerError); ok && string(serr) == ErrRelayTimeout.Error() {
+		return ErrRelayTimeout
+	}
+	return call.Error
+}
+
+// relayTo makes the rpc call to a single handler
+func (r *Relay) relayTo(ctx context.Context, h *handlerConn, faux *FauxRequest) (*Response, error) {
+	atomic.AddInt64(&h.inFlight, 1)
+	defer atomic.AddInt64(&h.inFlight, -1)
+
+	start := time.Now()
+	if h.info != nil && h.info.Compression != "" {
+		encoded := *faux
+		encoded.AcceptEncoding = h.info.Compression
+		encoded.Body, encoded.BodyEncoding = r.compressor.compress(faux.Body, h.info.Compression)
+		faux = &encoded
+	}
+	resp := &Response{}
+	call := h.client.Go(RelayerRelayRequest, faux, resp, make(chan *rpc.Call, 1))
+	var err error
+	select {
+	case <-call.Done:
+		// Go writes the request before it returns, a call that is already done may not have been sent
+		if err = callError(call); notWritten(err) {
+			err = &unsentError{err}
+		}
+	default:
+		select {
+		case <-call.Done:
+			err = callError(call)
+		case <-ctx.Done():
+			err = ErrRelayTimeout
+		}
+	}
+	if err == nil {
+		err = resp.decode(r.compressor)
+	}
+	if err == ErrRelayTimeout {
+		r.recordTimeout()
+	}
+	r.rpcsCounter.Add(1)
+	atomic.AddInt64(&h.rpcCount, 1)
+
+	duration := time.Since(start)
+	r.rpcHistogram.Add(duration.Seconds())
+	h.rpcHistogram.Add(duration.Seconds())
+	if r.Debug {
+		log.Printf("RPC to handler %d took: %s\n", h.id, duration.String())
+	}
+	return resp, err
+}
+
+func (r *Relay) setPeer(conn net.Conn, info *PeerInfo) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.conn = conn
+	r.peerInfo = info
+}
+
+func (r *Relay) recordTimeout() {
+	atomic.AddInt64(&r.timeoutCount, 1)
+	r.timeoutsCounter.Add(1)
+}
+
+func (r *Relay) recordFailure() {
+	atomic.AddInt64(&r.failureCount, 1)
+	r.failuresCounter.Add(1)
 }
 
-// Listen opens the configured port and accepts a single tcp connection, if the connection drops
-// this will start listening again for another connection.
+// Listen opens the configured port and accepts connections from any number of handlers,
+// relayed requests are spread across the connected handlers.
 func (r *Relay) Listen() error {
 	lsc, err := tls.Listen("tcp", fmt.Sprintf(":%d", r.Port), r.conf)
 	if err != nil {
 		return err
 	}
 
+	// tracked so the port is free once Close returns
+	r.wg.Add(1)
 	go func() {
+		defer r.wg.Done()
 		<-r.doneCh
 		if err := lsc.Close(); err != nil {
 			log.Println(err)
@@ -313,7 +817,8 @@ func (r *Relay) Listen() error {
 			if err != nil {
 				return
 			} else {
-				r.handleConn(conn)
+				r.wg.Add(1)
+				go r.handleConn(conn, "")
 			}
 		}
 	}()
@@ -322,62 +827,220 @@ func (r *Relay) Listen() error {
 
 // Connect makes an outgoing request to connected to a listening Relay
 func (r *Relay) Connect() {
+	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
-		retry := 0
-		sleepDur := time.Duration(0)
-		for {
+		<-r.doneCh
+		cancel()
+	}()
+	r.wg.Add(1)
+	go r.dialLoop(ctx, ChannelRelay)
+	if r.egressEnabled {
+		r.wg.Add(1)
+		go r.dialLoop(ctx, ChannelEgress)
+	}
+}
+
+// dialLoop keeps a connection of the given channel to the passthrough until the relay is closed
+func (r *Relay) dialLoop(ctx context.Context, channel string) {
+	defer r.wg.Done()
+	target := fmt.Sprintf("%s:%d", r.Host, r.Port)
+	conf := &tls.Config{}
+	if r.conf != nil {
+		conf = r.conf.Clone()
+	}
+	if conf.ServerName == "" && !conf.InsecureSkipVerify {
+		conf.ServerName = r.Host
+	}
+	// only the relay channel drives the handler's connection state
+	setState := func(state ConnState, next time.Time) {
+		if channel == ChannelRelay {
+			r.setConnState(state, next)
+		}
+	}
+	dialer := &net.Dialer{Timeout: handshakeTimeout}
+	retry := 0
+	for {
+		if retry > 0 {
+			wait := r.backoff.Duration(retry - 1)
+			setState(StateBackingOff, time.Now().Add(wait))
+			log.Printf("retrying relay %s connection in %s\n", channel, wait)
 			select {
 			case <-r.doneCh:
 				return
-			default:
-			}
-			// basic back off logic max of 5s
-			if retry > 0 {
-				log.Printf("sleeping %s to retry\n", sleepDur)
-				time.Sleep(sleepDur)
-			}
-			target := fmt.Sprintf("%s:%d", r.Host, r.Port)
-			conn, err := tls.Dial("tcp", target, r.conf)
-			if err != nil {
-				if retry < 5 {
-					sleepDur += 500 * time.Millisecond * time.Duration(retry)
-					retry++
-				}
-				log.Printf("failed to connect to %q - %v", target, err)
-				continue
+			case <-time.After(wait):
 			}
+		}
+		select {
+		case <-r.doneCh:
+			return
+		default:
+		}
+		setState(StateConnecting, time.Time{})
+		raw, err := dialer.DialContext(ctx, "tcp", target)
+		if err != nil {
+			retry++
+			log.Printf("failed to connect to %q - %v", target, err)
+			continue
+		}
+		r.wg.Add(1)
+		if r.handleConn(tls.Client(raw, conf), channel) {
 			retry = 0
-			sleepDur = time.Duration(0)
-			r.handleConn(conn)
+		} else {
+			// the connection was refused, back off as if the dial failed
+			retry++
 		}
-	}()
+	}
 }
 
-// AddrAllowed takes an address and returns whether that address is allowed by Relay's whitelist
+// AddrAllowed takes an address and returns whether that address is allowed by Relay's access list
 // Only invoked when the relay is in Passthrough mode, and discards the port
 func (r *Relay) AddrAllowed(addr net.Addr) bool {
-	if tcpAdr, ok := addr.(*net.TCPAddr); ok {
-		return r.WhiteList.MatchString(tcpAdr.IP.String())
+	return r.checkAddr(addr) == nil
+}
+
+func (r *Relay) checkAddr(addr net.Addr) error {
+	tcpAdr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("unsupported address type %T", addr)
 	}
-	return false
+	return r.AccessList().Allowed(tcpAdr.IP)
 }
 
-// handleConn blocks while either rpc client or server are isConnected.
-func (r *Relay) handleConn(conn net.Conn) {
-	r.connected()
-	log.Println("connected to:", conn.RemoteAddr())
+// AccessList returns the access list connecting handlers are checked against
+func (r *Relay) AccessList() *AccessList {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.acl
+}
+
+// SetAccessList replaces the access list, connected handlers that are no longer allowed are disconnected
+func (r *Relay) SetAccessList(acl *AccessList) {
+	r.lock.Lock()
+	r.acl = acl
+	r.lock.Unlock()
+	log.Printf("relay access list set, %s\n", acl)
+	for _, h := range r.handlers.list() {
+		addr, err := net.ResolveTCPAddr("tcp", h.addr)
+		if err != nil {
+			continue
+		}
+		if err := acl.Allowed(addr.IP); err != nil {
+			log.Printf("disconnecting handler %d (%s): %v\n", h.id, h.addr, err)
+			r.handlers.remove(h)
+		}
+	}
+}
+
+// RejectedConn describes a connection the passthrough turned away
+type RejectedConn struct {
+	Addr   string `json:"addr"`
+	Time   int64  `json:"time"`
+	Reason string `json:"reason"`
+}
+
+// maxRejected is the number of recent rejected connections kept for the status
+const maxRejected = 100
+
+func (r *Relay) reject(conn net.Conn, reason error) {
+	log.Printf("rejected relay connection from %q: %v\n", conn.RemoteAddr().String(), reason)
+	if err := conn.Close(); err != nil {
+		log.Println(err)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.rejectedCount++
+	if len(r.rejected) >= maxRejected {
+		r.rejected = r.rejected[1:]
+	}
+	r.rejected = append(r.rejected, RejectedConn{
+		Addr:   conn.RemoteAddr().String(),
+		Time:   time.Now().Unix(),
+		Reason: reason.Error(),
+	})
+}
+
+// handleConn blocks while either rpc client or server are isConnected. The channel is the kind of
+// connection a handler is opening, a passthrough learns it from the handshake.
+// Returns false if the connection was refused before it was established.
+func (r *Relay) handleConn(conn net.Conn, channel string) bool {
+	defer r.wg.Done()
 	if r.Mode == PassThrough {
-		if r.AddrAllowed(conn.RemoteAddr()) {
-			r.rpcClient = rpc.NewClient(conn)
-			<-r.clientConnectionWatcher() // block until rpc client appears to be disconnected
+		if err := r.checkAddr(conn.RemoteAddr()); err != nil {
+			r.reject(conn, err)
+			return false
+		}
+	}
+	peer := ""
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// handshake up front so a peer with a bad or missing client certificate is turned away before it counts as connected
+		_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		err := tlsConn.Handshake()
+		_ = conn.SetDeadline(time.Time{})
+		if err != nil {
+			if r.Mode == PassThrough {
+				r.reject(conn, fmt.Errorf("tls handshake failed: %v", err))
+				return false
+			}
+			log.Printf("tls handshake with %q failed: %v\n", conn.RemoteAddr().String(), err)
+			if err := conn.Close(); err != nil {
+				log.Println(err)
+			}
+			return false
+		}
+		peer = peerName(tlsConn.ConnectionState())
+	}
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	info, err := r.handshake(conn, channel)
+	_ = conn.SetDeadline(time.Time{})
+	if err != nil {
+		r.handshakeFailed(err)
+		if r.Mode == PassThrough {
+			r.reject(conn, err)
+			return false
+		}
+		log.Printf("relay handshake with %q failed: %v\n", conn.RemoteAddr().String(), err)
+		if err := conn.Close(); err != nil {
+			log.Println(err)
+		}
+		return false
+	}
+	if info.Channel == ChannelEgress || channel == ChannelEgress {
+		if r.Mode == PassThrough {
+			r.serveEgress(conn)
 		} else {
-			log.Printf("ip %q failed to match whitelist %q\n", conn.RemoteAddr().String(), r.WhiteList.String())
+			r.useEgress(conn, info)
 		}
+		return true
+	}
+	r.connected()
+	log.Printf("connected to: %s %s protocol: %d peer build: %s\n", conn.RemoteAddr(), peer, info.Protocol, info.Build.String())
+	if r.Mode == PassThrough {
+		h := r.handlers.add(conn.RemoteAddr().String(), peer, info, rpc.NewClient(conn))
+		go r.replayQueue()
+		<-r.clientConnectionWatcher(h) // block until rpc client appears to be disconnected
+		r.handlers.remove(h)
 	} else {
+		r.setPeer(conn, info)
 		// ServeConn in go routine because it blocks, Closes when the client hangs up
 		r.rpcServer.ServeConn(conn)
+		r.setPeer(nil, nil)
 	}
 	r.disconnected()
+	return true
+}
+
+func (r *Relay) setConnState(state ConnState, next time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.connState = state
+	r.nextAttempt = next
+}
+
+func (r *Relay) handshakeFailed(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.handshakeErrors++
+	r.handshakeError = err.Error()
 }
 
 func (r *Relay) disconnected() {
@@ -388,7 +1051,8 @@ func (r *Relay) disconnected() {
 	}
 	r.disconnectTimes = append(r.disconnectTimes, time.Now().Unix())
 	log.Print("disconnected")
-	r.isConnected = false
+	r.connections--
+	r.isConnected = r.connections > 0
 }
 
 func (r *Relay) connected() {
@@ -396,7 +1060,12 @@ func (r *Relay) connected() {
 	defer r.lock.Unlock()
 
 	r.connectCnt++
+	r.connections++
 	r.connectTime = time.Now().Unix()
+	if r.Mode == Handler {
+		r.connState = StateConnected
+		r.nextAttempt = time.Time{}
+	}
 	r.isConnected = true
 	r.connectCounter.Add(1)
 
@@ -410,7 +1079,7 @@ func (r *Relay) connected() {
 // clientConnectionWatcher returns a channel that will be closed, if the connection
 // appears to be disconnected. To check, we continuously call Ping via rpc to verify
 // our connection is still alive.
-func (r *Relay) clientConnectionWatcher() <-chan struct{} {
+func (r *Relay) clientConnectionWatcher(h *handlerConn) <-chan struct{} {
 	out := make(chan struct{})
 	go func() {
 		for {
@@ -429,18 +1098,26 @@ func (r *Relay) clientConnectionWatcher() <-chan struct{} {
 						return
 					}
 				case r.Mode == PassThrough:
-					if r.rpcClient != nil {
-						start := time.Now()
-						r.relayer.lastPing = start
-						var resp *string
-						err := r.rpcClient.Call(RelayerPing, start, &resp)
-						if err != nil || resp == nil {
-							log.Println("ping failed resp:", resp, "error:", err)
-							close(out)
-							return
-						}
-						r.pingHistogram.Add(time.Since(start).Seconds())
+					start := time.Now()
+					r.relayer.lastPing = start
+					var resp PingStatus
+					var err error
+					if h.info != nil && h.info.Protocol >= 3 {
+						err = h.client.Call(RelayerPingHealth, start, &resp)
+					} else {
+						err = h.client.Call(RelayerPing, start, &resp.Reply)
 					}
+					if err != nil || resp.Reply == "" {
+						log.Println("ping failed resp:", resp.Reply, "error:", err)
+						close(out)
+						return
+					}
+					if resp.Reply == DrainReply {
+						h.setState(HandlerDraining)
+					}
+					h.setHealth(resp.Health)
+					r.pingHistogram.Add(time.Since(start).Seconds())
+					h.pinged(start, time.Since(start))
 				default:
 					// unknown mode, bail out
 					log.Println("Unknown mode:", r.Mode)
@@ -453,14 +1130,60 @@ func (r *Relay) clientConnectionWatcher() <-chan struct{} {
 	return out
 }
 
-// Close
+// Close shuts down the relay, a handler first drains so the passthrough stops sending it
+// requests and the requests it already has can finish.
 func (r *Relay) Close() {
-	if r.rpcClient != nil {
-		if err := r.rpcClient.Close(); err != nil {
+	if r.Mode == Handler {
+		r.drain()
+	}
+	close(r.doneCh)
+	r.handlers.closeAll()
+	r.closeConn()
+	r.lock.Lock()
+	for conn := range r.egressConns {
+		if err := conn.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	r.lock.Unlock()
+	r.wg.Wait()
+	if r.recorder != nil {
+		if err := r.recorder.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// drain tells the passthrough this handler is going away, then waits for it to acknowledge via ping
+// and for in-flight requests to finish. Gives up after the drain timeout.
+func (r *Relay) drain() {
+	r.lock.Lock()
+	conn := r.conn
+	r.lock.Unlock()
+	if conn == nil || r.relayer == nil {
+		return
+	}
+	start := time.Now()
+	atomic.StoreInt32(&r.relayer.draining, 1)
+	log.Println("draining relay handler")
+	for time.Since(start) < r.drainTimeout {
+		acknowledged := r.LastPingTime().After(start)
+		if acknowledged && atomic.LoadInt64(&r.relayer.inFlight) == 0 {
+			break
+		}
+		time.Sleep(r.checkInterval / 10)
+	}
+}
+
+// closeConn hangs up the handler connection, if there is one
+func (r *Relay) closeConn() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.conn != nil {
+		if err := r.conn.Close(); err != nil {
 			log.Println(err)
 		}
 	}
-	close(r.doneCh)
 }
 
 // FauxRequest is the same as an http.Request, but since we can't send an io.Reader
@@ -477,6 +1200,10 @@ type FauxRequest struct {
 	TransferEncoding []string
 	Host             string
 	Form             url.Values
+	Timeout          time.Duration // time remaining before the relayed request should be abandoned
+	BodyEncoding     string        // set while the body is compressed for the relay
+	AcceptEncoding   string        // body encoding the requester accepts on the response
+	QueuedAt         int64         // unix seconds the passthrough queued the request, zero if it was relayed as it arrived
 }
 
 func CreateFauxRequest(req *http.Request, body []byte) *FauxRequest {
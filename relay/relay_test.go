@@ -2,12 +2,19 @@ package relay
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httputil"
+	"net/rpc"
+	"net/url"
+	"os"
 	"testing"
 	"time"
 
@@ -90,12 +97,24 @@ func TestRelayTest(t *testing.T) {
 	assert.Equal(t, respStatus, rr.Code)
 	assert.Equal(t, respBody, rr.Body.Bytes())
 
+	closed := make(chan struct{})
 	time.AfterFunc(5*time.Millisecond, func() {
 		dst.Close()
 		src.Close()
+		close(closed)
 	})
 
-	<-dst.doneCh
+	<-closed
+}
+
+func TestRelay_ClosePort(t *testing.T) {
+	conf := generateTlsConfig(t)
+	for i := 0; i < 2; i++ {
+		// the port is free again as soon as Close returns
+		src := NewRelay("", 5042, ".+", PassThrough, conf)
+		assert.NoError(t, src.Listen())
+		src.Close()
+	}
 }
 
 func TestCancel(t *testing.T) {
@@ -117,11 +136,10 @@ func TestCancel(t *testing.T) {
 
 	assert.False(t, src.isConnected)
 	assert.False(t, dst.isConnected)
-	go func() {
-		if err := src.Listen(); err != nil {
-			t.Error(err)
-		}
-	}()
+	// listening first, a refused dial would back off past the close
+	if err := src.Listen(); err != nil {
+		t.Error(err)
+	}
 	go dst.Connect()
 	for i := 0; i < 100; i++ {
 		if src.isConnected && dst.isConnected {
@@ -154,3 +172,666 @@ func TestRelay_IsWhiteListed(t *testing.T) {
 		})
 	}
 }
+
+// connectedRelays creates a passthrough and handler pair on the given port, the handler func is registered
+// on the handler relay before it connects. Callers are responsible for closing both relays.
+func connectedRelays(t *testing.T, port int, path string, handler http.HandlerFunc) (*Relay, *Relay) {
+	t.Helper()
+	conf := generateTlsConfig(t)
+	src := NewRelay("", port, ".+", PassThrough, conf)
+	dst := NewRelay("", port, ".+", Handler, conf)
+	if err := src.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Init(); err != nil {
+		t.Fatal(err)
+	}
+	src.SetCheckInterval(time.Millisecond * 100)
+	dst.SetCheckInterval(time.Millisecond * 100)
+	dst.HandleFunc(path, handler)
+	if err := src.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	dst.Connect()
+	for i := 0; i < 100; i++ {
+		if src.isConnected && dst.isConnected {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !src.isConnected || !dst.isConnected {
+		t.Fatal("relays failed to connect")
+	}
+	return src, dst
+}
+
+func TestRelay_RequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	src, dst := connectedRelays(t, 5010, "/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	defer src.Close()
+	defer dst.Close()
+	src.SetRequestTimeout(time.Millisecond * 100)
+
+	req, err := http.NewRequest(http.MethodPost, "/slow", bytes.NewReader(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	start := time.Now()
+	src.RelayHandler(rr, req)
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+	assert.True(t, time.Since(start) < time.Second)
+
+	status := src.Status()
+	assert.Equal(t, int64(1), status.TimeoutCount)
+	assert.Equal(t, int64(0), status.FailureCount)
+	assert.Equal(t, int64(0), status.InFlight)
+
+	// the handler side sees the same deadline and gives up on the request
+	for i := 0; i < 100 && dst.Status().TimeoutCount == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Equal(t, int64(1), dst.Status().TimeoutCount)
+}
+
+func TestRelay_ConcurrentRequests(t *testing.T) {
+	delay := time.Millisecond * 200
+	src, dst := connectedRelays(t, 5011, "/wait", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	defer src.Close()
+	defer dst.Close()
+
+	count := 5
+	codes := make(chan int, count)
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		go func() {
+			req, _ := http.NewRequest(http.MethodPost, "/wait", bytes.NewReader(nil))
+			rr := httptest.NewRecorder()
+			src.RelayHandler(rr, req)
+			codes <- rr.Code
+		}()
+	}
+	for i := 0; i < count; i++ {
+		assert.Equal(t, http.StatusAccepted, <-codes)
+	}
+	// requests run side by side rather than queueing behind one another
+	assert.True(t, time.Since(start) < delay*time.Duration(count))
+}
+
+func TestRelay_NoClientFailure(t *testing.T) {
+	src := NewRelay("", 0, ".+", PassThrough, generateTlsConfig(t))
+	if err := src.Init(); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, "/", bytes.NewReader(nil))
+	rr := httptest.NewRecorder()
+	src.RelayHandler(rr, req)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Equal(t, int64(1), src.Status().FailureCount)
+	assert.Equal(t, int64(0), src.Status().TimeoutCount)
+}
+
+func TestRelay_BufferedRequests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relayqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := generateTlsConfig(t)
+	src := NewRelay("", 5013, ".+", PassThrough, conf)
+	dst := NewRelay("", 5013, ".+", Handler, conf)
+	if err := src.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SetQueue(dir, 10); err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	defer dst.Close()
+	src.SetCheckInterval(time.Millisecond * 100)
+	dst.SetCheckInterval(time.Millisecond * 100)
+	if err := src.Listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	// no handler yet, requests are acknowledged and queued
+	count := 3
+	for i := 0; i < count; i++ {
+		req, _ := http.NewRequest(http.MethodPost, "/event", bytes.NewReader([]byte{byte('0' + i)}))
+		rr := httptest.NewRecorder()
+		src.BufferedRelayHandler(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, `{"status":"queued"}`, rr.Body.String())
+	}
+	assert.Equal(t, count, src.Status().QueueDepth)
+
+	received := make(chan string, count)
+	dst.HandleFunc("/event", func(w http.ResponseWriter, r *http.Request) {
+		// the handler is told when the request was queued
+		if at, ok := QueuedAt(r); assert.True(t, ok) {
+			assert.WithinDuration(t, time.Now(), at, 5*time.Second)
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		received <- string(b)
+	})
+	dst.Connect()
+	for i := 0; i < count; i++ {
+		select {
+		case body := <-received:
+			assert.Equal(t, string([]byte{byte('0' + i)}), body)
+		case <-time.After(time.Second * 3):
+			t.Fatal("queued request was not replayed")
+		}
+	}
+	for i := 0; i < 100 && src.Status().QueueReplayed < int64(count); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	status := src.Status()
+	assert.Equal(t, 0, status.QueueDepth)
+	assert.Equal(t, int64(count), status.QueueReplayed)
+	assert.Equal(t, int64(0), status.QueueDropped)
+}
+
+func TestResponse(t *testing.T) {
+	r := &Response{}
+	r.Header().Set("Content-Type", "text/plain")
+	_, _ = r.Write([]byte("hello "))
+	r.Header().Set("X-Late", "ignored")
+	r.WriteHeader(http.StatusTeapot)
+	_, _ = r.Write([]byte("world"))
+	assert.Equal(t, http.StatusOK, r.Status)
+	assert.Equal(t, http.Header{"Content-Type": []string{"text/plain"}}, r.Headers)
+	assert.Equal(t, "hello world", string(r.Body))
+
+	// reads pick up where the last one left off
+	buf := make([]byte, 4)
+	var out []byte
+	for {
+		n, err := r.Read(buf)
+		out = append(out, buf[:n]...)
+		if err != nil {
+			break
+		}
+	}
+	assert.Equal(t, "hello world", string(out))
+}
+
+// TestRelay_ResponseFidelity serves each handler directly and through the relay, the responses must be identical
+func TestRelay_ResponseFidelity(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"empty", func(w http.ResponseWriter, r *http.Request) {}},
+		{"status only", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+		}},
+		{"sniffed content type", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("<html><body>hi</body></html>"))
+		}},
+		{"challenge", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text")
+			_, _ = w.Write([]byte("3eZbrw1aBm2rZgRNFdxV2595E9CY3gmdALWMmHkvFXO7tYXAYM8P"))
+		}},
+		{"json", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"text":"ok"}`))
+		}},
+		{"chunked writes", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			for i := 0; i < 10; i++ {
+				_, _ = w.Write(bytes.Repeat([]byte{byte('a' + i)}, 1000))
+			}
+		}},
+		{"multi value headers and status", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("X-Multi", "one")
+			w.Header().Add("X-Multi", "two")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte("created"))
+			w.Header().Set("X-Too-Late", "dropped")
+		}},
+		{"error", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "bad request", http.StatusBadRequest)
+		}},
+		{"echo", func(w http.ResponseWriter, r *http.Request) {
+			b, _ := ioutil.ReadAll(r.Body)
+			w.Header().Set("X-Method", r.Method)
+			_, _ = w.Write(b)
+		}},
+	}
+	src, dst := connectedRelays(t, 5014, "/unused", func(w http.ResponseWriter, r *http.Request) {})
+	defer src.Close()
+	defer dst.Close()
+	for i, tt := range tests {
+		dst.HandleFunc(fmt.Sprintf("/%d", i), tt.handler)
+	}
+	local := http.NewServeMux()
+	for i, tt := range tests {
+		local.HandleFunc(fmt.Sprintf("/%d", i), tt.handler)
+	}
+	localServer := httptest.NewServer(local)
+	defer localServer.Close()
+	relayServer := httptest.NewServer(http.HandlerFunc(src.RelayHandler))
+	defer relayServer.Close()
+
+	dump := func(t *testing.T, url string) []byte {
+		t.Helper()
+		resp, err := http.Post(url, "text/plain", bytes.NewReader([]byte("request body")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		resp.Header.Del("Date")
+		b, err := httputil.DumpResponse(resp, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := fmt.Sprintf("/%d", i)
+			expected := dump(t, localServer.URL+path)
+			actual := dump(t, relayServer.URL+path)
+			assert.Equal(t, string(expected), string(actual))
+		})
+	}
+}
+
+func TestRelay_AccessList(t *testing.T) {
+	src, dst := connectedRelays(t, 5015, "/unused", func(w http.ResponseWriter, r *http.Request) {})
+	defer src.Close()
+	defer dst.Close()
+
+	// reloading a list that no longer allows the handler disconnects it, and its reconnects are rejected
+	acl, err := NewAccessList(nil, []string{"127.0.0.0/8", "::1"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.SetAccessList(acl)
+	for i := 0; i < 100 && (len(src.Status().Handlers) > 0 || src.Status().RejectedCount == 0); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	status := src.Status()
+	assert.Len(t, status.Handlers, 0)
+	assert.True(t, status.RejectedCount > 0)
+	if assert.NotEmpty(t, status.Rejected) {
+		assert.Contains(t, status.Rejected[0].Reason, "denied by 127.0.0.0/8")
+		assert.Contains(t, status.Rejected[0].Addr, "127.0.0.1")
+	}
+
+	// and allowing it again lets it back in
+	acl, err = NewAccessList([]string{"127.0.0.0/8"}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.SetAccessList(acl)
+	for i := 0; i < 100 && len(src.Status().Handlers) == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Len(t, src.Status().Handlers, 1)
+}
+
+func TestRelay_SharedSecret(t *testing.T) {
+	tests := []struct {
+		name      string
+		secret    string
+		connected bool
+	}{
+		{"matching secret", "s3cret", true},
+		{"mismatched secret", "wrong", false},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conf := generateTlsConfig(t)
+			src := NewRelay("", 5030+i, ".+", PassThrough, conf)
+			dst := NewRelay("", 5030+i, ".+", Handler, conf)
+			if err := src.Init(); err != nil {
+				t.Fatal(err)
+			}
+			if err := dst.Init(); err != nil {
+				t.Fatal(err)
+			}
+			src.SetSecret("s3cret")
+			dst.SetSecret(test.secret)
+			src.SetCheckInterval(time.Millisecond * 100)
+			dst.SetCheckInterval(time.Millisecond * 100)
+			dst.SetDrainTimeout(time.Millisecond * 200)
+			if err := src.Listen(); err != nil {
+				t.Fatal(err)
+			}
+			dst.Connect()
+			defer src.Close()
+			defer dst.Close()
+			for i := 0; i < 100; i++ {
+				if src.Status().Connected || src.Status().HandshakeErrors > 0 {
+					break
+				}
+				time.Sleep(time.Millisecond * 10)
+			}
+			srcStatus := src.Status()
+			assert.Equal(t, test.connected, srcStatus.Connected)
+			if test.connected {
+				for i := 0; i < 100 && dst.Status().Peer == nil; i++ {
+					time.Sleep(time.Millisecond * 10)
+				}
+				if assert.NotNil(t, dst.Status().Peer) {
+					assert.Equal(t, ProtocolVersion, dst.Status().Peer.Protocol)
+				}
+				return
+			}
+			assert.Contains(t, srcStatus.HandshakeError, "shared secret mismatch")
+			if assert.NotEmpty(t, srcStatus.Rejected) {
+				assert.Contains(t, srcStatus.Rejected[0].Reason, "shared secret mismatch")
+			}
+			for i := 0; i < 100 && dst.Status().HandshakeErrors == 0; i++ {
+				time.Sleep(time.Millisecond * 10)
+			}
+			assert.Contains(t, dst.Status().HandshakeError, "shared secret mismatch")
+		})
+	}
+}
+
+func TestRelay_BackingOff(t *testing.T) {
+	// nothing is listening, the handler keeps backing off
+	dst := NewRelay("127.0.0.1", 5016, ".+", Handler, generateTlsConfig(t))
+	if err := dst.Init(); err != nil {
+		t.Fatal(err)
+	}
+	dst.SetBackoff(Backoff{Initial: time.Hour, Max: time.Hour})
+	dst.Connect()
+	for i := 0; i < 100 && dst.Status().State != StateBackingOff; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	status := dst.Status()
+	assert.Equal(t, StateBackingOff, status.State)
+	assert.True(t, status.NextAttempt > time.Now().Add(time.Minute).Unix())
+
+	// shutdown doesn't wait out the back off
+	start := time.Now()
+	dst.Close()
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestRelay_MultipleHandlers(t *testing.T) {
+	hits := make(chan string, 100)
+	handle := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			hits <- name
+		}
+	}
+	src, first := connectedRelays(t, 5012, "/", handle("first"))
+	defer src.Close()
+	second := NewRelay("", 5012, ".+", Handler, generateTlsConfig(t))
+	if err := second.Init(); err != nil {
+		t.Fatal(err)
+	}
+	second.SetCheckInterval(time.Millisecond * 100)
+	second.HandleFunc("/", handle("second"))
+	second.Connect()
+	for i := 0; i < 100 && len(src.Status().Handlers) < 2; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Len(t, src.Status().Handlers, 2)
+
+	send := func() int {
+		req, _ := http.NewRequest(http.MethodPost, "/", bytes.NewReader(nil))
+		rr := httptest.NewRecorder()
+		src.RelayHandler(rr, req)
+		return rr.Code
+	}
+	seen := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, http.StatusOK, send())
+		seen[<-hits]++
+	}
+	assert.Equal(t, 5, seen["first"])
+	assert.Equal(t, 5, seen["second"])
+
+	// closing a handler drains it, the remaining handler takes all the requests
+	first.Close()
+	for i := 0; i < 100 && len(src.Status().Handlers) > 1; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Len(t, src.Status().Handlers, 1)
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, http.StatusOK, send())
+		assert.Equal(t, "second", <-hits)
+	}
+	second.Close()
+}
+
+// countingRelayer answers relayed requests over rpc, counting them
+type countingRelayer struct {
+	calls chan string
+}
+
+func (c *countingRelayer) RelayRequest(req *FauxRequest, resp *Response) error {
+	c.calls <- req.URL.Path
+	resp.Status = http.StatusOK
+	return nil
+}
+
+func TestRelay_Failover(t *testing.T) {
+	r := NewRelay("", 0, ".+", PassThrough, nil)
+	relayer := &countingRelayer{calls: make(chan string, 10)}
+	server := rpc.NewServer()
+	if err := server.RegisterName("Relayer", relayer); err != nil {
+		t.Fatal(err)
+	}
+	serve := func() *rpc.Client {
+		client, conn := net.Pipe()
+		go server.ServeConn(conn)
+		return rpc.NewClient(client)
+	}
+	// received reads the request and hangs up without answering
+	received := func() *rpc.Client {
+		client, conn := net.Pipe()
+		go func() {
+			_, _ = conn.Read(make([]byte, 64*1024))
+			time.Sleep(50 * time.Millisecond)
+			conn.Close()
+		}()
+		return rpc.NewClient(client)
+	}
+	// closed was shut down before the request
+	closed := func() *rpc.Client {
+		client := serve()
+		client.Close()
+		return client
+	}
+	relay := func(path string) (*Response, error) {
+		return r.relay(context.Background(), &FauxRequest{Method: http.MethodPost, URL: &url.URL{Path: path}})
+	}
+
+	// a request that never reached a handler goes to another
+	r.handlers = handlerPool{}
+	r.handlers.add("closed", "", nil, closed())
+	r.handlers.add("ok", "", nil, serve())
+	resp, err := relay("/unsent")
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.Status)
+	}
+	assert.Equal(t, "/unsent", <-relayer.calls)
+
+	// a request the handler may have received isn't sent again
+	r.handlers = handlerPool{}
+	r.handlers.add("received", "", nil, received())
+	r.handlers.add("ok", "", nil, serve())
+	_, err = relay("/received")
+	assert.Error(t, err)
+	assert.NotEqual(t, ErrNoHandler, err)
+	assert.Len(t, relayer.calls, 0)
+
+	// with no handler left to try the request can be queued
+	r.handlers = handlerPool{}
+	r.handlers.add("closed", "", nil, closed())
+	_, err = relay("/none")
+	assert.Equal(t, ErrNoHandler, err)
+}
+
+// failingRelayer fails every relayed request
+type failingRelayer struct{}
+
+func (failingRelayer) RelayRequest(req *FauxRequest, resp *Response) error {
+	return errors.New("handler failed")
+}
+
+func TestRelay_ReplayQueueFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relayqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r := NewRelay("", 0, ".+", PassThrough, nil)
+	if err := r.SetQueue(dir, 10); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/1", "/2"} {
+		assert.NoError(t, r.queue.Push(&FauxRequest{Method: http.MethodPost, URL: &url.URL{Path: path}}))
+	}
+	server := rpc.NewServer()
+	if err := server.RegisterName("Relayer", failingRelayer{}); err != nil {
+		t.Fatal(err)
+	}
+	serve := func() *rpc.Client {
+		client, conn := net.Pipe()
+		go server.ServeConn(conn)
+		return rpc.NewClient(client)
+	}
+	live, gone := serve(), serve()
+	gone.Close()
+
+	// a handler that is gone but still counted stops the replay instead of spinning on it
+	r.handlers.add("gone", "", nil, gone)
+	done := make(chan struct{})
+	go func() {
+		r.replayQueue()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("replay didn't stop without a handler")
+	}
+	assert.Equal(t, 2, r.queue.Len())
+
+	// requests the handler fails are kept aside, not dropped
+	r.handlers = handlerPool{}
+	r.handlers.add("live", "", nil, live)
+	r.replayQueue()
+	assert.Equal(t, 0, r.queue.Len())
+	assert.Equal(t, int64(2), r.queue.Rejected())
+	files, err := ioutil.ReadDir(r.queue.rejectedDir())
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+}
+
+func TestHandlerPool_Pick(t *testing.T) {
+	pool := handlerPool{}
+	a := pool.add("a", "", nil, nil)
+	b := pool.add("b", "", nil, nil)
+	c := pool.add("c", "", nil, nil)
+
+	a.inFlight = 2
+	b.inFlight = 1
+	c.inFlight = 3
+	assert.Equal(t, b, pool.pick(nil))
+	assert.Equal(t, a, pool.pick(map[*handlerConn]bool{b: true}))
+
+	b.setState(HandlerDraining)
+	assert.Equal(t, a, pool.pick(nil))
+	assert.Nil(t, pool.pick(map[*handlerConn]bool{a: true, c: true}))
+	assert.Equal(t, 2, pool.available())
+}
+
+// mutualTlsConfigs creates passthrough and handler configs that require verified certificates from both ends
+func mutualTlsConfigs(t *testing.T, handlerCert string, peers ...string) (*tls.Config, *tls.Config) {
+	t.Helper()
+	pool, err := LoadCertPool("testdata/ca.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := tls.LoadX509KeyPair("testdata/passthrough.crt", "testdata/passthrough.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := tls.LoadX509KeyPair("testdata/"+handlerCert+".crt", "testdata/"+handlerCert+".key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates:          []tls.Certificate{server},
+		ClientAuth:            tls.RequireAndVerifyClientCert,
+		ClientCAs:             pool,
+		VerifyPeerCertificate: VerifyPeerNames(peers),
+	}, &tls.Config{
+		Certificates: []tls.Certificate{client},
+		RootCAs:      pool,
+	}
+}
+
+func TestRelay_MutualTLS(t *testing.T) {
+	tests := []struct {
+		name      string
+		cert      string
+		peers     []string
+		connected bool
+	}{
+		{"signed by ca", "handler", nil, true},
+		{"pinned name", "handler", []string{"handler.atsu.io"}, true},
+		{"pinned san", "handler", []string{"other", "localhost"}, true},
+		{"not pinned", "rogue", []string{"handler.atsu.io"}, false},
+		{"not signed by ca", "test", nil, false},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			port := 5020 + i
+			srcConf, dstConf := mutualTlsConfigs(t, test.cert, test.peers...)
+			src := NewRelay("", port, ".+", PassThrough, srcConf)
+			dst := NewRelay("localhost", port, ".+", Handler, dstConf)
+			src.SetCheckInterval(time.Millisecond * 100)
+			dst.SetCheckInterval(time.Millisecond * 100)
+			dst.SetDrainTimeout(time.Millisecond * 200)
+			if err := src.Init(); err != nil {
+				t.Fatal(err)
+			}
+			if err := dst.Init(); err != nil {
+				t.Fatal(err)
+			}
+			if err := src.Listen(); err != nil {
+				t.Fatal(err)
+			}
+			dst.Connect()
+			for i := 0; i < 50 && !src.Status().Connected; i++ {
+				time.Sleep(time.Millisecond * 10)
+			}
+			status := src.Status()
+			assert.Equal(t, test.connected, status.Connected)
+			if test.connected {
+				assert.Equal(t, "handler.atsu.io", status.Handlers[0].Peer)
+			}
+			dst.Close()
+			src.Close()
+		})
+	}
+}
+
+func TestVerifyPeerNames(t *testing.T) {
+	assert.Nil(t, VerifyPeerNames(nil))
+	assert.Nil(t, VerifyPeerNames([]string{"", " "}))
+}
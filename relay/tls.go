@@ -0,0 +1,73 @@
+package relay
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// LoadCertPool reads a PEM encoded CA bundle into a cert pool, used to verify relay peers
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %q", file)
+	}
+	return pool, nil
+}
+
+// VerifyPeerNames returns a tls.Config VerifyPeerCertificate func that only accepts a verified
+// peer certificate whose subject CN or one of its SANs is in names. Returns nil if names is empty,
+// in which case any certificate signed by the configured CA is accepted.
+func VerifyPeerNames(names []string) func([][]byte, [][]*x509.Certificate) error {
+	allowed := make(map[string]bool)
+	for _, n := range names {
+		if n = strings.TrimSpace(n); n != "" {
+			allowed[n] = true
+		}
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, chain := range verifiedChains {
+			if len(chain) == 0 {
+				continue
+			}
+			for _, name := range certNames(chain[0]) {
+				if allowed[name] {
+					return nil
+				}
+			}
+		}
+		return errors.New("relay peer certificate does not match any allowed name")
+	}
+}
+
+// certNames lists the subject CN and SANs of a certificate
+func certNames(cert *x509.Certificate) []string {
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// peerName returns the subject CN of the verified peer certificate, or "" if the peer did not present one
+func peerName(state tls.ConnectionState) string {
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
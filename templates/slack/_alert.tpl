@@ -6,6 +6,7 @@ Ex: curl -X POST '<chatopshost>/slack/atsu-event?tpl=_alert.tpl' -d '{ "view_pat
 name: alert
 description: display alert
 sendtokafka: true
+messagekey: atsu_id
 ---
 */}}
 {{ if not .InteractionData.atsu_id }}{{ Error "atsu_id is required" }}{{ end }}
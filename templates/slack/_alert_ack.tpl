@@ -0,0 +1,18 @@
+{{/* Template Info
+Acknowledges an alert when someone reacts to it with :white_check_mark:, replying in the alert's thread.
+Only alerts posted to a channel by _alert.tpl are remembered by their atsu_id message key, reactions to other
+messages and other reactions render nothing so they are ignored. Needs the reaction_added event subscription
+and the reactions:read scope.
+---
+name: alert_ack
+description: acknowledge an alert with a reaction
+events: [reaction_added]
+sendtokafka: true
+---
+*/}}
+{{ $atsuId := TrimPrefix .MessageKey "atsu_id=" }}
+{{ if and (eq .Event.reaction "white_check_mark") (ne $atsuId .MessageKey) }}
+{
+  "text": "<@{{ .Event.user }}> acknowledged alert *{{ $atsuId }}*"
+}
+{{ end }}
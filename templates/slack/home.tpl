@@ -0,0 +1,52 @@
+{{/* Template Info
+This template is the app home tab, it is published with views.publish when a user opens the tab
+and refreshed when an alert or the user's feedback arrives. Needs the app_home_opened event subscription.
+---
+name: home
+description: the app home tab, recent alerts and your alert feedback
+---
+*/}}
+{{ if not .Home }}{{ Error "home is only rendered for the app home tab" }}{{ end }}
+{
+  "type": "home",
+  "blocks": [
+    {
+      "type": "section",
+      "text": {
+        "type": "mrkdwn",
+        "text": "*Recent alerts*"
+      }
+    },
+    {{ range .Home.RecentAlerts }}
+    {
+      "type": "section",
+      "text": {
+        "type": "mrkdwn",
+        "text": "<{{ $.ViewUrl }}/alertdetail?atsu_id={{ .AtsuId }} | *{{ .AtsuId }}*> {{ .Text }}"
+      }
+    },
+    {{ else }}
+    {
+      "type": "context",
+      "elements": [
+        {
+          "type": "mrkdwn",
+          "text": "No recent alerts"
+        }
+      ]
+    },
+    {{ end }}
+    {
+      "type": "divider"
+    },
+    {
+      "type": "context",
+      "elements": [
+        {
+          "type": "mrkdwn",
+          "text": "Your alert feedback :thumbsup: {{ .Home.Feedback.Positive }} :thumbsdown: {{ .Home.Feedback.Negative }}"
+        }
+      ]
+    }
+  ]
+}
@@ -1,26 +1,54 @@
 {{/* Template Info
 ---
 name: issue
-description: submit an issue via dialog interaction
-dialog: true
+description: submit an issue via a modal
+modal: open
 ---
 */}}
 {
+  "type": "modal",
   "callback_id": "000|_kafka",
-  "title": "Report an Issue",
-  "submit_label": "Submit",
-  "notify_on_cancel": false,
-  "elements": [
+  "title": {
+    "type": "plain_text",
+    "text": "Report an Issue"
+  },
+  "submit": {
+    "type": "plain_text",
+    "text": "Submit"
+  },
+  "close": {
+    "type": "plain_text",
+    "text": "Cancel"
+  },
+  "blocks": [
     {
-      "label": "Subject",
-      "name": "subject",
-      "type": "text"
+      "type": "input",
+      "block_id": "subject",
+      "label": {
+        "type": "plain_text",
+        "text": "Subject"
+      },
+      "element": {
+        "type": "plain_text_input",
+        "action_id": "subject"
+      }
     },
     {
-      "label": "Description",
-      "name": "description",
-      "type": "textarea",
-      "hint": "don't forget to include distinguishing information such as JID or Mount"
+      "type": "input",
+      "block_id": "description",
+      "label": {
+        "type": "plain_text",
+        "text": "Description"
+      },
+      "hint": {
+        "type": "plain_text",
+        "text": "don't forget to include distinguishing information such as JID or Mount"
+      },
+      "element": {
+        "type": "plain_text_input",
+        "action_id": "description",
+        "multiline": true
+      }
     }
   ]
-}
\ No newline at end of file
+}
@@ -6,9 +6,6 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"net/http"
 	"net/url"
 	"os"
 	"path"
@@ -18,22 +15,6 @@ import (
 	"text/template"
 )
 
-// SendResponseURL sends the provided message as the POST body
-func SendResponseURL(url string, body []byte) (int, []byte, error) {
-	payload := bytes.NewReader(body)
-	res, err := http.Post(url, "application/json", payload)
-	if err != nil {
-		return 0, nil, fmt.Errorf("failed POST to %s - %s", url, err)
-	}
-	defer func() {
-		if err := res.Body.Close(); err != nil {
-			log.Println(err)
-		}
-	}()
-	b, err := ioutil.ReadAll(res.Body)
-	return res.StatusCode, b, err
-}
-
 func StripSlackUsers(str string) string {
 	rx := regexp.MustCompile("<@[^>]+>") // Strip users...
 	return strings.TrimSpace(rx.ReplaceAllString(str, ""))